@@ -18,10 +18,24 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package main
 
-import "arylic-connect/localWebsocketApi"
+import (
+	"arylic-connect/localWebsocketApi"
+	"arylic-connect/localWebsocketApi/config"
+	"flag"
+	"log"
+	"os"
+)
 
 func main() {
-	err := localWebsocketApi.RunWebsocketServer()
+	brokerConfig, configErr := config.Load(os.Args[1:])
+	if configErr == flag.ErrHelp {
+		return
+	}
+	if configErr != nil {
+		log.Fatalf("Error loading config: %s\n", configErr)
+	}
+
+	err := localWebsocketApi.RunWebsocketServer(brokerConfig)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,332 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package artwork
+
+import (
+	"arylic-connect/localWebsocketApi/endpoints"
+	"arylic-connect/localWebsocketApi/extWebsocket"
+	"arylic-connect/localWebsocketApi/upgrades"
+	"arylic-connect/rpcWrapper/websocketControl"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxImageSize caps how much of a response is read when fetching artwork.
+const maxImageSize = 16 << 20
+
+// maxFetched caps how many image URLs are remembered, so a long running
+// broker doesn't keep every URL it has ever seen.
+const maxFetched = 1024
+
+var ErrNoArtwork = errors.New("no artwork for current track")
+
+// Artwork describes the cover of the track a device is playing. Path is served
+// by the broker and stays valid for as long as the cache holds the image.
+type Artwork struct {
+	Hash   string `json:"hash"`
+	Source string `json:"source"`
+	Path   string `json:"path"`
+}
+
+type device struct {
+	connection *websocketControl.RPC
+	cancel     func()
+	imageUrl   string
+	current    Artwork
+}
+
+// Service follows the websocket status stream of each device, fetching the
+// cover whenever the track changes so browsers only ever load it from us.
+type Service struct {
+	websocketConnections *extWebsocket.ExternalWebsocketWrapper
+	cache                *cache
+	client               http.Client
+
+	lock    sync.Mutex
+	devices map[string]*device
+	fetched map[string]string // image URL to content hash
+}
+
+func New(websocket *extWebsocket.ExternalWebsocketWrapper, cacheDir string) (*Service, error) {
+	if cacheDir == "" {
+		cacheDir = defaultCacheDir()
+	}
+	diskCache, cacheErr := newCache(cacheDir)
+	if cacheErr != nil {
+		return nil, cacheErr
+	}
+	service := &Service{
+		websocketConnections: websocket,
+		cache:                diskCache,
+		client:               http.Client{Timeout: time.Second * 15},
+		devices:              make(map[string]*device),
+		fetched:              make(map[string]string),
+	}
+	websocket.Endpoints.OnChange(service.endpointChanged)
+	return service, nil
+}
+
+// endpointChanged stops following a device when its connection is lost or
+// replaced, moving over to the new connection if there is one. The status
+// stream of a dead connection may never close, so this can't be left to
+// follow. Wrappers can call this with their lock held, so the work is done
+// separately.
+func (service *Service) endpointChanged(change endpoints.Change) {
+	if change.Endpoint.State == endpoints.State_Connected && !change.NewConnection {
+		return
+	}
+	go func() {
+		service.lock.Lock()
+		watched, hasDevice := service.devices[change.Endpoint.Name]
+		if hasDevice {
+			watched.cancel()
+			delete(service.devices, change.Endpoint.Name)
+		}
+		service.lock.Unlock()
+		if hasDevice && change.Endpoint.State == endpoints.State_Connected {
+			service.Watch(change.Endpoint.Name)
+		}
+	}()
+}
+
+// Watch starts following a device, restarting if its connection was
+// replaced since the last call.
+func (service *Service) Watch(target string) error {
+	service.websocketConnections.OpLock.RLock()
+	connection, hasConnection := service.websocketConnections.HttpMediaCons[target]
+	service.websocketConnections.OpLock.RUnlock()
+	if !hasConnection {
+		return errors.New("endpoint not found")
+	}
+
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	existing, hasDevice := service.devices[target]
+	if hasDevice {
+		if existing.connection == connection {
+			return nil
+		}
+		existing.cancel()
+	}
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	watched := &device{connection: connection, cancel: ctxCancel}
+	service.devices[target] = watched
+	go service.follow(ctx, target, watched)
+	return nil
+}
+
+func (service *Service) follow(ctx context.Context, target string, watched *device) {
+	defer func() {
+		service.lock.Lock()
+		if service.devices[target] == watched {
+			delete(service.devices, target)
+		}
+		service.lock.Unlock()
+	}()
+
+	statusChannel := watched.connection.StatusChangeChannel(ctx)
+	base := "http://" + upgrades.HostOf(watched.connection.TransportTarget()) + "/"
+	status, statusErr := watched.connection.GetStatus(ctx)
+	if statusErr == nil {
+		service.trackChanged(ctx, target, watched, base, status.Image)
+	}
+	for status := range statusChannel {
+		service.trackChanged(ctx, target, watched, base, status.Image)
+	}
+}
+
+// trackChanged fetches the image for a status if it differs from the last one
+// seen for the device.
+func (service *Service) trackChanged(ctx context.Context, target string, watched *device, base string, image string) {
+	service.lock.Lock()
+	if watched.imageUrl == image {
+		service.lock.Unlock()
+		return
+	}
+	watched.imageUrl = image
+	watched.current = Artwork{}
+	knownHash, known := service.fetched[image]
+	service.lock.Unlock()
+
+	if image == "" {
+		return
+	}
+	// The image may have been evicted from the cache since
+	if known && !service.cache.has(knownHash) {
+		known = false
+	}
+
+	hash := knownHash
+	if !known {
+		var fetchErr error
+		hash, fetchErr = service.fetch(ctx, base, image)
+		if fetchErr != nil {
+			log.Printf("Error fetching artwork for %s: %s\n", target, fetchErr)
+			return
+		}
+	}
+
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	if _, remembered := service.fetched[image]; !remembered && len(service.fetched) >= maxFetched {
+		// Map order is random, which is as good as any for URLs that are
+		// cheap to fetch again
+		for forgotten := range service.fetched {
+			delete(service.fetched, forgotten)
+			break
+		}
+	}
+	service.fetched[image] = hash
+	// The track may have moved on while the image downloaded.
+	if watched.imageUrl == image {
+		watched.current = Artwork{
+			Hash:   hash,
+			Source: image,
+			Path:   fmt.Sprintf("/art/%s/%s", url.PathEscape(target), hash),
+		}
+	}
+}
+
+func (service *Service) fetch(ctx context.Context, base string, image string) (string, error) {
+	baseUrl, _ := url.Parse(base)
+	imageUrl, parseErr := baseUrl.Parse(image)
+	if parseErr != nil {
+		return "", parseErr
+	}
+	if imageUrl.Scheme != "http" && imageUrl.Scheme != "https" {
+		return "", errors.New("unsupported artwork URL scheme")
+	}
+
+	fetchCtx, fetchCancel := context.WithTimeout(ctx, time.Second*15)
+	defer fetchCancel()
+	request, requestErr := http.NewRequestWithContext(fetchCtx, http.MethodGet, imageUrl.String(), nil)
+	if requestErr != nil {
+		return "", requestErr
+	}
+	response, responseErr := service.client.Do(request)
+	if responseErr != nil {
+		return "", responseErr
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("artwork request returned %s", response.Status)
+	}
+
+	data, readErr := io.ReadAll(io.LimitReader(response.Body, maxImageSize+1))
+	if readErr != nil {
+		return "", readErr
+	}
+	if len(data) > maxImageSize {
+		return "", errors.New("artwork too large")
+	}
+	if !strings.HasPrefix(http.DetectContentType(data), "image/") {
+		return "", errors.New("artwork is not an image")
+	}
+	return service.cache.store(data)
+}
+
+// GetArtwork returns the cover of the track a device is currently playing.
+func (service *Service) GetArtwork(ctx context.Context, target string) (Artwork, error) {
+	watchErr := service.Watch(target)
+	if watchErr != nil {
+		return Artwork{}, watchErr
+	}
+
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	watched, hasDevice := service.devices[target]
+	if !hasDevice {
+		// Its connection went away since Watch
+		return Artwork{}, ErrNoArtwork
+	}
+	current := watched.current
+	if current.Hash == "" {
+		return Artwork{}, ErrNoArtwork
+	}
+	return current, nil
+}
+
+// Handler serves /art/<device>/current and /art/<device>/<hash>, with an
+// optional ?size= for a thumbnail. The hash form never changes so can be
+// cached by the browser, the current form always points at the latest cover.
+//
+// It's kept off Service itself so the RPC server doesn't pick it up.
+func (service *Service) Handler() http.Handler {
+	return http.HandlerFunc(service.serveArt)
+}
+
+func (service *Service) serveArt(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/art/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	target, unescapeErr := url.PathUnescape(parts[0])
+	if unescapeErr != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	size := 0
+	if sizeParam := r.URL.Query().Get("size"); sizeParam != "" {
+		parsedSize, sizeErr := strconv.Atoi(sizeParam)
+		if sizeErr != nil || !validThumbnailSize(parsedSize) {
+			http.Error(w, fmt.Sprintf("size must be one of %v", ThumbnailSizes), http.StatusBadRequest)
+			return
+		}
+		size = parsedSize
+	}
+
+	hash := parts[1]
+	if hash == "current" {
+		current, artworkErr := service.GetArtwork(r.Context(), target)
+		if artworkErr != nil {
+			http.NotFound(w, r)
+			return
+		}
+		hash = current.Hash
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+
+	data, loadErr := service.cache.load(hash, size)
+	if loadErr != nil {
+		http.NotFound(w, r)
+		return
+	}
+	etag := `"` + hash + `"`
+	if size != 0 {
+		etag = fmt.Sprintf(`"%s_%d"`, hash, size)
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
@@ -0,0 +1,202 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package artwork
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxCacheSize is how much the disk cache can hold before the least recently
+// used images are removed.
+const maxCacheSize = 256 << 20
+
+// cache stores images on disk named by the hash of their contents, so the same
+// cover shared by a whole album is only stored once.
+type cache struct {
+	dir string
+
+	evictLock sync.Mutex
+}
+
+func newCache(dir string) (*cache, error) {
+	mkdirErr := os.MkdirAll(dir, 0755)
+	if mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	return &cache{dir: dir}, nil
+}
+
+// defaultCacheDir picks the user cache directory, falling back to the temp
+// directory on systems without one.
+func defaultCacheDir() string {
+	base, cacheErr := os.UserCacheDir()
+	if cacheErr != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "arylic-connect", "artwork")
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, decodeErr := hex.DecodeString(hash)
+	return decodeErr == nil && strings.ToLower(hash) == hash
+}
+
+func (c *cache) path(hash string, size int) string {
+	if size == 0 {
+		return filepath.Join(c.dir, hash)
+	}
+	return filepath.Join(c.dir, fmt.Sprintf("%s_%d.jpg", hash, size))
+}
+
+// has checks the original of an image is still cached.
+func (c *cache) has(hash string) bool {
+	_, statErr := os.Stat(c.path(hash, 0))
+	return statErr == nil
+}
+
+// store writes an original image, returning its hash.
+func (c *cache) store(data []byte) (string, error) {
+	hash := hashOf(data)
+	path := c.path(hash, 0)
+	if c.has(hash) {
+		touch(path)
+		return hash, nil
+	}
+	writeErr := writeAtomic(path, data)
+	if writeErr == nil {
+		c.evict()
+	}
+	return hash, writeErr
+}
+
+// touch marks a file as used, so eviction goes by last use rather than when
+// it was first stored.
+func touch(path string) {
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+// evict removes the least recently used files until the cache fits in
+// maxCacheSize.
+func (c *cache) evict() {
+	c.evictLock.Lock()
+	defer c.evictLock.Unlock()
+
+	entries, readErr := os.ReadDir(c.dir)
+	if readErr != nil {
+		log.Printf("Error reading artwork cache: %s\n", readErr.Error())
+		return
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	var total int64
+	for _, entry := range entries {
+		info, infoErr := entry.Info()
+		if infoErr != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+	if total <= maxCacheSize {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, file := range files {
+		if total <= maxCacheSize {
+			break
+		}
+		removeErr := os.Remove(filepath.Join(c.dir, file.Name()))
+		if removeErr == nil {
+			total -= file.Size()
+		}
+	}
+}
+
+// load reads an image back, generating and storing the thumbnail on first use
+// when a size is given.
+func (c *cache) load(hash string, size int) ([]byte, error) {
+	if !validHash(hash) {
+		return nil, errors.New("invalid artwork hash")
+	}
+	if size != 0 && !validThumbnailSize(size) {
+		return nil, errors.New("unsupported thumbnail size")
+	}
+
+	data, readErr := os.ReadFile(c.path(hash, size))
+	if readErr == nil {
+		touch(c.path(hash, size))
+	}
+	if readErr == nil || size == 0 {
+		return data, readErr
+	}
+
+	original, originalErr := os.ReadFile(c.path(hash, 0))
+	if originalErr != nil {
+		return nil, originalErr
+	}
+	scaled, scaleErr := thumbnail(original, size)
+	if scaleErr != nil {
+		return nil, scaleErr
+	}
+	writeErr := writeAtomic(c.path(hash, size), scaled)
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	c.evict()
+	return scaled, nil
+}
+
+// writeAtomic writes through a temp file so a reader never sees half an image.
+func writeAtomic(path string, data []byte) error {
+	temp, createErr := os.CreateTemp(filepath.Dir(path), ".partial-*")
+	if createErr != nil {
+		return createErr
+	}
+	_, writeErr := temp.Write(data)
+	closeErr := temp.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(temp.Name())
+		return writeErr
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,134 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package artwork
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+// ThumbnailSizes are the edge lengths thumbnails can be requested at. Keeping
+// this to a fixed set bounds how much the disk cache can grow per image.
+var ThumbnailSizes = []int{64, 128, 256, 512}
+
+func validThumbnailSize(size int) bool {
+	for _, allowed := range ThumbnailSizes {
+		if allowed == size {
+			return true
+		}
+	}
+	return false
+}
+
+// maxImagePixels caps the size of image that gets decoded. Images come from the
+// device, and a small file can claim dimensions that would take gigabytes to
+// decode.
+const maxImagePixels = 4096 * 4096
+
+// thumbnail scales an image down so its longest edge is size pixels and
+// encodes it as a JPEG. Images already smaller than that are only re-encoded.
+func thumbnail(data []byte, size int) ([]byte, error) {
+	config, _, configErr := image.DecodeConfig(bytes.NewReader(data))
+	if configErr != nil {
+		return nil, configErr
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, errors.New("artwork dimensions too large to scale")
+	}
+
+	source, _, decodeErr := image.Decode(bytes.NewReader(data))
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			height = height * size / width
+			width = size
+		} else {
+			width = width * size / height
+			height = size
+		}
+		if width < 1 {
+			width = 1
+		}
+		if height < 1 {
+			height = 1
+		}
+	}
+
+	scaled := boxScale(source, width, height)
+	output := bytes.Buffer{}
+	encodeErr := jpeg.Encode(&output, scaled, &jpeg.Options{Quality: 85})
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+	return output.Bytes(), nil
+}
+
+// boxScale resizes by averaging every source pixel that falls under each
+// destination pixel, which is plenty for downscaling cover art.
+func boxScale(source image.Image, width int, height int) *image.RGBA {
+	bounds := source.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), source, bounds.Min, draw.Src)
+
+	sourceWidth, sourceHeight := bounds.Dx(), bounds.Dy()
+	output := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		top := y * sourceHeight / height
+		bottom := (y + 1) * sourceHeight / height
+		if bottom <= top {
+			bottom = top + 1
+		}
+		for x := 0; x < width; x++ {
+			left := x * sourceWidth / width
+			right := (x + 1) * sourceWidth / width
+			if right <= left {
+				right = left + 1
+			}
+
+			var r, g, b, a, count uint32
+			for sy := top; sy < bottom; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := left; sx < right; sx++ {
+					pixel := row[sx*4 : sx*4+4]
+					r += uint32(pixel[0])
+					g += uint32(pixel[1])
+					b += uint32(pixel[2])
+					a += uint32(pixel[3])
+					count++
+				}
+			}
+			offset := y*output.Stride + x*4
+			output.Pix[offset] = uint8(r / count)
+			output.Pix[offset+1] = uint8(g / count)
+			output.Pix[offset+2] = uint8(b / count)
+			output.Pix[offset+3] = uint8(a / count)
+		}
+	}
+	return output
+}
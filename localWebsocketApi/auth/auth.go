@@ -0,0 +1,255 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package auth authenticates control API clients and limits the JSON-RPC
+// methods they can call to the scopes of their role.
+package auth
+
+import (
+	"arylic-connect/localWebsocketApi/config"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var ErrUnauthenticated = errors.New("authentication required")
+var ErrForbidden = errors.New("not permitted for this role")
+
+// Principal is who a request was made by.
+type Principal struct {
+	Name   string
+	Role   string
+	scopes map[Scope]bool
+}
+
+func (principal Principal) Has(scope Scope) bool {
+	return principal.scopes[scope]
+}
+
+// anonymous is used for every request when auth is off.
+var anonymous = Principal{Name: "anonymous", Role: "admin", scopes: scopeSet(allScopes)}
+
+func scopeSet(scopes []Scope) map[Scope]bool {
+	set := make(map[Scope]bool)
+	for _, scope := range scopes {
+		set[scope] = true
+	}
+	return set
+}
+
+type credential struct {
+	name   string
+	secret string
+	role   string
+}
+
+type Authenticator struct {
+	enabled        bool
+	allowAnyOrigin bool
+	origins        map[string]bool
+	roles          map[string]map[Scope]bool
+	tokens         []credential
+	users          []credential
+}
+
+func New(authConfig config.Auth) (*Authenticator, error) {
+	authenticator := &Authenticator{
+		enabled: authConfig.Enabled,
+		origins: make(map[string]bool),
+		roles:   make(map[string]map[Scope]bool),
+	}
+
+	for _, origin := range authConfig.AllowedOrigins {
+		if origin == "*" {
+			authenticator.allowAnyOrigin = true
+			continue
+		}
+		authenticator.origins[strings.TrimSuffix(strings.ToLower(origin), "/")] = true
+	}
+
+	for role, scopes := range DefaultRoles {
+		authenticator.roles[role] = scopeSet(scopes)
+	}
+	for role, names := range authConfig.Roles {
+		scopes := make([]Scope, 0, len(names))
+		for _, name := range names {
+			if !validScope(Scope(name)) {
+				return nil, fmt.Errorf("role %s has unknown scope %s", role, name)
+			}
+			scopes = append(scopes, Scope(name))
+		}
+		authenticator.roles[role] = scopeSet(scopes)
+	}
+
+	for _, token := range authConfig.Tokens {
+		if token.Token == "" {
+			return nil, fmt.Errorf("token %s is empty", token.Name)
+		}
+		if _, known := authenticator.roles[token.Role]; !known {
+			return nil, fmt.Errorf("token %s has unknown role %s", token.Name, token.Role)
+		}
+		authenticator.tokens = append(authenticator.tokens, credential{name: token.Name, secret: token.Token, role: token.Role})
+	}
+	for _, user := range authConfig.Users {
+		if user.Name == "" || user.Password == "" {
+			return nil, errors.New("users need a name and password")
+		}
+		if _, known := authenticator.roles[user.Role]; !known {
+			return nil, fmt.Errorf("user %s has unknown role %s", user.Name, user.Role)
+		}
+		authenticator.users = append(authenticator.users, credential{name: user.Name, secret: user.Password, role: user.Role})
+	}
+	return authenticator, nil
+}
+
+func validScope(scope Scope) bool {
+	for _, known := range allScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (authenticator *Authenticator) principal(entry credential) Principal {
+	return Principal{Name: entry.name, Role: entry.role, scopes: authenticator.roles[entry.role]}
+}
+
+func passwordMatches(stored string, given string) bool {
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(given)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1
+}
+
+// Authenticate works out who made a request, from a bearer token, a token
+// query parameter (for websockets and images in browsers, which can't set
+// headers) or basic auth.
+func (authenticator *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if !authenticator.enabled {
+		return anonymous, nil
+	}
+
+	token := r.URL.Query().Get("token")
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		token = strings.TrimPrefix(header, "Bearer ")
+	}
+	if token != "" {
+		for _, entry := range authenticator.tokens {
+			if subtle.ConstantTimeCompare([]byte(entry.secret), []byte(token)) == 1 {
+				return authenticator.principal(entry), nil
+			}
+		}
+		return Principal{}, ErrUnauthenticated
+	}
+
+	name, password, hasBasic := r.BasicAuth()
+	if hasBasic {
+		for _, entry := range authenticator.users {
+			if entry.name == name && passwordMatches(entry.secret, password) {
+				return authenticator.principal(entry), nil
+			}
+		}
+	}
+	return Principal{}, ErrUnauthenticated
+}
+
+// CheckOrigin allows requests from the broker's own pages, the configured
+// origins and non-browser clients, which don't send an Origin.
+func (authenticator *Authenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || authenticator.allowAnyOrigin {
+		return true
+	}
+	parsed, parseErr := url.Parse(origin)
+	if parseErr == nil && strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	return authenticator.origins[strings.TrimSuffix(strings.ToLower(origin), "/")]
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the principal a request was authenticated as. Contexts
+// that didn't come through the authenticator, like the broker's own calls,
+// are trusted.
+func FromContext(ctx context.Context) Principal {
+	principal, found := ctx.Value(principalKey{}).(Principal)
+	if !found {
+		return anonymous
+	}
+	return principal
+}
+
+// Allowed checks the principal in ctx may call a JSON-RPC method.
+func Allowed(ctx context.Context, method string) error {
+	return FromContext(ctx).allowed(method)
+}
+
+func (principal Principal) allowed(method string) error {
+	scope := ScopeFor(method)
+	if !principal.Has(scope) {
+		return fmt.Errorf("%w: %s needs the %s scope", ErrForbidden, method, scope)
+	}
+	return nil
+}
+
+func (authenticator *Authenticator) reject(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusUnauthorized && len(authenticator.users) != 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="arylic-connect"`)
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// Require authenticates requests before passing them on, with the principal
+// in the request context.
+func (authenticator *Authenticator) Require(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authenticator.CheckOrigin(r) {
+			authenticator.reject(w, http.StatusForbidden, errors.New("origin not allowed"))
+			return
+		}
+		principal, authErr := authenticator.Authenticate(r)
+		if authErr != nil {
+			authenticator.reject(w, http.StatusUnauthorized, authErr)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// RequireScope is Require for handlers that aren't JSON-RPC methods.
+func (authenticator *Authenticator) RequireScope(scope Scope, handler http.Handler) http.Handler {
+	return authenticator.Require(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !FromContext(r.Context()).Has(scope) {
+			authenticator.reject(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,146 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"strings"
+)
+
+// Scope is a group of JSON-RPC methods granted together.
+type Scope string
+
+const (
+	Scope_Read     Scope = "read"     // status, settings and subscriptions
+	Scope_Playback Scope = "playback" // transport controls, volume, mute and source
+	Scope_Settings Scope = "settings" // device settings like EQ, alarms and names
+	Scope_Network  Scope = "network"  // Wi-Fi, ethernet and broker connections
+	Scope_System   Scope = "system"   // reboot, reset, upgrades and raw commands
+)
+
+var allScopes = []Scope{Scope_Read, Scope_Playback, Scope_Settings, Scope_Network, Scope_System}
+
+// DefaultRoles are the built-in roles, which config may add to or replace.
+var DefaultRoles = map[string][]Scope{
+	"readonly": {Scope_Read},
+	"playback": {Scope_Read, Scope_Playback},
+	"operator": {Scope_Read, Scope_Playback, Scope_Settings},
+	"admin":    allScopes,
+}
+
+// methodScopes lists methods by name without their namespace, as the same
+// call means the same thing whichever transport or service it's made through.
+var methodScopes = map[string]Scope{
+	"connectedEndpoints": Scope_Read,
+	"mediaReady":         Scope_Read,
+	"checkForUpdate":     Scope_Read,
+	"unsubscribe":        Scope_Read,
+	"modules":            Scope_Read,
+	"presence":           Scope_Read,
+
+	"requestPlay":      Scope_Playback,
+	"requestPause":     Scope_Playback,
+	"requestPlayPause": Scope_Playback,
+	"requestStop":      Scope_Playback,
+	"requestNext":      Scope_Playback,
+	"requestPrevious":  Scope_Playback,
+	"seek":             Scope_Playback,
+	"setLoopMode":      Scope_Playback,
+	"playLocalTrack":   Scope_Playback,
+	"setVolume":        Scope_Playback,
+	"setMute":          Scope_Playback,
+	"toggleMute":       Scope_Playback,
+	"setSource":        Scope_Playback,
+	"setInput":         Scope_Playback,
+
+	"setBalance":         Scope_Settings,
+	"setBass":            Scope_Settings,
+	"setTreble":          Scope_Settings,
+	"setVirtualBass":     Scope_Settings,
+	"toggleVirtualBass":  Scope_Settings,
+	"setBeep":            Scope_Settings,
+	"setLED":             Scope_Settings,
+	"toggleLED":          Scope_Settings,
+	"setFixedVolume":     Scope_Settings,
+	"setMaxVolume":       Scope_Settings,
+	"setVolumeSync":      Scope_Settings,
+	"setInputAutoswitch": Scope_Settings,
+	"setDefaultSource":   Scope_Settings,
+	"setVoicePrompt":     Scope_Settings,
+	"setLanguage":        Scope_Settings,
+	"setName":            Scope_Settings,
+	"setDeviceName":      Scope_Settings,
+	"setBluetooth":       Scope_Settings,
+	"setAlarm":           Scope_Settings,
+	"clearAlarm":         Scope_Settings,
+	"stopAlarm":          Scope_Settings,
+	"setSleepTimer":      Scope_Settings,
+	"cancelSleepTimer":   Scope_Settings,
+	"setTimeZone":        Scope_Settings,
+	"requestStandby":     Scope_Settings,
+	"setZone":            Scope_Settings,
+	"deleteZone":         Scope_Settings,
+	"setJob":             Scope_Settings,
+	"setJobEnabled":      Scope_Settings,
+	"deleteJob":          Scope_Settings,
+	"runJob":             Scope_Settings,
+
+	"connectToWifi":       Scope_Network,
+	"connectToHiddenWifi": Scope_Network,
+	"setWifi":             Scope_Network,
+	"setEthernet":         Scope_Network,
+	"setEthernetDHCP":     Scope_Network,
+	"setEthernetStatic":   Scope_Network,
+	"setDNS":              Scope_Network,
+	"setInternet":         Scope_Network,
+	"setApSSID":           Scope_Network,
+	"setApPassword":       Scope_Network,
+	"setHideSSID":         Scope_Network,
+	"requestWifiReset":    Scope_Network,
+	"connectEndpoint":     Scope_Network,
+	"disconnectEndpoint":  Scope_Network,
+	"reconnectEndpoint":   Scope_Network,
+	"forgetEndpoint":      Scope_Network,
+
+	"requestReset":   Scope_System,
+	"requestReboot":  Scope_System,
+	"requestRecover": Scope_System,
+	"startUpdate":    Scope_System,
+	"directCommand":  Scope_System,
+}
+
+// ScopeFor returns the scope needed to call a JSON-RPC method, like
+// httpmedia_getStatus. Subscriptions take the name of the subscription as
+// the method. Reads are recognised by name, and anything unknown needs the
+// system scope so new methods are locked down until they're listed.
+func ScopeFor(method string) Scope {
+	name := method
+	separator := strings.Index(method, "_")
+	if separator != -1 {
+		name = method[separator+1:]
+	}
+
+	scope, listed := methodScopes[name]
+	if listed {
+		return scope
+	}
+	if strings.HasPrefix(name, "get") || strings.HasPrefix(name, "list") || strings.HasSuffix(name, "Changes") || strings.HasSuffix(name, "Channel") {
+		return Scope_Read
+	}
+	return Scope_System
+}
@@ -0,0 +1,302 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"arylic-connect/localWebsocketApi/artwork"
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/localWebsocketApi/extWebsocket"
+	"arylic-connect/localWebsocketApi/httpmedia"
+	"arylic-connect/localWebsocketApi/nowplaying"
+	"arylic-connect/localWebsocketApi/scheduler"
+	"arylic-connect/localWebsocketApi/serialmedia"
+	"arylic-connect/localWebsocketApi/zones"
+	"github.com/ethereum/go-ethereum/rpc"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// expectedScopes is every method the RPC server serves, subscriptions
+// included, with the scope it should need.
+var expectedScopes = map[string]Scope{
+	"rpc_modules": Scope_Read,
+
+	"serialmedia_connectEndpoint":    Scope_Network,
+	"serialmedia_connectedEndpoints": Scope_Read,
+	"serialmedia_directCommand":      Scope_System,
+	"serialmedia_disconnectEndpoint": Scope_Network,
+	"serialmedia_forgetEndpoint":     Scope_Network,
+	"serialmedia_getBalance":         Scope_Read,
+	"serialmedia_getBass":            Scope_Read,
+	"serialmedia_getBeep":            Scope_Read,
+	"serialmedia_getBluetooth":       Scope_Read,
+	"serialmedia_getChannelConfig":   Scope_Read,
+	"serialmedia_getDefaultSource":   Scope_Read,
+	"serialmedia_getEthernet":        Scope_Read,
+	"serialmedia_getFixedVolume":     Scope_Read,
+	"serialmedia_getInputAutoswitch": Scope_Read,
+	"serialmedia_getInternet":        Scope_Read,
+	"serialmedia_getLED":             Scope_Read,
+	"serialmedia_getLoopMode":        Scope_Read,
+	"serialmedia_getMaxVolume":       Scope_Read,
+	"serialmedia_getMultiroomMode":   Scope_Read,
+	"serialmedia_getMute":            Scope_Read,
+	"serialmedia_getName":            Scope_Read,
+	"serialmedia_getSource":          Scope_Read,
+	"serialmedia_getStatus":          Scope_Read,
+	"serialmedia_getTreble":          Scope_Read,
+	"serialmedia_getVersion":         Scope_Read,
+	"serialmedia_getVirtualBass":     Scope_Read,
+	"serialmedia_getVoicePrompt":     Scope_Read,
+	"serialmedia_getVolume":          Scope_Read,
+	"serialmedia_getVolumeSync":      Scope_Read,
+	"serialmedia_getWifi":            Scope_Read,
+	"serialmedia_getWifiPlayback":    Scope_Read,
+	"serialmedia_listEndpoints":      Scope_Read,
+	"serialmedia_mediaReady":         Scope_Read,
+	"serialmedia_metadataChanges":    Scope_Read,
+	"serialmedia_muteChanges":        Scope_Read,
+	"serialmedia_playChanges":        Scope_Read,
+	"serialmedia_reconnectEndpoint":  Scope_Network,
+	"serialmedia_requestNext":        Scope_Playback,
+	"serialmedia_requestPlayPause":   Scope_Playback,
+	"serialmedia_requestPrevious":    Scope_Playback,
+	"serialmedia_requestReboot":      Scope_System,
+	"serialmedia_requestRecover":     Scope_System,
+	"serialmedia_requestReset":       Scope_System,
+	"serialmedia_requestStandby":     Scope_Settings,
+	"serialmedia_requestStop":        Scope_Playback,
+	"serialmedia_requestWifiReset":   Scope_Network,
+	"serialmedia_setBalance":         Scope_Settings,
+	"serialmedia_setBass":            Scope_Settings,
+	"serialmedia_setBeep":            Scope_Settings,
+	"serialmedia_setBluetooth":       Scope_Settings,
+	"serialmedia_setDefaultSource":   Scope_Settings,
+	"serialmedia_setEthernet":        Scope_Network,
+	"serialmedia_setFixedVolume":     Scope_Settings,
+	"serialmedia_setInputAutoswitch": Scope_Settings,
+	"serialmedia_setInternet":        Scope_Network,
+	"serialmedia_setLED":             Scope_Settings,
+	"serialmedia_setLoopMode":        Scope_Playback,
+	"serialmedia_setMaxVolume":       Scope_Settings,
+	"serialmedia_setMute":            Scope_Playback,
+	"serialmedia_setName":            Scope_Settings,
+	"serialmedia_setSource":          Scope_Playback,
+	"serialmedia_setTreble":          Scope_Settings,
+	"serialmedia_setVirtualBass":     Scope_Settings,
+	"serialmedia_setVoicePrompt":     Scope_Settings,
+	"serialmedia_setVolume":          Scope_Playback,
+	"serialmedia_setVolumeSync":      Scope_Settings,
+	"serialmedia_setWifi":            Scope_Network,
+	"serialmedia_toggleLED":          Scope_Settings,
+	"serialmedia_toggleMute":         Scope_Playback,
+	"serialmedia_toggleVirtualBass":  Scope_Settings,
+	"serialmedia_volumeChanges":      Scope_Read,
+
+	"httpmedia_cancelSleepTimer":    Scope_Settings,
+	"httpmedia_checkForUpdate":      Scope_Read,
+	"httpmedia_clearAlarm":          Scope_Settings,
+	"httpmedia_connectEndpoint":     Scope_Network,
+	"httpmedia_connectToHiddenWifi": Scope_Network,
+	"httpmedia_connectToWifi":       Scope_Network,
+	"httpmedia_connectedEndpoints":  Scope_Read,
+	"httpmedia_disconnectEndpoint":  Scope_Network,
+	"httpmedia_forgetEndpoint":      Scope_Network,
+	"httpmedia_getAlarm":            Scope_Read,
+	"httpmedia_getAlarms":           Scope_Read,
+	"httpmedia_getApList":           Scope_Read,
+	"httpmedia_getCapabilities":     Scope_Read,
+	"httpmedia_getLocalTrackCount":  Scope_Read,
+	"httpmedia_getLocalTracks":      Scope_Read,
+	"httpmedia_getPlayerStatus":     Scope_Read,
+	"httpmedia_getSleepTimer":       Scope_Read,
+	"httpmedia_getStatus":           Scope_Read,
+	"httpmedia_getUpdateState":      Scope_Read,
+	"httpmedia_getWlanState":        Scope_Read,
+	"httpmedia_listEndpoints":       Scope_Read,
+	"httpmedia_listUpdates":         Scope_Read,
+	"httpmedia_metadataChanges":     Scope_Read,
+	"httpmedia_muteChanges":         Scope_Read,
+	"httpmedia_playChanges":         Scope_Read,
+	"httpmedia_playLocalTrack":      Scope_Playback,
+	"httpmedia_reconnectEndpoint":   Scope_Network,
+	"httpmedia_setAlarm":            Scope_Settings,
+	"httpmedia_setApPassword":       Scope_Network,
+	"httpmedia_setApSSID":           Scope_Network,
+	"httpmedia_setDNS":              Scope_Network,
+	"httpmedia_setDeviceName":       Scope_Settings,
+	"httpmedia_setEthernetDHCP":     Scope_Network,
+	"httpmedia_setEthernetStatic":   Scope_Network,
+	"httpmedia_setHideSSID":         Scope_Network,
+	"httpmedia_setLanguage":         Scope_Settings,
+	"httpmedia_setSleepTimer":       Scope_Settings,
+	"httpmedia_setTimeZone":         Scope_Settings,
+	"httpmedia_setVoicePrompt":      Scope_Settings,
+	"httpmedia_startUpdate":         Scope_System,
+	"httpmedia_statusChanges":       Scope_Read,
+	"httpmedia_stopAlarm":           Scope_Settings,
+	"httpmedia_updateChanges":       Scope_Read,
+	"httpmedia_volumeChanges":       Scope_Read,
+
+	"websocketmedia_connectEndpoint":    Scope_Network,
+	"websocketmedia_connectedEndpoints": Scope_Read,
+	"websocketmedia_disconnectEndpoint": Scope_Network,
+	"websocketmedia_forgetEndpoint":     Scope_Network,
+	"websocketmedia_getStatus":          Scope_Read,
+	"websocketmedia_listEndpoints":      Scope_Read,
+	"websocketmedia_reconnectEndpoint":  Scope_Network,
+	"websocketmedia_requestNext":        Scope_Playback,
+	"websocketmedia_requestPause":       Scope_Playback,
+	"websocketmedia_requestPlay":        Scope_Playback,
+	"websocketmedia_requestPrevious":    Scope_Playback,
+	"websocketmedia_seek":               Scope_Playback,
+	"websocketmedia_setInput":           Scope_Playback,
+	"websocketmedia_setLoopMode":        Scope_Playback,
+	"websocketmedia_setVolume":          Scope_Playback,
+	"websocketmedia_statusChanges":      Scope_Read,
+
+	"devices_getDevice":        Scope_Read,
+	"devices_getMute":          Scope_Read,
+	"devices_getPlayerStatus":  Scope_Read,
+	"devices_getSource":        Scope_Read,
+	"devices_getStatus":        Scope_Read,
+	"devices_getVolume":        Scope_Read,
+	"devices_listDevices":      Scope_Read,
+	"devices_presence":         Scope_Read,
+	"devices_requestNext":      Scope_Playback,
+	"devices_requestPause":     Scope_Playback,
+	"devices_requestPlay":      Scope_Playback,
+	"devices_requestPlayPause": Scope_Playback,
+	"devices_requestPrevious":  Scope_Playback,
+	"devices_requestStandby":   Scope_Settings,
+	"devices_requestStop":      Scope_Playback,
+	"devices_setMute":          Scope_Playback,
+	"devices_setSource":        Scope_Playback,
+	"devices_setVolume":        Scope_Playback,
+
+	"zones_deleteZone":       Scope_Settings,
+	"zones_getZone":          Scope_Read,
+	"zones_listZones":        Scope_Read,
+	"zones_requestNext":      Scope_Playback,
+	"zones_requestPause":     Scope_Playback,
+	"zones_requestPlay":      Scope_Playback,
+	"zones_requestPlayPause": Scope_Playback,
+	"zones_requestPrevious":  Scope_Playback,
+	"zones_requestStandby":   Scope_Settings,
+	"zones_requestStop":      Scope_Playback,
+	"zones_setMute":          Scope_Playback,
+	"zones_setSource":        Scope_Playback,
+	"zones_setVolume":        Scope_Playback,
+	"zones_setZone":          Scope_Settings,
+
+	"scheduler_deleteJob":     Scope_Settings,
+	"scheduler_getHistory":    Scope_Read,
+	"scheduler_getJob":        Scope_Read,
+	"scheduler_getNextRuns":   Scope_Read,
+	"scheduler_listJobs":      Scope_Read,
+	"scheduler_runJob":        Scope_Settings,
+	"scheduler_setJob":        Scope_Settings,
+	"scheduler_setJobEnabled": Scope_Settings,
+
+	"artwork_getArtwork": Scope_Read,
+	// Not meant to be called, so they stay locked down
+	"artwork_handler": Scope_System,
+	"artwork_watch":   Scope_System,
+
+	"nowplaying_getAnchor":       Scope_Read,
+	"nowplaying_positionChanges": Scope_Read,
+}
+
+// registeredMethods lists what a server would answer to, read out of its
+// service registry. The registry isn't exported, but reflection can still read
+// the names.
+func registeredMethods(server *rpc.Server) []string {
+	methods := make([]string, 0)
+	services := reflect.ValueOf(server).Elem().FieldByName("services").FieldByName("services")
+	for _, namespace := range services.MapKeys() {
+		service := services.MapIndex(namespace)
+		for _, field := range []string{"callbacks", "subscriptions"} {
+			for _, name := range service.FieldByName(field).MapKeys() {
+				methods = append(methods, namespace.String()+"_"+name.String())
+			}
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func TestScopeForRegisteredMethods(t *testing.T) {
+	// Registering only looks at the types, so empty services will do
+	server := rpc.NewServer()
+	services := map[string]interface{}{
+		"serialmedia":    &serialmedia.SerialMediaWrapper{},
+		"httpmedia":      &httpmedia.HttpMediaWrapper{},
+		"websocketmedia": &extWebsocket.ExternalWebsocketWrapper{},
+		"devices":        &devices.Registry{},
+		"zones":          &zones.Service{},
+		"scheduler":      &scheduler.Service{},
+		"artwork":        &artwork.Service{},
+		"nowplaying":     &nowplaying.Service{},
+	}
+	for namespace, service := range services {
+		registerErr := server.RegisterName(namespace, service)
+		if registerErr != nil {
+			t.Fatal(registerErr)
+		}
+	}
+
+	registered := registeredMethods(server)
+	if len(registered) == 0 {
+		t.Fatal("no methods found in the server's registry")
+	}
+	seen := make(map[string]bool)
+	for _, method := range registered {
+		seen[method] = true
+		expected, listed := expectedScopes[method]
+		if !listed {
+			t.Errorf("%s is served but has no expected scope, got %s", method, ScopeFor(method))
+			continue
+		}
+		if got := ScopeFor(method); got != expected {
+			t.Errorf("ScopeFor(%q) = %s, want %s", method, got, expected)
+		}
+	}
+	for method := range expectedScopes {
+		if !seen[method] {
+			t.Errorf("%s is expected but not served", method)
+		}
+	}
+}
+
+func TestScopeForUnlisted(t *testing.T) {
+	cases := map[string]Scope{
+		"httpmedia_unsubscribe":    Scope_Read,
+		"httpmedia_getSomething":   Scope_Read,
+		"zones_listSomething":      Scope_Read,
+		"devices_somethingChanges": Scope_Read,
+		"devices_doSomething":      Scope_System,
+		"noNamespace":              Scope_System,
+	}
+	for method, expected := range cases {
+		if got := ScopeFor(method); got != expected {
+			t.Errorf("ScopeFor(%q) = %s, want %s", method, got, expected)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsMessageSizeLimit = 15 * 1024 * 1024
+	wsPingInterval     = 30 * time.Second
+	wsPingWriteTimeout = 5 * time.Second
+
+	// forbiddenCode is the JSON-RPC error code for calls outside the
+	// caller's scopes, from the range left for servers to define.
+	forbiddenCode = -32003
+)
+
+type request struct {
+	ID     json.RawMessage   `json:"id,omitempty"`
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Version string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   rpcError        `json:"error"`
+}
+
+// method is what a request is checked against, which for subscriptions is
+// the subscription rather than the generic subscribe call.
+func (call request) method() string {
+	if strings.HasSuffix(call.Method, "_subscribe") && len(call.Params) != 0 {
+		var name string
+		if json.Unmarshal(call.Params[0], &name) == nil {
+			return strings.TrimSuffix(call.Method, "subscribe") + name
+		}
+	}
+	return call.Method
+}
+
+// denied returns error responses for a message the principal can't send, or
+// nil if it may go through. A batch is refused whole if any call in it is.
+func denied(principal Principal, raw json.RawMessage) []errorResponse {
+	calls := make([]request, 0)
+	isBatch := bytes.HasPrefix(bytes.TrimSpace(raw), []byte("["))
+	if isBatch {
+		json.Unmarshal(raw, &calls)
+	} else {
+		var call request
+		json.Unmarshal(raw, &call)
+		calls = append(calls, call)
+	}
+
+	var refusal error
+	for _, call := range calls {
+		if call.Method == "" {
+			continue
+		}
+		refusal = principal.allowed(call.method())
+		if refusal != nil {
+			break
+		}
+	}
+	if refusal == nil {
+		return nil
+	}
+
+	responses := make([]errorResponse, 0, len(calls))
+	for _, call := range calls {
+		if len(call.ID) == 0 {
+			continue
+		}
+		responses = append(responses, errorResponse{
+			Version: "2.0",
+			ID:      call.ID,
+			Error:   rpcError{Code: forbiddenCode, Message: refusal.Error()},
+		})
+	}
+	return responses
+}
+
+// WebsocketHandler serves JSON-RPC over websockets like rpc.Server's own
+// handler, but checks the origin and credentials on connect and every
+// method called against the caller's scopes.
+func (authenticator *Authenticator) WebsocketHandler(rpcServer *rpc.Server) http.Handler {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: authenticator.CheckOrigin,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authenticator.CheckOrigin(r) {
+			authenticator.reject(w, http.StatusForbidden, ErrForbidden)
+			return
+		}
+		principal, authErr := authenticator.Authenticate(r)
+		if authErr != nil {
+			authenticator.reject(w, http.StatusUnauthorized, authErr)
+			return
+		}
+
+		conn, upgradeErr := upgrader.Upgrade(w, r, nil)
+		if upgradeErr != nil {
+			log.Printf("Websocket upgrade failed: %s\n", upgradeErr.Error())
+			return
+		}
+		conn.SetReadLimit(wsMessageSizeLimit)
+
+		var writeLock sync.Mutex
+		encode := func(v interface{}) error {
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			return conn.WriteJSON(v)
+		}
+		decode := func(v interface{}) error {
+			for {
+				var raw json.RawMessage
+				readErr := conn.ReadJSON(&raw)
+				if readErr != nil {
+					return readErr
+				}
+				responses := denied(principal, raw)
+				if responses == nil {
+					return json.Unmarshal(raw, v)
+				}
+				if len(responses) == 1 && !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+					encode(responses[0])
+				} else if len(responses) != 0 {
+					encode(responses)
+				}
+			}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(wsPingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsPingWriteTimeout))
+				}
+			}
+		}()
+		rpcServer.ServeCodec(rpc.NewFuncCodec(conn, encode, decode), 0)
+		close(done)
+	})
+}
@@ -0,0 +1,274 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package certs provides the TLS setup for the broker's web server.
+package certs
+
+import (
+	"arylic-connect/localWebsocketApi/config"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// selfSignedLifetime is how long generated certificates last. They're
+// regenerated on startup once expired, or once the broker is reachable by a
+// name or address they don't cover.
+const selfSignedLifetime = 825 * 24 * time.Hour
+
+// generatedOrganization marks the certificates the broker generates, so it
+// only ever replaces its own.
+const generatedOrganization = "arylic-connect"
+
+// Load returns the TLS config for the web server, generating a self-signed
+// certificate first if configured to and one isn't there.
+func Load(tlsConfig config.TLS) (*tls.Config, error) {
+	certFile, keyFile := tlsConfig.CertFile, tlsConfig.KeyFile
+	if certFile == "" {
+		configDir, dirErr := os.UserConfigDir()
+		if dirErr != nil {
+			return nil, dirErr
+		}
+		certFile = filepath.Join(configDir, "arylic-connect", "tls", "cert.pem")
+		keyFile = filepath.Join(configDir, "arylic-connect", "tls", "key.pem")
+	}
+
+	if tlsConfig.SelfSigned {
+		prepareErr := prepare(certFile, keyFile)
+		if prepareErr != nil {
+			return nil, prepareErr
+		}
+	}
+
+	certificate, loadErr := tls.LoadX509KeyPair(certFile, keyFile)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}, nil
+}
+
+// prepare generates a certificate if there isn't one, or replaces one the
+// broker generated that has expired or no longer covers it. A certificate
+// from anywhere else is never overwritten.
+func prepare(certFile string, keyFile string) error {
+	certificate, readErr := readCertificate(certFile)
+	switch {
+	case errors.Is(readErr, fs.ErrNotExist):
+		// Nothing there yet
+	case readErr != nil:
+		return fmt.Errorf("reading certificate %s: %w", certFile, readErr)
+	case usable(certificate, keyFile):
+		return nil
+	case !generated(certificate):
+		return fmt.Errorf("certificate %s has expired or doesn't cover this host, and won't be replaced as the broker didn't generate it", certFile)
+	}
+
+	log.Printf("Generating self-signed certificate in %s\n", certFile)
+	generateErr := generate(certFile, keyFile)
+	if generateErr != nil {
+		return fmt.Errorf("generating certificate: %w", generateErr)
+	}
+	return nil
+}
+
+func readCertificate(certFile string) (*x509.Certificate, error) {
+	data, readErr := os.ReadFile(certFile)
+	if readErr != nil {
+		return nil, readErr
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// generated checks a certificate is one the broker made: signed by its own key
+// and issued by generatedOrganization.
+func generated(certificate *x509.Certificate) bool {
+	if !bytes.Equal(certificate.RawIssuer, certificate.RawSubject) {
+		return false
+	}
+	if certificate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature) != nil {
+		return false
+	}
+	for _, organization := range certificate.Subject.Organization {
+		if organization == generatedOrganization {
+			return true
+		}
+	}
+	return false
+}
+
+// usable checks a certificate has its key, hasn't expired and covers the
+// broker's current names and addresses.
+func usable(certificate *x509.Certificate, keyFile string) bool {
+	_, keyErr := os.Stat(keyFile)
+	if keyErr != nil {
+		return false
+	}
+	if !time.Now().Before(certificate.NotAfter) {
+		return false
+	}
+	return covers(certificate)
+}
+
+// covers checks a certificate names every host name and IPv4 address the
+// broker currently has. IPv6 addresses are left out of the check as temporary
+// addresses would have it regenerated on every start.
+func covers(certificate *x509.Certificate) bool {
+	names, addresses := hostNames()
+	for _, name := range names {
+		if certificate.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	for _, address := range addresses {
+		if address.To4() == nil {
+			continue
+		}
+		listed := false
+		for _, certified := range certificate.IPAddresses {
+			if certified.Equal(address) {
+				listed = true
+				break
+			}
+		}
+		if !listed {
+			return false
+		}
+	}
+	return true
+}
+
+// hostNames collects the names and addresses the broker is likely reached
+// by, so the certificate matches whichever one a browser uses.
+func hostNames() ([]string, []net.IP) {
+	names := []string{"localhost"}
+	hostname, hostnameErr := os.Hostname()
+	if hostnameErr == nil {
+		names = append(names, hostname, hostname+".local")
+	}
+
+	addresses := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	interfaceAddresses, addrErr := net.InterfaceAddrs()
+	if addrErr == nil {
+		for _, address := range interfaceAddresses {
+			ipNet, isIpNet := address.(*net.IPNet)
+			// Link-local addresses need a zone, which browsers won't take
+			if isIpNet && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				addresses = append(addresses, ipNet.IP)
+			}
+		}
+	}
+	return names, addresses
+}
+
+// generate writes a self-signed leaf certificate. It isn't a CA, so trusting
+// it trusts this broker and nothing it could sign.
+func generate(certFile string, keyFile string) error {
+	key, keyErr := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if keyErr != nil {
+		return keyErr
+	}
+	serial, serialErr := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if serialErr != nil {
+		return serialErr
+	}
+
+	names, addresses := hostNames()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[len(names)-1], Organization: []string{generatedOrganization}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedLifetime),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  false,
+		DNSNames:              names,
+		IPAddresses:           addresses,
+	}
+	der, createErr := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if createErr != nil {
+		return createErr
+	}
+	keyDer, marshalErr := x509.MarshalECPrivateKey(key)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	writeErr := writePem(keyFile, "EC PRIVATE KEY", keyDer, 0600)
+	if writeErr != nil {
+		return writeErr
+	}
+	return writePem(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePem(path string, blockType string, data []byte, mode fs.FileMode) error {
+	mkdirErr := os.MkdirAll(filepath.Dir(path), 0700)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	file, openErr := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if openErr != nil {
+		return openErr
+	}
+	encodeErr := pem.Encode(file, &pem.Block{Type: blockType, Bytes: data})
+	if encodeErr != nil {
+		file.Close()
+		return encodeErr
+	}
+	return file.Close()
+}
+
+// RedirectHandler sends plain HTTP requests to the same host and path over
+// HTTPS on the port from the HTTPS listen address.
+func RedirectHandler(httpsListen string) http.Handler {
+	_, httpsPort, _ := net.SplitHostPort(httpsListen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, splitErr := net.SplitHostPort(r.Host)
+		if splitErr != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
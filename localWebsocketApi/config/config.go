@@ -0,0 +1,583 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transport switches one of the device APIs on or off, with the port it
+// listens on where the device lets that vary.
+type Transport struct {
+	Enabled bool `yaml:"enabled"`
+	Port    int  `yaml:"port,omitempty"`
+}
+
+type Transports struct {
+	Serial    Transport `yaml:"serial"`
+	Http      Transport `yaml:"http"`
+	Websocket Transport `yaml:"websocket"`
+}
+
+// Scan probes address ranges for devices, for networks where SSDP multicast
+// doesn't get through.
+type Scan struct {
+	// Ranges are CIDR blocks to scan, like 192.168.20.0/24. Scanning is off
+	// when there are none.
+	Ranges []string `yaml:"ranges,omitempty"`
+	// Interval is how often the ranges are scanned.
+	Interval time.Duration `yaml:"interval"`
+	// Concurrency is the most probes in flight at once.
+	Concurrency int `yaml:"concurrency"`
+	// Rate is the most hosts probed per second.
+	Rate int `yaml:"rate"`
+	// Timeout is how long each probe waits for an answer.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type Discovery struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often SSDP is searched and static devices that
+	// dropped off are retried.
+	Interval time.Duration `yaml:"interval"`
+	// Wait is how long each SSDP search listens for replies.
+	Wait time.Duration `yaml:"wait"`
+	// Passive listens for devices announcing themselves and leaving, so
+	// they're picked up without waiting for the next search.
+	Passive bool `yaml:"passive"`
+	// Interfaces limits discovery to the named network interfaces. All
+	// interfaces are used when empty.
+	Interfaces []string `yaml:"interfaces,omitempty"`
+	// Manufacturers are matched against the manufacturer and model in a
+	// discovered device's UPnP description, to skip other brands' Linkplay
+	// devices. Empty connects to any device offering the PlayQueue service.
+	Manufacturers []string `yaml:"manufacturers"`
+	Scan          Scan     `yaml:"scan"`
+}
+
+// MQTT configures the bridge publishing device state to an MQTT broker.
+type MQTT struct {
+	Enabled  bool   `yaml:"enabled"`
+	Broker   string `yaml:"broker"` // tcp://host:1883, ssl://host:8883 or ws://host/path
+	ClientID string `yaml:"clientId"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// TopicPrefix is the root of the state and command topics.
+	TopicPrefix string `yaml:"topicPrefix"`
+	// Discovery turns on Home Assistant MQTT discovery, published under
+	// DiscoveryPrefix.
+	Discovery       bool   `yaml:"discovery"`
+	DiscoveryPrefix string `yaml:"discoveryPrefix"`
+}
+
+// TLS serves the web server over HTTPS on the listen address.
+type TLS struct {
+	Enabled  bool   `yaml:"enabled"`
+	CertFile string `yaml:"certFile,omitempty"`
+	KeyFile  string `yaml:"keyFile,omitempty"`
+	// SelfSigned generates a certificate when the files don't exist, or
+	// in the user's config directory when no files are given. Only
+	// certificates it generated are ever replaced.
+	SelfSigned bool `yaml:"selfSigned,omitempty"`
+	// RedirectHTTP is an address to serve plain HTTP on, redirecting
+	// everything to HTTPS. Empty disables it.
+	RedirectHTTP string `yaml:"redirectHttp,omitempty"`
+}
+
+// Token is an API token, sent as a bearer token or a token query parameter.
+type Token struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+// User logs in with HTTP basic auth. Password may be a bcrypt hash.
+type User struct {
+	Name     string `yaml:"name"`
+	Password string `yaml:"password"`
+	Role     string `yaml:"role"`
+}
+
+// Auth controls who may use the control API and what they may do.
+type Auth struct {
+	// Enabled requires a token or user on every API request.
+	Enabled bool `yaml:"enabled"`
+	// AllowedOrigins lists the web origins browsers may call the API from,
+	// on top of the broker's own. "*" allows any origin.
+	AllowedOrigins []string `yaml:"allowedOrigins,omitempty"`
+	Tokens         []Token  `yaml:"tokens,omitempty"`
+	Users          []User   `yaml:"users,omitempty"`
+	// Roles adds or replaces roles, as lists of scopes. The readonly,
+	// playback, operator and admin roles are built in.
+	Roles map[string][]string `yaml:"roles,omitempty"`
+}
+
+// ZoneMember is a device in a zone. VolumeOffset is added to the zone volume
+// for this device, so quieter rooms can stay quieter.
+type ZoneMember struct {
+	Device       string  `json:"device" yaml:"device"` // ID, UUID, MAC, host or name
+	VolumeOffset float32 `json:"volumeOffset,omitempty" yaml:"volumeOffset,omitempty"`
+}
+
+// Zone is a named set of devices controlled together by the broker,
+// independent of any multiroom grouping on the devices.
+type Zone struct {
+	Name    string       `yaml:"name"`
+	Members []ZoneMember `yaml:"members"`
+}
+
+// Scheduler sets where scheduled jobs are kept. Jobs themselves are made
+// over the API.
+type Scheduler struct {
+	// File holds the jobs and their history, by default in the user config
+	// directory.
+	File string `yaml:"file,omitempty"`
+	// History is how many runs to keep, across all jobs. 0 keeps them all.
+	History int `yaml:"history"`
+}
+
+// Device declares a device by host. Listed devices are connected at startup
+// without waiting for discovery, and the same settings apply if discovery
+// finds them later. Unset fields fall back to the global settings.
+type Device struct {
+	Host string `yaml:"host"`
+	// Name is used for the websocket connection when the other transports
+	// can't provide one.
+	Name string `yaml:"name,omitempty"`
+	// Ignore skips the device entirely, even when discovered.
+	Ignore        bool  `yaml:"ignore,omitempty"`
+	Serial        *bool `yaml:"serial,omitempty"`
+	Http          *bool `yaml:"http,omitempty"`
+	Websocket     *bool `yaml:"websocket,omitempty"`
+	SerialPort    int   `yaml:"serialPort,omitempty"`
+	WebsocketPort int   `yaml:"websocketPort,omitempty"`
+}
+
+type Config struct {
+	Listen         string        `yaml:"listen"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	ArtworkCache   string        `yaml:"artworkCache,omitempty"`
+	Discovery      Discovery     `yaml:"discovery"`
+	Transports     Transports    `yaml:"transports"`
+	Devices        []Device      `yaml:"devices,omitempty"`
+	MQTT           MQTT          `yaml:"mqtt"`
+	Auth           Auth          `yaml:"auth"`
+	TLS            TLS           `yaml:"tls"`
+	// Zones listed in the config can't be changed over the API. Zones made
+	// over the API are kept in ZonesFile, by default in the user config
+	// directory.
+	Zones     []Zone    `yaml:"zones,omitempty"`
+	ZonesFile string    `yaml:"zonesFile,omitempty"`
+	Scheduler Scheduler `yaml:"scheduler"`
+	// DevicesFile remembers which hardware is at each address, so devices
+	// keep their IDs while their HTTP API is unreachable. By default it's
+	// in the user config directory.
+	DevicesFile string `yaml:"devicesFile,omitempty"`
+}
+
+// Default matches what the broker did before it was configurable.
+func Default() Config {
+	return Config{
+		Listen:         ":8080",
+		ConnectTimeout: time.Second * 15,
+		Discovery: Discovery{
+			Enabled:  true,
+			Interval: time.Minute,
+			Wait:     time.Second * 5,
+			Passive:  true,
+			// Rakoit makes Arylic's boards
+			Manufacturers: []string{"arylic", "rakoit"},
+			Scan: Scan{
+				Interval:    time.Minute * 10,
+				Concurrency: 32,
+				Rate:        50,
+				Timeout:     time.Second * 2,
+			},
+		},
+		Transports: Transports{
+			Serial:    Transport{Enabled: true, Port: 8899},
+			Http:      Transport{Enabled: true},
+			Websocket: Transport{Enabled: true, Port: 8888},
+		},
+		MQTT: MQTT{
+			Broker:          "tcp://localhost:1883",
+			ClientID:        "arylic-connect",
+			TopicPrefix:     "arylic",
+			Discovery:       true,
+			DiscoveryPrefix: "homeassistant",
+		},
+		Scheduler: Scheduler{History: 200},
+	}
+}
+
+// ResolvedDevice is a device's settings with the global defaults filled in.
+type ResolvedDevice struct {
+	Host          string
+	Name          string
+	Ignore        bool
+	Serial        bool
+	Http          bool
+	Websocket     bool
+	SerialPort    int
+	WebsocketPort int
+}
+
+// Device returns the settings that apply to a host, whether or not it's
+// listed in the config.
+func (config Config) Device(host string) ResolvedDevice {
+	resolved := ResolvedDevice{
+		Host:          host,
+		Serial:        config.Transports.Serial.Enabled,
+		Http:          config.Transports.Http.Enabled,
+		Websocket:     config.Transports.Websocket.Enabled,
+		SerialPort:    config.Transports.Serial.Port,
+		WebsocketPort: config.Transports.Websocket.Port,
+	}
+	for _, device := range config.Devices {
+		if device.Host != host {
+			continue
+		}
+		resolved.Name = device.Name
+		resolved.Ignore = device.Ignore
+		if device.Serial != nil {
+			resolved.Serial = *device.Serial
+		}
+		if device.Http != nil {
+			resolved.Http = *device.Http
+		}
+		if device.Websocket != nil {
+			resolved.Websocket = *device.Websocket
+		}
+		if device.SerialPort != 0 {
+			resolved.SerialPort = device.SerialPort
+		}
+		if device.WebsocketPort != 0 {
+			resolved.WebsocketPort = device.WebsocketPort
+		}
+		break
+	}
+	return resolved
+}
+
+func (config Config) Validate() error {
+	if config.Listen == "" {
+		return errors.New("listen address must be set")
+	}
+	if config.ConnectTimeout <= 0 {
+		return errors.New("connectTimeout must be positive")
+	}
+	if config.Discovery.Interval <= 0 {
+		return errors.New("discovery interval must be positive")
+	}
+	if config.Discovery.Wait < time.Second {
+		return errors.New("discovery wait must be at least one second")
+	}
+	if len(config.Discovery.Scan.Ranges) != 0 {
+		scan := config.Discovery.Scan
+		if scan.Interval <= 0 || scan.Concurrency < 1 || scan.Rate < 1 || scan.Timeout <= 0 {
+			return errors.New("scan interval, concurrency, rate and timeout must be positive")
+		}
+	}
+	for _, port := range []int{config.Transports.Serial.Port, config.Transports.Websocket.Port} {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("port %d out of range", port)
+		}
+	}
+	if config.MQTT.Enabled && (config.MQTT.Broker == "" || config.MQTT.TopicPrefix == "") {
+		return errors.New("mqtt needs a broker and topic prefix")
+	}
+	if config.TLS.Enabled && !config.TLS.SelfSigned && (config.TLS.CertFile == "" || config.TLS.KeyFile == "") {
+		return errors.New("tls needs a cert and key file, or selfSigned")
+	}
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		return errors.New("tls cert and key files must be set together")
+	}
+	if config.Auth.Enabled && len(config.Auth.Tokens) == 0 && len(config.Auth.Users) == 0 {
+		return errors.New("auth is enabled without any tokens or users")
+	}
+	for index, zone := range config.Zones {
+		if zone.Name == "" || len(zone.Members) == 0 {
+			return fmt.Errorf("zone %d needs a name and members", index)
+		}
+	}
+	for index, device := range config.Devices {
+		if device.Host == "" {
+			return fmt.Errorf("device %d has no host", index)
+		}
+		for _, port := range []int{device.SerialPort, device.WebsocketPort} {
+			if port < 0 || port > 65535 {
+				return fmt.Errorf("device %s port %d out of range", device.Host, port)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadFile reads a YAML config over the defaults. Anything the file leaves
+// out keeps its default.
+func LoadFile(path string) (Config, error) {
+	config := Default()
+	data, readErr := os.ReadFile(path)
+	if readErr != nil {
+		return config, readErr
+	}
+	unmarshalErr := yaml.Unmarshal(data, &config)
+	if unmarshalErr != nil {
+		return config, fmt.Errorf("parsing %s: %w", path, unmarshalErr)
+	}
+	return config, nil
+}
+
+// Load builds the config from, in increasing priority, the defaults, the
+// config file, ARYLIC_* environment variables and command-line flags.
+//
+// The config file is taken from -config or ARYLIC_CONFIG.
+func Load(args []string) (Config, error) {
+	flags := flag.NewFlagSet("arylic-connect", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("ARYLIC_CONFIG"), "path to a YAML config file")
+	listen := flags.String("listen", "", "address for the web server to listen on")
+	connectTimeout := flags.Duration("connect-timeout", 0, "timeout when connecting to a device")
+	artworkCache := flags.String("artwork-cache", "", "directory to cache album art in")
+	discoveryInterval := flags.Duration("ssdp-interval", 0, "how often to search for devices")
+	discoveryWait := flags.Duration("ssdp-wait", 0, "how long each search waits for replies")
+	noDiscovery := flags.Bool("no-discovery", false, "only connect to devices listed in the config")
+	noPassive := flags.Bool("no-ssdp-listen", false, "only find devices by searching, not from their announcements")
+	manufacturers := flags.String("ssdp-manufacturers", "", "comma-separated manufacturers to connect to, \"*\" for any")
+	scanRanges := flags.String("scan", "", "comma-separated CIDR ranges to scan for devices")
+	discoveryInterfaces := flags.String("ssdp-interfaces", "", "comma-separated network interfaces to discover devices on")
+	serialPort := flags.Int("serial-port", 0, "TCP port of the serial API")
+	websocketPort := flags.Int("websocket-port", 0, "port of the websocket API")
+	noSerial := flags.Bool("no-serial", false, "don't connect to the serial API")
+	noHttp := flags.Bool("no-http", false, "don't connect to the HTTP API")
+	noWebsocket := flags.Bool("no-websocket", false, "don't connect to the websocket API")
+	mqttBroker := flags.String("mqtt-broker", "", "MQTT broker to publish to, enables the MQTT bridge")
+	authToken := flags.String("auth-token", "", "admin API token, enables auth")
+	tlsCert := flags.String("tls-cert", "", "TLS certificate file, enables HTTPS")
+	tlsKey := flags.String("tls-key", "", "TLS key file")
+	tlsSelfSigned := flags.Bool("tls-self-signed", false, "serve HTTPS with a generated self-signed certificate")
+	httpRedirect := flags.String("http-redirect", "", "address to redirect plain HTTP to HTTPS from, like :80")
+	allowedOrigins := flags.String("allowed-origins", "", "comma-separated web origins allowed to use the API")
+	parseErr := flags.Parse(args)
+	if parseErr != nil {
+		return Config{}, parseErr
+	}
+
+	config := Default()
+	if *configPath != "" {
+		var loadErr error
+		config, loadErr = LoadFile(*configPath)
+		if loadErr != nil {
+			return config, loadErr
+		}
+	}
+
+	envErr := config.applyEnvironment()
+	if envErr != nil {
+		return config, envErr
+	}
+
+	if *listen != "" {
+		config.Listen = *listen
+	}
+	if *connectTimeout != 0 {
+		config.ConnectTimeout = *connectTimeout
+	}
+	if *artworkCache != "" {
+		config.ArtworkCache = *artworkCache
+	}
+	if *discoveryInterval != 0 {
+		config.Discovery.Interval = *discoveryInterval
+	}
+	if *discoveryWait != 0 {
+		config.Discovery.Wait = *discoveryWait
+	}
+	if *serialPort != 0 {
+		config.Transports.Serial.Port = *serialPort
+	}
+	if *websocketPort != 0 {
+		config.Transports.Websocket.Port = *websocketPort
+	}
+	if *noDiscovery {
+		config.Discovery.Enabled = false
+	}
+	if *noPassive {
+		config.Discovery.Passive = false
+	}
+	if *manufacturers != "" {
+		config.Discovery.Manufacturers = manufacturerList(*manufacturers)
+	}
+	if *scanRanges != "" {
+		config.Discovery.Scan.Ranges = splitList(*scanRanges)
+	}
+	if *discoveryInterfaces != "" {
+		config.Discovery.Interfaces = splitList(*discoveryInterfaces)
+	}
+	if *noSerial {
+		config.Transports.Serial.Enabled = false
+	}
+	if *noHttp {
+		config.Transports.Http.Enabled = false
+	}
+	if *noWebsocket {
+		config.Transports.Websocket.Enabled = false
+	}
+	if *mqttBroker != "" {
+		config.MQTT.Enabled = true
+		config.MQTT.Broker = *mqttBroker
+	}
+	if *authToken != "" {
+		config.Auth.addAdminToken(*authToken)
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		config.TLS.Enabled = true
+		config.TLS.CertFile = *tlsCert
+		config.TLS.KeyFile = *tlsKey
+	}
+	if *tlsSelfSigned {
+		config.TLS.Enabled = true
+		config.TLS.SelfSigned = true
+	}
+	if *httpRedirect != "" {
+		config.TLS.RedirectHTTP = *httpRedirect
+	}
+	if *allowedOrigins != "" {
+		config.Auth.AllowedOrigins = splitList(*allowedOrigins)
+	}
+
+	return config, config.Validate()
+}
+
+// applyEnvironment overrides settings from ARYLIC_* variables that are set.
+func (config *Config) applyEnvironment() error {
+	var envErr error
+	lookup := func(name string, apply func(value string) error) {
+		value, isSet := os.LookupEnv(name)
+		if !isSet || envErr != nil {
+			return
+		}
+		applyErr := apply(value)
+		if applyErr != nil {
+			envErr = fmt.Errorf("%s: %w", name, applyErr)
+		}
+	}
+	setString := func(target *string) func(string) error {
+		return func(value string) error {
+			*target = value
+			return nil
+		}
+	}
+	setDuration := func(target *time.Duration) func(string) error {
+		return func(value string) (err error) {
+			*target, err = time.ParseDuration(value)
+			return
+		}
+	}
+	setInt := func(target *int) func(string) error {
+		return func(value string) (err error) {
+			*target, err = strconv.Atoi(value)
+			return
+		}
+	}
+	setBool := func(target *bool) func(string) error {
+		return func(value string) (err error) {
+			*target, err = strconv.ParseBool(value)
+			return
+		}
+	}
+
+	lookup("ARYLIC_LISTEN", setString(&config.Listen))
+	lookup("ARYLIC_CONNECT_TIMEOUT", setDuration(&config.ConnectTimeout))
+	lookup("ARYLIC_ARTWORK_CACHE", setString(&config.ArtworkCache))
+	lookup("ARYLIC_DISCOVERY", setBool(&config.Discovery.Enabled))
+	lookup("ARYLIC_SSDP_INTERVAL", setDuration(&config.Discovery.Interval))
+	lookup("ARYLIC_SSDP_WAIT", setDuration(&config.Discovery.Wait))
+	lookup("ARYLIC_SSDP_LISTEN", setBool(&config.Discovery.Passive))
+	lookup("ARYLIC_SSDP_MANUFACTURERS", func(value string) error {
+		config.Discovery.Manufacturers = manufacturerList(value)
+		return nil
+	})
+	lookup("ARYLIC_SCAN", func(value string) error {
+		config.Discovery.Scan.Ranges = splitList(value)
+		return nil
+	})
+	lookup("ARYLIC_SCAN_INTERVAL", setDuration(&config.Discovery.Scan.Interval))
+	lookup("ARYLIC_SSDP_INTERFACES", func(value string) error {
+		config.Discovery.Interfaces = splitList(value)
+		return nil
+	})
+	lookup("ARYLIC_SERIAL", setBool(&config.Transports.Serial.Enabled))
+	lookup("ARYLIC_SERIAL_PORT", setInt(&config.Transports.Serial.Port))
+	lookup("ARYLIC_HTTP", setBool(&config.Transports.Http.Enabled))
+	lookup("ARYLIC_WEBSOCKET", setBool(&config.Transports.Websocket.Enabled))
+	lookup("ARYLIC_WEBSOCKET_PORT", setInt(&config.Transports.Websocket.Port))
+	lookup("ARYLIC_MQTT", setBool(&config.MQTT.Enabled))
+	lookup("ARYLIC_MQTT_BROKER", setString(&config.MQTT.Broker))
+	lookup("ARYLIC_MQTT_USERNAME", setString(&config.MQTT.Username))
+	lookup("ARYLIC_MQTT_PASSWORD", setString(&config.MQTT.Password))
+	lookup("ARYLIC_TLS", setBool(&config.TLS.Enabled))
+	lookup("ARYLIC_TLS_CERT", setString(&config.TLS.CertFile))
+	lookup("ARYLIC_TLS_KEY", setString(&config.TLS.KeyFile))
+	lookup("ARYLIC_TLS_SELF_SIGNED", setBool(&config.TLS.SelfSigned))
+	lookup("ARYLIC_HTTP_REDIRECT", setString(&config.TLS.RedirectHTTP))
+	lookup("ARYLIC_ZONES_FILE", setString(&config.ZonesFile))
+	lookup("ARYLIC_SCHEDULER_FILE", setString(&config.Scheduler.File))
+	lookup("ARYLIC_DEVICES_FILE", setString(&config.DevicesFile))
+	lookup("ARYLIC_AUTH", setBool(&config.Auth.Enabled))
+	lookup("ARYLIC_AUTH_TOKEN", func(value string) error {
+		config.Auth.addAdminToken(value)
+		return nil
+	})
+	lookup("ARYLIC_ALLOWED_ORIGINS", func(value string) error {
+		config.Auth.AllowedOrigins = splitList(value)
+		return nil
+	})
+	return envErr
+}
+
+// addAdminToken is the shortcut for a single-user setup.
+func (auth *Auth) addAdminToken(token string) {
+	auth.Enabled = true
+	auth.Tokens = append(auth.Tokens, Token{Name: "admin", Token: token, Role: "admin"})
+}
+
+// manufacturerList reads a list of manufacturers, where "*" means any.
+func manufacturerList(value string) []string {
+	if strings.TrimSpace(value) == "*" {
+		return nil
+	}
+	return splitList(value)
+}
+
+func splitList(value string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
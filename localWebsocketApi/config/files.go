@@ -0,0 +1,54 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+)
+
+// WriteYAML saves a value as YAML for the state files the broker keeps. It's
+// written to a temp file and renamed into place, so a crash can't leave half
+// a file.
+func WriteYAML(path string, value interface{}) error {
+	data, marshalErr := yaml.Marshal(value)
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	mkdirErr := os.MkdirAll(filepath.Dir(path), 0755)
+	if mkdirErr != nil {
+		return mkdirErr
+	}
+	temp, createErr := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if createErr != nil {
+		return createErr
+	}
+	_, writeErr := temp.Write(data)
+	closeErr := temp.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr != nil {
+		os.Remove(temp.Name())
+		return writeErr
+	}
+	return os.Rename(temp.Name(), path)
+}
@@ -0,0 +1,473 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package devices groups the connections each transport wrapper holds into
+// one record per physical device, keyed by the hardware's own identity rather
+// than its user-editable name.
+package devices
+
+import (
+	"arylic-connect/localWebsocketApi/config"
+	"arylic-connect/localWebsocketApi/extWebsocket"
+	"arylic-connect/localWebsocketApi/httpmedia"
+	"arylic-connect/localWebsocketApi/serialmedia"
+	"arylic-connect/localWebsocketApi/upgrades"
+	"arylic-connect/localWebsocketApi/upnp"
+	"arylic-connect/rpcWrapper/httpControl"
+	"arylic-connect/rpcWrapper/serialMediaControl"
+	"arylic-connect/rpcWrapper/websocketControl"
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrDeviceNotFound = errors.New("device not found")
+
+type Transport string
+
+const (
+	Transport_Serial    Transport = "serial"
+	Transport_Http      Transport = "http"
+	Transport_Websocket Transport = "websocket"
+)
+
+// identity is what the HTTP API tells us about the hardware. Devices without
+// an HTTP connection fall back to their UPnP description. Identities are
+// remembered by host and saved, so a device keeps its ID while its HTTP
+// connection is down and across restarts.
+type identity struct {
+	UUID         string `yaml:"uuid,omitempty"`
+	MAC          string `yaml:"mac,omitempty"`
+	Name         string `yaml:"name,omitempty"`
+	Model        string `yaml:"model,omitempty"`
+	Manufacturer string `yaml:"manufacturer,omitempty"`
+	SerialNumber string `yaml:"serialNumber,omitempty"`
+}
+
+// key is what a device's record is kept under, empty until the hardware has
+// identified itself.
+func (i identity) key() string {
+	if i.UUID != "" {
+		return i.UUID
+	}
+	return i.MAC
+}
+
+// sameHardware checks two identities are the same device, going by whichever
+// of the UUID and MAC both have.
+func (i identity) sameHardware(other identity) bool {
+	if i.UUID != "" && other.UUID != "" {
+		return i.UUID == other.UUID
+	}
+	return i.MAC != "" && strings.EqualFold(i.MAC, other.MAC)
+}
+
+// savedIdentity is an identity as kept on disk.
+type savedIdentity struct {
+	Host     string `yaml:"host"`
+	identity `yaml:",inline"`
+}
+
+// device is a physical device and the client each transport has for it.
+type device struct {
+	id   string
+	host string
+	identity
+
+	serial       *serialMediaControl.RPC
+	serialKey    string
+	http         *httpControl.RPC
+	httpKey      string
+	websocket    *websocketControl.RPC
+	websocketKey string
+}
+
+// DeviceInfo describes a device. ID is the UUID, falling back to the MAC and,
+// for devices that have never identified themselves, the host. The
+// per-transport names are the targets to use with the serialmedia, httpmedia
+// and websocketmedia namespaces.
+type DeviceInfo struct {
+	ID    string `json:"id"`
+	UUID  string `json:"uuid"`
+	MAC   string `json:"mac"`
+	Host  string `json:"host"`
+	Name  string `json:"name"`
+	Model string `json:"model"`
+
+	Manufacturer string `json:"manufacturer,omitempty"`
+	SerialNumber string `json:"serialNumber,omitempty"`
+
+	Transports    []Transport `json:"transports"`
+	SerialName    string      `json:"serialName,omitempty"`
+	HttpName      string      `json:"httpName,omitempty"`
+	WebsocketName string      `json:"websocketName,omitempty"`
+}
+
+func (d *device) info() DeviceInfo {
+	info := DeviceInfo{
+		ID:            d.id,
+		UUID:          d.UUID,
+		MAC:           d.MAC,
+		Host:          d.host,
+		Name:          d.Name,
+		Model:         d.Model,
+		Manufacturer:  d.Manufacturer,
+		SerialNumber:  d.SerialNumber,
+		Transports:    make([]Transport, 0, 3),
+		SerialName:    d.serialKey,
+		HttpName:      d.httpKey,
+		WebsocketName: d.websocketKey,
+	}
+	if d.serial != nil {
+		info.Transports = append(info.Transports, Transport_Serial)
+	}
+	if d.http != nil {
+		info.Transports = append(info.Transports, Transport_Http)
+	}
+	if d.websocket != nil {
+		info.Transports = append(info.Transports, Transport_Websocket)
+	}
+	return info
+}
+
+// describe fills in whatever the HTTP API didn't from a UPnP description.
+func (i *identity) describe(description upnp.Description) {
+	if i.UUID == "" {
+		i.UUID = description.UUID()
+	}
+	if i.Name == "" {
+		i.Name = description.FriendlyName
+	}
+	if i.Model == "" {
+		i.Model = description.ModelName
+	}
+	i.Manufacturer = description.Manufacturer
+	i.SerialNumber = description.SerialNumber
+}
+
+// Registry keeps a record of each device, built out of the three wrappers'
+// connections. It doesn't own any connections itself; records are updated
+// when the wrappers report a connection changing.
+type Registry struct {
+	serialConnections    *serialmedia.SerialMediaWrapper
+	httpConnections      *httpmedia.HttpMediaWrapper
+	websocketConnections *extWebsocket.ExternalWebsocketWrapper
+	upgrades             *upgrades.Tracker
+	// Descriptions are the UPnP descriptions read during discovery, if any.
+	Descriptions *upnp.Directory
+	// Feed carries presence events, which discovery publishes to as well.
+	Feed *PresenceFeed
+
+	path string
+
+	lock    sync.RWMutex
+	devices map[string]*device
+	// known is the identity of the hardware at each host
+	known map[string]identity
+	// identified are the HTTP connections already asked for an identity
+	identified map[*httpControl.RPC]struct{}
+}
+
+// New loads the identities saved at path, an empty path using the user
+// config directory.
+func New(serial *serialmedia.SerialMediaWrapper, http *httpmedia.HttpMediaWrapper, websocket *extWebsocket.ExternalWebsocketWrapper, upgradeTracker *upgrades.Tracker, path string) (*Registry, error) {
+	if path == "" {
+		configDir, dirErr := os.UserConfigDir()
+		if dirErr != nil {
+			return nil, dirErr
+		}
+		path = filepath.Join(configDir, "arylic-connect", "devices.yaml")
+	}
+	registry := &Registry{
+		serialConnections:    serial,
+		httpConnections:      http,
+		websocketConnections: websocket,
+		upgrades:             upgradeTracker,
+		Feed:                 newPresenceFeed(),
+		path:                 path,
+		devices:              make(map[string]*device),
+		known:                make(map[string]identity),
+		identified:           make(map[*httpControl.RPC]struct{}),
+	}
+
+	data, readErr := os.ReadFile(path)
+	if readErr != nil && !errors.Is(readErr, os.ErrNotExist) {
+		return nil, readErr
+	}
+	if readErr == nil {
+		saved := make([]savedIdentity, 0)
+		unmarshalErr := yaml.Unmarshal(data, &saved)
+		if unmarshalErr != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, unmarshalErr)
+		}
+		for _, entry := range saved {
+			registry.known[entry.Host] = entry.identity
+		}
+	}
+
+	registry.watchEndpoints(Transport_Serial, serial.Endpoints)
+	registry.watchEndpoints(Transport_Http, http.Endpoints)
+	registry.watchEndpoints(Transport_Websocket, websocket.Endpoints)
+	return registry, nil
+}
+
+// save writes out the known identities.
+//
+// Callers must hold the write lock.
+func (registry *Registry) save() error {
+	saved := make([]savedIdentity, 0, len(registry.known))
+	for host, known := range registry.known {
+		saved = append(saved, savedIdentity{Host: host, identity: known})
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].Host < saved[j].Host
+	})
+	return config.WriteYAML(registry.path, saved)
+}
+
+// learn records the identity of the hardware at a host. Any other host
+// holding the same hardware is dropped, as the device has moved.
+//
+// Callers must hold the write lock.
+func (registry *Registry) learn(host string, learnt identity) {
+	if learnt.key() == "" || registry.known[host] == learnt {
+		return
+	}
+	for otherHost, other := range registry.known {
+		if otherHost != host && other.sameHardware(learnt) {
+			delete(registry.known, otherHost)
+		}
+	}
+	registry.known[host] = learnt
+	saveErr := registry.save()
+	if saveErr != nil {
+		log.Printf("Error saving device identities: %s\n", saveErr.Error())
+	}
+}
+
+// identify asks new HTTP connections who they are, then regroups the records.
+// Only HTTP connections not asked before are requested, so this is cheap once
+// everything connected has answered.
+func (registry *Registry) identify(ctx context.Context) {
+	type pending struct {
+		host       string
+		connection *httpControl.RPC
+	}
+	missing := make([]pending, 0)
+	registry.httpConnections.OpLock.RLock()
+	registry.lock.RLock()
+	for _, connection := range registry.httpConnections.HttpMediaCons {
+		_, asked := registry.identified[connection]
+		if !asked {
+			missing = append(missing, pending{host: upgrades.HostOf(connection.TransportTarget()), connection: connection})
+		}
+	}
+	registry.lock.RUnlock()
+	registry.httpConnections.OpLock.RUnlock()
+
+	// Each is a request to the device, so none of the locks are held
+	for _, next := range missing {
+		statusCtx, statusCancel := context.WithTimeout(ctx, time.Second*5)
+		status, statusErr := next.connection.GetStatus(statusCtx)
+		statusCancel()
+		if statusErr != nil {
+			continue
+		}
+		mac := status.Ethernet.MAC
+		if mac == "" {
+			mac = status.Wifi.StationMAC
+		}
+		fromHttp := identity{
+			UUID:  status.DeviceID,
+			MAC:   strings.ToUpper(mac),
+			Name:  status.DeviceName,
+			Model: status.Model,
+		}
+
+		registry.lock.Lock()
+		registry.identified[next.connection] = struct{}{}
+		// Keep what the UPnP description added if it's the same hardware
+		learnt := registry.known[next.host]
+		if !learnt.sameHardware(fromHttp) {
+			learnt = identity{}
+		}
+		learnt.UUID, learnt.MAC, learnt.Name, learnt.Model = fromHttp.UUID, fromHttp.MAC, fromHttp.Name, fromHttp.Model
+		registry.learn(next.host, learnt)
+		registry.lock.Unlock()
+	}
+
+	registry.regroup()
+}
+
+// regroup rebuilds the records from the wrappers' connections, grouping them
+// by host and keying each on the identity known for that host. Nothing is
+// requested from the devices.
+func (registry *Registry) regroup() {
+	byHost := make(map[string]*device)
+	deviceFor := func(host string) *device {
+		existing, hasDevice := byHost[host]
+		if !hasDevice {
+			existing = &device{host: host}
+			byHost[host] = existing
+		}
+		return existing
+	}
+
+	registry.serialConnections.OpLock.RLock()
+	for key, connection := range registry.serialConnections.SerialMediaCons {
+		d := deviceFor(upgrades.HostOf(connection.TransportTarget()))
+		d.serial, d.serialKey = connection, key
+	}
+	registry.serialConnections.OpLock.RUnlock()
+
+	registry.httpConnections.OpLock.RLock()
+	for key, connection := range registry.httpConnections.HttpMediaCons {
+		d := deviceFor(upgrades.HostOf(connection.TransportTarget()))
+		d.http, d.httpKey = connection, key
+	}
+	registry.httpConnections.OpLock.RUnlock()
+
+	registry.websocketConnections.OpLock.RLock()
+	for key, connection := range registry.websocketConnections.HttpMediaCons {
+		d := deviceFor(upgrades.HostOf(connection.TransportTarget()))
+		d.websocket, d.websocketKey = connection, key
+	}
+	registry.websocketConnections.OpLock.RUnlock()
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	devices := make(map[string]*device)
+	liveConnections := make(map[*httpControl.RPC]struct{})
+	for host, d := range byHost {
+		if d.http != nil {
+			if _, asked := registry.identified[d.http]; asked {
+				liveConnections[d.http] = struct{}{}
+			}
+		}
+		if registry.Descriptions != nil {
+			description, described := registry.Descriptions.Get(host)
+			if described {
+				known := registry.known[host]
+				known.describe(description)
+				registry.learn(host, known)
+			}
+		}
+		d.identity = registry.known[host]
+		if d.Name == "" {
+			d.Name = d.serialKey
+		}
+		if d.Name == "" {
+			d.Name = d.websocketKey
+		}
+
+		d.id = d.key()
+		if d.id == "" {
+			d.id = host
+		}
+		devices[d.id] = d
+	}
+	registry.comparePresence(registry.devices, devices)
+	registry.devices = devices
+	// Forget connections that have since been replaced
+	registry.identified = liveConnections
+}
+
+// lookup finds a device by ID, UUID, MAC, host or name. Names only match when
+// exactly one device has it.
+//
+// Callers must hold the read lock.
+func (registry *Registry) lookup(ref string) (*device, error) {
+	direct, hasDevice := registry.devices[ref]
+	if hasDevice {
+		return direct, nil
+	}
+
+	var named *device
+	namedCount := 0
+	for _, d := range registry.devices {
+		if strings.EqualFold(d.MAC, ref) || d.UUID == ref || d.host == ref {
+			return d, nil
+		}
+		if d.Name == ref {
+			named = d
+			namedCount++
+		}
+	}
+	if namedCount == 1 {
+		return named, nil
+	}
+	if namedCount > 1 {
+		return nil, errors.New("more than one device has that name, use its ID")
+	}
+	return nil, ErrDeviceNotFound
+}
+
+// find looks a device up, regrouping the records once if it isn't found in
+// case its connection has only just been made.
+func (registry *Registry) find(ref string) (device, error) {
+	found, findErr := registry.tryFind(ref)
+	if findErr == ErrDeviceNotFound {
+		registry.regroup()
+		found, findErr = registry.tryFind(ref)
+	}
+	return found, findErr
+}
+
+func (registry *Registry) tryFind(ref string) (device, error) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	d, lookupErr := registry.lookup(ref)
+	if lookupErr != nil {
+		return device{}, lookupErr
+	}
+	return *d, nil
+}
+
+// GetDevice returns the current record for a device reference.
+func (registry *Registry) GetDevice(ctx context.Context, ref string) (DeviceInfo, error) {
+	d, findErr := registry.find(ref)
+	if findErr != nil {
+		return DeviceInfo{}, findErr
+	}
+	return d.info(), nil
+}
+
+// ListDevices returns every connected device, sorted by name.
+func (registry *Registry) ListDevices(ctx context.Context) []DeviceInfo {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	list := make([]DeviceInfo, 0, len(registry.devices))
+	for _, d := range registry.devices {
+		list = append(list, d.info())
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name == list[j].Name {
+			return list[i].ID < list[j].ID
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,187 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package devices
+
+import (
+	"arylic-connect/localWebsocketApi/endpoints"
+	"arylic-connect/localWebsocketApi/upgrades"
+	"context"
+	"github.com/ethereum/go-ethereum/rpc"
+	"sync"
+	"time"
+)
+
+type PresenceKind string
+
+const (
+	Presence_Discovered   PresenceKind = "discovered"   // found by SSDP or a scan
+	Presence_Left         PresenceKind = "left"         // announced it was leaving the network
+	Presence_Connected    PresenceKind = "connected"    // a transport connected for the first time
+	Presence_Reconnected  PresenceKind = "reconnected"  // a transport connected again
+	Presence_Offline      PresenceKind = "offline"      // a transport stopped responding
+	Presence_Online       PresenceKind = "online"       // an offline transport started responding again
+	Presence_Disconnected PresenceKind = "disconnected" // a transport was disconnected on request
+	Presence_Forgotten    PresenceKind = "forgotten"
+	Presence_Moved        PresenceKind = "moved" // the device's address changed
+	Presence_Renamed      PresenceKind = "renamed"
+)
+
+// PresenceEvent is one change in what devices are around. Transport and Name
+// (the wrapper's name for the connection) are set for transport events.
+type PresenceEvent struct {
+	Kind         PresenceKind `json:"kind"`
+	Time         time.Time    `json:"time"`
+	DeviceID     string       `json:"deviceId,omitempty"`
+	Host         string       `json:"host,omitempty"`
+	Transport    Transport    `json:"transport,omitempty"`
+	Name         string       `json:"name,omitempty"`
+	PreviousHost string       `json:"previousHost,omitempty"`
+	PreviousName string       `json:"previousName,omitempty"`
+	Error        string       `json:"error,omitempty"`
+	Via          string       `json:"via,omitempty"` // how a discovered device was found
+}
+
+// PresenceFeed fans presence events out to subscribers.
+type PresenceFeed struct {
+	lock        sync.Mutex
+	subscribers map[chan PresenceEvent]struct{}
+}
+
+func newPresenceFeed() *PresenceFeed {
+	return &PresenceFeed{subscribers: make(map[chan PresenceEvent]struct{})}
+}
+
+// Publish sends an event to every subscriber, stamping it if it has no time.
+func (feed *PresenceFeed) Publish(event PresenceEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	feed.lock.Lock()
+	defer feed.lock.Unlock()
+	for subscriber := range feed.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// just pass on send fails
+		}
+	}
+}
+
+func (feed *PresenceFeed) subscribe() (chan PresenceEvent, func()) {
+	incoming := make(chan PresenceEvent, 16)
+	feed.lock.Lock()
+	feed.subscribers[incoming] = struct{}{}
+	feed.lock.Unlock()
+	return incoming, func() {
+		feed.lock.Lock()
+		delete(feed.subscribers, incoming)
+		feed.lock.Unlock()
+	}
+}
+
+// kindOf maps an endpoint state change onto a presence event.
+func kindOf(change endpoints.Change) PresenceKind {
+	switch {
+	case change.Forgotten:
+		return Presence_Forgotten
+	case change.NewConnection && change.Previous == "":
+		return Presence_Connected
+	case change.NewConnection:
+		return Presence_Reconnected
+	case change.Endpoint.State == endpoints.State_Connected:
+		return Presence_Online
+	case change.Endpoint.State == endpoints.State_Offline:
+		return Presence_Offline
+	}
+	return Presence_Disconnected
+}
+
+// watchEndpoints turns a wrapper's endpoint changes into presence events. The
+// device records are updated after each, which picks up moves and renames.
+func (registry *Registry) watchEndpoints(transport Transport, registryOf *endpoints.Registry) {
+	registryOf.OnChange(func(change endpoints.Change) {
+		host := upgrades.HostOf(change.Endpoint.Target)
+		registry.lock.RLock()
+		deviceID := ""
+		for _, d := range registry.devices {
+			if d.host == host {
+				deviceID = d.id
+				break
+			}
+		}
+		registry.lock.RUnlock()
+
+		registry.Feed.Publish(PresenceEvent{
+			Kind:      kindOf(change),
+			DeviceID:  deviceID,
+			Host:      host,
+			Transport: transport,
+			Name:      change.Endpoint.Name,
+			Error:     change.Endpoint.LastError,
+		})
+		go func() {
+			ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer ctxCancel()
+			registry.identify(ctx)
+		}()
+	})
+}
+
+// comparePresence reports devices whose address or name changed between two
+// regroups.
+//
+// Callers must hold the write lock.
+func (registry *Registry) comparePresence(previous map[string]*device, current map[string]*device) {
+	for id, now := range current {
+		before, known := previous[id]
+		if !known {
+			continue
+		}
+		if before.host != now.host {
+			registry.Feed.Publish(PresenceEvent{Kind: Presence_Moved, DeviceID: id, Host: now.host, PreviousHost: before.host, Name: now.Name})
+		}
+		if before.Name != now.Name && before.Name != "" && now.Name != "" {
+			registry.Feed.Publish(PresenceEvent{Kind: Presence_Renamed, DeviceID: id, Host: now.host, Name: now.Name, PreviousName: before.Name})
+		}
+	}
+}
+
+// Presence subscribes to devices being discovered, connecting, dropping off,
+// coming back, moving and being renamed.
+func (registry *Registry) Presence(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	incomingChannel, unsubscribe := registry.Feed.subscribe()
+	sub := notifier.CreateSubscription()
+	go func() {
+		defer unsubscribe()
+		for {
+			select {
+			case event := <-incomingChannel:
+				notifier.Notify(sub.ID, event)
+			case <-sub.Err():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
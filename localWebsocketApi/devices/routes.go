@@ -0,0 +1,458 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package devices
+
+import (
+	"arylic-connect/localWebsocketApi/upgrades"
+	"arylic-connect/rpcWrapper"
+	"arylic-connect/rpcWrapper/httpControl"
+	"arylic-connect/rpcWrapper/serialMediaControl"
+	"arylic-connect/rpcWrapper/websocketControl"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// AttemptTimeout bounds each transport's try at a call, so a hung connection
+// leaves time to fall back to the next one.
+const AttemptTimeout = 5 * time.Second
+
+var ErrUnsupported = errors.New("no connected transport supports this call")
+
+// route is how one call is made over each transport that can do it. Nil
+// entries mean the transport can't. Idempotent calls can safely be repeated
+// over another transport when one times out; the rest only fail over when
+// the first transport never got the request out.
+type route struct {
+	idempotent bool
+
+	serial    func(ctx context.Context, connection *serialMediaControl.RPC) error
+	http      func(ctx context.Context, connection *httpControl.RPC) error
+	websocket func(ctx context.Context, connection *websocketControl.RPC) error
+}
+
+type FailedAttempt struct {
+	Transport Transport `json:"transport"`
+	Error     string    `json:"error"`
+}
+
+// Served reports which transport a call went over, and any that were tried
+// first and failed.
+type Served struct {
+	Transport Transport       `json:"transport"`
+	Failed    []FailedAttempt `json:"failed,omitempty"`
+}
+
+type StatusResult struct {
+	Served
+	Status httpControl.EndpointStatus `json:"status"`
+}
+
+type PlayerStatusResult struct {
+	Served
+	Status httpControl.PlayerStatus `json:"status"`
+}
+
+type VolumeResult struct {
+	Served
+	Volume float32 `json:"volume"` // 0 - 1
+}
+
+type MuteResult struct {
+	Served
+	Mute bool `json:"mute"`
+}
+
+type SourceResult struct {
+	Served
+	Source serialMediaControl.InputSource `json:"source"`
+}
+
+// transportDown decides whether an error means the request never reached the
+// device, because the transport wasn't connected or couldn't connect.
+func transportDown(err error) bool {
+	if errors.Is(err, rpcWrapper.ErrTransportNotConnected) ||
+		errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// shouldFailover decides whether an error means the transport let us down, as
+// opposed to the device refusing the request, which another transport would
+// refuse just the same. A call that isn't idempotent may have reached the
+// device before timing out, so it only fails over when the transport was
+// down.
+func shouldFailover(err error, idempotent bool) bool {
+	if transportDown(err) {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	// The websocket library wraps closed connections in its own types
+	return strings.Contains(err.Error(), "websocket: close")
+}
+
+// attempt is one transport's go at a route.
+type attempt struct {
+	transport Transport
+	offline   bool
+	run       func(ctx context.Context) error
+	// markFailed flags the connection offline so later calls try it last,
+	// until the wrapper's liveness probe sees it respond again.
+	markFailed func(err error)
+}
+
+// attempts lists the transports of a device that can run a route, in the
+// order to try them: serial, HTTP then websocket, with any the wrappers have
+// marked offline moved to the back.
+func (registry *Registry) attempts(target device, r route) []attempt {
+	candidates := make([]attempt, 0, 3)
+	if r.serial != nil && target.serial != nil {
+		candidates = append(candidates, attempt{
+			transport: Transport_Serial,
+			offline:   registry.serialConnections.Endpoints.Offline(target.serialKey),
+			run: func(ctx context.Context) error {
+				return r.serial(ctx, target.serial)
+			},
+			markFailed: func(err error) {
+				registry.serialConnections.Endpoints.Failed(target.serialKey, err)
+			},
+		})
+	}
+	if r.http != nil && target.http != nil {
+		candidates = append(candidates, attempt{
+			transport: Transport_Http,
+			offline:   registry.httpConnections.Endpoints.Offline(target.httpKey),
+			run: func(ctx context.Context) error {
+				return r.http(ctx, target.http)
+			},
+			markFailed: func(err error) {
+				registry.httpConnections.Endpoints.Failed(target.httpKey, err)
+			},
+		})
+	}
+	if r.websocket != nil && target.websocket != nil {
+		candidates = append(candidates, attempt{
+			transport: Transport_Websocket,
+			offline:   registry.websocketConnections.Endpoints.Offline(target.websocketKey),
+			run: func(ctx context.Context) error {
+				return r.websocket(ctx, target.websocket)
+			},
+			markFailed: func(err error) {
+				registry.websocketConnections.Endpoints.Failed(target.websocketKey, err)
+			},
+		})
+	}
+
+	ordered := make([]attempt, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !candidate.offline {
+			ordered = append(ordered, candidate)
+		}
+	}
+	for _, candidate := range candidates {
+		if candidate.offline {
+			ordered = append(ordered, candidate)
+		}
+	}
+	return ordered
+}
+
+// call runs a route on a device, falling back through its other transports
+// when one has lost its connection or, for idempotent calls, times out.
+func (registry *Registry) call(ctx context.Context, ref string, r route) (Served, error) {
+	target, findErr := registry.find(ref)
+	if findErr != nil {
+		return Served{}, findErr
+	}
+
+	if registry.upgrades.Upgrading(target.host) {
+		return Served{}, upgrades.ErrUpgrading
+	}
+
+	attempts := registry.attempts(target, r)
+	if len(attempts) == 0 {
+		return Served{}, ErrUnsupported
+	}
+
+	served := Served{}
+	for _, next := range attempts {
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, AttemptTimeout)
+		runErr := next.run(attemptCtx)
+		attemptCancel()
+		if runErr == nil {
+			served.Transport = next.transport
+			if len(served.Failed) != 0 {
+				log.Printf("Call to %s fell back to %s after %d failed attempts\n", target.Name, next.transport, len(served.Failed))
+			}
+			return served, nil
+		}
+
+		served.Failed = append(served.Failed, FailedAttempt{Transport: next.transport, Error: runErr.Error()})
+		if ctx.Err() != nil || !shouldFailover(runErr, r.idempotent) {
+			return served, runErr
+		}
+		next.markFailed(runErr)
+	}
+
+	reasons := make([]string, len(served.Failed))
+	for index, failed := range served.Failed {
+		reasons[index] = fmt.Sprintf("%s: %s", failed.Transport, failed.Error)
+	}
+	return served, fmt.Errorf("all transports failed: %s", strings.Join(reasons, "; "))
+}
+
+// GetStatus returns the full device status, which only the HTTP API has.
+func (registry *Registry) GetStatus(ctx context.Context, ref string) (StatusResult, error) {
+	result := StatusResult{}
+	served, err := registry.call(ctx, ref, route{
+		idempotent: true,
+		http: func(ctx context.Context, connection *httpControl.RPC) (err error) {
+			result.Status, err = connection.GetStatus(ctx)
+			return
+		},
+	})
+	result.Served = served
+	return result, err
+}
+
+func (registry *Registry) GetPlayerStatus(ctx context.Context, ref string) (PlayerStatusResult, error) {
+	result := PlayerStatusResult{}
+	served, err := registry.call(ctx, ref, route{
+		idempotent: true,
+		http: func(ctx context.Context, connection *httpControl.RPC) (err error) {
+			result.Status, err = connection.GetPlayerStatus(ctx)
+			return
+		},
+	})
+	result.Served = served
+	return result, err
+}
+
+// GetVolume returns the volume from 0 to 1.
+func (registry *Registry) GetVolume(ctx context.Context, ref string) (VolumeResult, error) {
+	result := VolumeResult{}
+	served, err := registry.call(ctx, ref, route{
+		idempotent: true,
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) (err error) {
+			result.Volume, err = connection.GetVolume(ctx)
+			return
+		},
+		http: func(ctx context.Context, connection *httpControl.RPC) error {
+			status, statusErr := connection.GetPlayerStatus(ctx)
+			result.Volume = status.Volume
+			return statusErr
+		},
+		websocket: func(ctx context.Context, connection *websocketControl.RPC) error {
+			status, statusErr := connection.GetStatus(ctx)
+			result.Volume = float32(status.Volume) / 100
+			return statusErr
+		},
+	})
+	result.Served = served
+	return result, err
+}
+
+// SetVolume sets the volume from 0 to 1, returning what the device reports.
+func (registry *Registry) SetVolume(ctx context.Context, ref string, level float32) (VolumeResult, error) {
+	result := VolumeResult{}
+	served, err := registry.call(ctx, ref, route{
+		idempotent: true,
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) (err error) {
+			result.Volume, err = connection.SetVolume(ctx, level)
+			return
+		},
+		http: func(ctx context.Context, connection *httpControl.RPC) (err error) {
+			result.Volume, err = connection.SetVolume(ctx, level)
+			return
+		},
+		websocket: func(ctx context.Context, connection *websocketControl.RPC) (err error) {
+			result.Volume, err = connection.SetVolume(ctx, level)
+			return
+		},
+	})
+	result.Served = served
+	return result, err
+}
+
+func (registry *Registry) GetMute(ctx context.Context, ref string) (MuteResult, error) {
+	result := MuteResult{}
+	served, err := registry.call(ctx, ref, route{
+		idempotent: true,
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) (err error) {
+			result.Mute, err = connection.GetMute(ctx)
+			return
+		},
+		http: func(ctx context.Context, connection *httpControl.RPC) error {
+			status, statusErr := connection.GetPlayerStatus(ctx)
+			result.Mute = status.Mute
+			return statusErr
+		},
+	})
+	result.Served = served
+	return result, err
+}
+
+func (registry *Registry) SetMute(ctx context.Context, ref string, state bool) (MuteResult, error) {
+	result := MuteResult{}
+	served, err := registry.call(ctx, ref, route{
+		idempotent: true,
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) (err error) {
+			result.Mute, err = connection.SetMute(ctx, state)
+			return
+		},
+		http: func(ctx context.Context, connection *httpControl.RPC) (err error) {
+			result.Mute, err = connection.SetMute(ctx, state)
+			return
+		},
+	})
+	result.Served = served
+	return result, err
+}
+
+func (registry *Registry) RequestPlay(ctx context.Context, ref string) (Served, error) {
+	return registry.call(ctx, ref, route{
+		idempotent: true,
+		http: func(ctx context.Context, connection *httpControl.RPC) error {
+			return connection.RequestPlay(ctx)
+		},
+		websocket: func(ctx context.Context, connection *websocketControl.RPC) error {
+			return connection.RequestPlay(ctx)
+		},
+	})
+}
+
+func (registry *Registry) RequestPause(ctx context.Context, ref string) (Served, error) {
+	return registry.call(ctx, ref, route{
+		idempotent: true,
+		http: func(ctx context.Context, connection *httpControl.RPC) error {
+			return connection.RequestPause(ctx)
+		},
+		websocket: func(ctx context.Context, connection *websocketControl.RPC) error {
+			return connection.RequestPause(ctx)
+		},
+	})
+}
+
+func (registry *Registry) RequestPlayPause(ctx context.Context, ref string) (Served, error) {
+	return registry.call(ctx, ref, route{
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) error {
+			return connection.RequestPlayPause(ctx)
+		},
+		http: func(ctx context.Context, connection *httpControl.RPC) error {
+			return connection.RequestPlayPause(ctx)
+		},
+	})
+}
+
+func (registry *Registry) RequestStop(ctx context.Context, ref string) (Served, error) {
+	return registry.call(ctx, ref, route{
+		idempotent: true,
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) error {
+			return connection.RequestStop(ctx)
+		},
+		http: func(ctx context.Context, connection *httpControl.RPC) error {
+			return connection.RequestStop(ctx)
+		},
+	})
+}
+
+func (registry *Registry) RequestNext(ctx context.Context, ref string) (Served, error) {
+	return registry.call(ctx, ref, route{
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) error {
+			return connection.RequestNext(ctx)
+		},
+		http: func(ctx context.Context, connection *httpControl.RPC) error {
+			return connection.RequestNext(ctx)
+		},
+		websocket: func(ctx context.Context, connection *websocketControl.RPC) error {
+			return connection.RequestNext(ctx)
+		},
+	})
+}
+
+func (registry *Registry) RequestPrevious(ctx context.Context, ref string) (Served, error) {
+	return registry.call(ctx, ref, route{
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) error {
+			return connection.RequestPrevious(ctx)
+		},
+		http: func(ctx context.Context, connection *httpControl.RPC) error {
+			return connection.RequestPrevious(ctx)
+		},
+		websocket: func(ctx context.Context, connection *websocketControl.RPC) error {
+			return connection.RequestPrevious(ctx)
+		},
+	})
+}
+
+func (registry *Registry) GetSource(ctx context.Context, ref string) (SourceResult, error) {
+	result := SourceResult{}
+	served, err := registry.call(ctx, ref, route{
+		idempotent: true,
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) (err error) {
+			result.Source, err = connection.GetSource(ctx)
+			return
+		},
+	})
+	result.Served = served
+	return result, err
+}
+
+func (registry *Registry) SetSource(ctx context.Context, ref string, source serialMediaControl.InputSource) (SourceResult, error) {
+	result := SourceResult{}
+	served, err := registry.call(ctx, ref, route{
+		idempotent: true,
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) (err error) {
+			result.Source, err = connection.SetSource(ctx, source)
+			return
+		},
+	})
+	result.Served = served
+	return result, err
+}
+
+// RequestStandby puts the device in standby, which only the serial API can do.
+func (registry *Registry) RequestStandby(ctx context.Context, ref string) (Served, error) {
+	return registry.call(ctx, ref, route{
+		idempotent: true,
+		serial: func(ctx context.Context, connection *serialMediaControl.RPC) error {
+			return connection.RequestStandby(ctx)
+		},
+	})
+}
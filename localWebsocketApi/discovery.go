@@ -0,0 +1,215 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package localWebsocketApi
+
+import (
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/localWebsocketApi/endpoints"
+	"arylic-connect/localWebsocketApi/extWebsocket"
+	"arylic-connect/localWebsocketApi/httpmedia"
+	"arylic-connect/localWebsocketApi/serialmedia"
+	"arylic-connect/localWebsocketApi/upgrades"
+	"arylic-connect/localWebsocketApi/upnp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/koron/go-ssdp"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// playQueueService is the SSDP service type only Arylic (LinkPlay) devices
+// advertise.
+const playQueueService = "urn:schemas-wiimu-com:service:PlayQueue:1"
+
+var errDeviceLeft = errors.New("device left the network")
+
+// useInterfaces limits SSDP, both searching and listening, to the named
+// interfaces.
+func useInterfaces(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	interfaces := make([]net.Interface, 0, len(names))
+	for _, name := range names {
+		found, findErr := net.InterfaceByName(name)
+		if findErr != nil {
+			return fmt.Errorf("discovery interface %s: %w", name, findErr)
+		}
+		interfaces = append(interfaces, *found)
+	}
+	ssdp.Interfaces = interfaces
+	return nil
+}
+
+// uuidOf takes the device UUID from an SSDP USN, like
+// uuid:<uuid>::urn:schemas-wiimu-com:service:PlayQueue:1.
+func uuidOf(usn string) string {
+	uuid := strings.TrimPrefix(usn, "uuid:")
+	separator := strings.Index(uuid, "::")
+	if separator != -1 {
+		uuid = uuid[:separator]
+	}
+	return uuid
+}
+
+// found handles a device turning up at a location, from a search reply or an
+// announcement. Its description is read first to check it's one of ours;
+// if that fails it's connected anyway, as it did advertise the PlayQueue
+// service. Byebye messages only carry the USN, so the host is remembered for
+// them.
+func (manager *WebsocketManager) found(usn string, location string) {
+	parsedUrl, urlErr := url.Parse(location)
+	if urlErr != nil || parsedUrl.Hostname() == "" {
+		return
+	}
+	host := parsedUrl.Hostname()
+
+	manager.ssdpLock.Lock()
+	previousHost, seen := manager.ssdpHosts[uuidOf(usn)]
+	manager.ssdpHosts[uuidOf(usn)] = host
+	manager.ssdpLock.Unlock()
+	if !seen || previousHost != host {
+		manager.devices.Feed.Publish(devices.PresenceEvent{Kind: devices.Presence_Discovered, Host: host, Via: "ssdp"})
+	}
+
+	description, described := manager.descriptions.Get(host)
+	if !described || description.Location != location {
+		ctx, ctxCancel := context.WithTimeout(context.Background(), manager.config.Discovery.Wait)
+		fetched, fetchErr := upnp.Fetch(ctx, location)
+		ctxCancel()
+		if fetchErr != nil {
+			log.Printf("Error reading device description for %s: %s\n", host, fetchErr.Error())
+		} else {
+			description, described = fetched, true
+			manager.descriptions.Set(host, description)
+			if !manager.wanted(description) {
+				log.Printf("Skipping %s at %s, made by %s\n", description.FriendlyName, host, description.Manufacturer)
+			}
+		}
+	}
+	if described && !manager.wanted(description) {
+		return
+	}
+	manager.connectHost(host)
+}
+
+// wanted checks a description against the configured manufacturers.
+func (manager *WebsocketManager) wanted(description upnp.Description) bool {
+	manufacturers := manager.config.Discovery.Manufacturers
+	return len(manufacturers) == 0 || description.MadeBy(manufacturers)
+}
+
+// left drops the connections to a device that said it's going. They're
+// picked up again when it next announces itself or is searched out.
+func (manager *WebsocketManager) left(usn string) {
+	manager.ssdpLock.Lock()
+	host, known := manager.ssdpHosts[uuidOf(usn)]
+	// Forget it so its return counts as a discovery.
+	delete(manager.ssdpHosts, uuidOf(usn))
+	manager.ssdpLock.Unlock()
+	if !known {
+		return
+	}
+
+	log.Printf("Device at %s left the network\n", host)
+	manager.devices.Feed.Publish(devices.PresenceEvent{Kind: devices.Presence_Left, Host: host})
+	onHost := func(registry *endpoints.Registry) []string {
+		names := make([]string, 0)
+		for _, endpoint := range registry.List() {
+			if upgrades.HostOf(endpoint.Target) == host && endpoint.State == endpoints.State_Connected {
+				names = append(names, endpoint.Name)
+			}
+		}
+		return names
+	}
+	for _, name := range onHost(manager.serialConnections.Endpoints) {
+		serialmedia.DropEndpoint(manager.serialConnections, name, errDeviceLeft)
+	}
+	for _, name := range onHost(manager.httpConnections.Endpoints) {
+		httpmedia.DropEndpoint(manager.httpConnections, name, errDeviceLeft)
+	}
+	for _, name := range onHost(manager.websocketConnections.Endpoints) {
+		extWebsocket.DropEndpoint(manager.websocketConnections, name, errDeviceLeft)
+	}
+}
+
+// announced handles an alive message away from the monitor's receive loop,
+// as reading the description and connecting can take a while. Devices repeat
+// their announcements, so any that come in while one is being handled are
+// dropped.
+func (manager *WebsocketManager) announced(usn string, location string) {
+	uuid := uuidOf(usn)
+	manager.ssdpLock.Lock()
+	if manager.ssdpBusy[uuid] {
+		manager.ssdpLock.Unlock()
+		return
+	}
+	manager.ssdpBusy[uuid] = true
+	manager.ssdpLock.Unlock()
+
+	go func() {
+		defer func() {
+			manager.ssdpLock.Lock()
+			delete(manager.ssdpBusy, uuid)
+			manager.ssdpLock.Unlock()
+		}()
+		manager.found(usn, location)
+	}()
+}
+
+// ssdpListenLoop connects devices as soon as they announce themselves and
+// drops them when they say they're leaving. The periodic search still runs
+// for devices whose announcements get lost.
+func (manager *WebsocketManager) ssdpListenLoop(ctx context.Context) error {
+	monitor := &ssdp.Monitor{
+		Alive: func(message *ssdp.AliveMessage) {
+			if message.Type == playQueueService {
+				manager.announced(message.USN, message.Location)
+			}
+		},
+		Bye: func(message *ssdp.ByeMessage) {
+			if message.Type == playQueueService {
+				// Dropping connections waits on the wrappers' locks
+				go manager.left(message.USN)
+			}
+		},
+	}
+	startErr := monitor.Start()
+	if startErr != nil {
+		return startErr
+	}
+	<-ctx.Done()
+	return monitor.Close()
+}
+
+// knownHost reports whether a host already has a working connection, so scans
+// can skip it.
+func (manager *WebsocketManager) knownHost(host string) bool {
+	for _, registry := range []*endpoints.Registry{manager.serialConnections.Endpoints, manager.httpConnections.Endpoints, manager.websocketConnections.Endpoints} {
+		for _, endpoint := range registry.List() {
+			if upgrades.HostOf(endpoint.Target) == host && endpoint.State != endpoints.State_Offline {
+				return true
+			}
+		}
+	}
+	return false
+}
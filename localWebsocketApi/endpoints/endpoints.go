@@ -0,0 +1,297 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package endpoints keeps the connection state of each device a wrapper has
+// seen, including ones that have dropped off or been disconnected, so that
+// clients can tell a device that's offline from one that was never there.
+package endpoints
+
+import (
+	"arylic-connect/transport"
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProbeInterval is how often connected endpoints are checked for liveness.
+const ProbeInterval = 30 * time.Second
+
+type ConnectionState string
+
+const (
+	State_Connected    ConnectionState = "connected"
+	State_Offline      ConnectionState = "offline"      // stopped responding, will be retried
+	State_Disconnected ConnectionState = "disconnected" // disconnected on request, left alone
+)
+
+type Endpoint struct {
+	Name        string
+	Target      string
+	State       ConnectionState
+	ConnectedAt time.Time
+	LastSeen    time.Time
+	LastError   string
+}
+
+type entry struct {
+	Endpoint
+	stopProbe func()
+}
+
+// Change describes an endpoint moving between states. Previous is empty for
+// endpoints that weren't known before, and NewConnection is set when a
+// connection was opened rather than an existing one recovering.
+type Change struct {
+	Endpoint      Endpoint
+	Previous      ConnectionState
+	NewConnection bool
+	Forgotten     bool
+}
+
+// Registry tracks endpoints by the name the wrapper keys its connections on.
+type Registry struct {
+	flavor transport.InterfaceFlavor
+
+	lock      sync.Mutex
+	endpoints map[string]*entry
+	listeners []func(Change)
+}
+
+// NewRegistry makes a registry for the connections of one transport flavor.
+func NewRegistry(flavor transport.InterfaceFlavor) *Registry {
+	return &Registry{
+		flavor:    flavor,
+		endpoints: make(map[string]*entry),
+	}
+}
+
+// OnChange adds a function to call whenever an endpoint connects or changes
+// state. It's called without the registry locked.
+func (registry *Registry) OnChange(listener func(Change)) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	registry.listeners = append(registry.listeners, listener)
+}
+
+// notify is deferred before locking so it runs once the lock is released.
+func (registry *Registry) notify(change *Change) {
+	if change == nil {
+		return
+	}
+	registry.lock.Lock()
+	listeners := registry.listeners
+	registry.lock.Unlock()
+	for _, listener := range listeners {
+		listener(*change)
+	}
+}
+
+func (registry *Registry) entryFor(name string) *entry {
+	existing, hasEntry := registry.endpoints[name]
+	if !hasEntry {
+		existing = &entry{Endpoint: Endpoint{Name: name}}
+		registry.endpoints[name] = existing
+	}
+	return existing
+}
+
+// Connected records a new connection and starts probing it with probe every
+// ProbeInterval, replacing any probe already running for the name.
+func (registry *Registry) Connected(name string, target string, probe func(ctx context.Context) error) {
+	var change *Change
+	defer func() { registry.notify(change) }()
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	previous, seenBefore := registry.endpoints[name]
+	previousState := ConnectionState("")
+	if seenBefore {
+		previousState = previous.State
+		transport.Observed().Reconnect(registry.flavor, target)
+	}
+
+	now := time.Now()
+	current := registry.entryFor(name)
+	if current.stopProbe != nil {
+		current.stopProbe()
+	}
+	current.Target = target
+	current.State = State_Connected
+	current.ConnectedAt = now
+	current.LastSeen = now
+	current.LastError = ""
+	change = &Change{Endpoint: current.Endpoint, Previous: previousState, NewConnection: true}
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	current.stopProbe = ctxCancel
+	go registry.probeLoop(ctx, name, probe)
+}
+
+func (registry *Registry) probeLoop(ctx context.Context, name string, probe func(ctx context.Context) error) {
+	ticker := time.NewTicker(ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			probeCtx, probeCancel := context.WithTimeout(ctx, ProbeInterval/2)
+			probeErr := probe(probeCtx)
+			probeCancel()
+			if ctx.Err() != nil {
+				return
+			}
+			if probeErr != nil {
+				registry.Failed(name, probeErr)
+			} else {
+				registry.Seen(name)
+			}
+		}
+	}
+}
+
+// Seen marks an endpoint as responding.
+func (registry *Registry) Seen(name string) {
+	var change *Change
+	defer func() { registry.notify(change) }()
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	current, hasEntry := registry.endpoints[name]
+	if !hasEntry || current.State == State_Disconnected {
+		return
+	}
+	previousState := current.State
+	current.State = State_Connected
+	current.LastSeen = time.Now()
+	current.LastError = ""
+	if previousState != State_Connected {
+		change = &Change{Endpoint: current.Endpoint, Previous: previousState}
+	}
+}
+
+// Failed marks an endpoint as offline. Probing continues, so it comes back if
+// the device does.
+func (registry *Registry) Failed(name string, err error) {
+	var change *Change
+	defer func() { registry.notify(change) }()
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	current, hasEntry := registry.endpoints[name]
+	if !hasEntry {
+		return
+	}
+	current.LastError = err.Error()
+	if current.State == State_Connected {
+		current.State = State_Offline
+		change = &Change{Endpoint: current.Endpoint, Previous: State_Connected}
+	}
+}
+
+// Disconnected marks an endpoint as deliberately disconnected and stops
+// probing it. The entry is kept so it can be reconnected.
+func (registry *Registry) Disconnected(name string) {
+	var change *Change
+	defer func() { registry.notify(change) }()
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	current, hasEntry := registry.endpoints[name]
+	if !hasEntry {
+		return
+	}
+	if current.stopProbe != nil {
+		current.stopProbe()
+		current.stopProbe = nil
+	}
+	previousState := current.State
+	current.State = State_Disconnected
+	if previousState != State_Disconnected {
+		change = &Change{Endpoint: current.Endpoint, Previous: previousState}
+	}
+}
+
+// Forget drops everything known about an endpoint.
+func (registry *Registry) Forget(name string) bool {
+	var change *Change
+	defer func() { registry.notify(change) }()
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	current, hasEntry := registry.endpoints[name]
+	if !hasEntry {
+		return false
+	}
+	if current.stopProbe != nil {
+		current.stopProbe()
+	}
+	delete(registry.endpoints, name)
+	change = &Change{Endpoint: current.Endpoint, Previous: current.State, Forgotten: true}
+	return true
+}
+
+func (registry *Registry) Get(name string) (Endpoint, bool) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	current, hasEntry := registry.endpoints[name]
+	if !hasEntry {
+		return Endpoint{}, false
+	}
+	return current.Endpoint, true
+}
+
+// HeldDisconnected reports whether a target was disconnected on request, so
+// discovery knows not to bring it back.
+func (registry *Registry) HeldDisconnected(target string) bool {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	for _, current := range registry.endpoints {
+		if current.Target == target && current.State == State_Disconnected {
+			return true
+		}
+	}
+	return false
+}
+
+// Offline reports whether the endpoint for a name has stopped responding.
+func (registry *Registry) Offline(name string) bool {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	current, hasEntry := registry.endpoints[name]
+	return hasEntry && current.State == State_Offline
+}
+
+// List returns every known endpoint, sorted by name.
+func (registry *Registry) List() []Endpoint {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	list := make([]Endpoint, 0, len(registry.endpoints))
+	for _, current := range registry.endpoints {
+		list = append(list, current.Endpoint)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,121 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package extWebsocket
+
+import (
+	"arylic-connect/rpcWrapper/websocketControl"
+	"context"
+)
+
+func (wrapper *ExternalWebsocketWrapper) RequestPlay(ctx context.Context, target string) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.RequestPlay(ctx)
+}
+
+func (wrapper *ExternalWebsocketWrapper) RequestPause(ctx context.Context, target string) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.RequestPause(ctx)
+}
+
+func (wrapper *ExternalWebsocketWrapper) RequestNext(ctx context.Context, target string) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.RequestNext(ctx)
+}
+
+func (wrapper *ExternalWebsocketWrapper) RequestPrevious(ctx context.Context, target string) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.RequestPrevious(ctx)
+}
+
+// Seek jumps to a position in the current track, in milliseconds.
+func (wrapper *ExternalWebsocketWrapper) Seek(ctx context.Context, target string, position int) (websocketControl.StatusChangeMessage, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return websocketControl.StatusChangeMessage{}, connErr
+	}
+
+	return connection.Seek(ctx, position)
+}
+
+func (wrapper *ExternalWebsocketWrapper) SetVolume(ctx context.Context, target string, level float32) (float32, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
+	}
+
+	return connection.SetVolume(ctx, level)
+}
+
+func (wrapper *ExternalWebsocketWrapper) SetInput(ctx context.Context, target string, input string) (string, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return "", connErr
+	}
+
+	return connection.SetInput(ctx, input)
+}
+
+func (wrapper *ExternalWebsocketWrapper) SetLoopMode(ctx context.Context, target string, mode string) (string, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return "", connErr
+	}
+
+	return connection.SetLoopMode(ctx, mode)
+}
@@ -19,10 +19,14 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package extWebsocket
 
 import (
+	"arylic-connect/localWebsocketApi/endpoints"
+	"arylic-connect/localWebsocketApi/upgrades"
 	"arylic-connect/rpcWrapper/websocketControl"
+	arylicTransport "arylic-connect/transport"
 	"arylic-connect/transport/websocket"
 	"context"
-	"log"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -30,49 +34,82 @@ import (
 type ExternalWebsocketWrapper struct {
 	HttpMediaCons map[string]*websocketControl.RPC
 	OpLock        sync.RWMutex
+
+	Upgrades  *upgrades.Tracker
+	Endpoints *endpoints.Registry
+	// ConnectTimeout bounds how long ConnectEndpoint waits for a device.
+	ConnectTimeout time.Duration
 }
 
 func New() *ExternalWebsocketWrapper {
 	return &ExternalWebsocketWrapper{
-		HttpMediaCons: make(map[string]*websocketControl.RPC),
+		HttpMediaCons:  make(map[string]*websocketControl.RPC),
+		ConnectTimeout: time.Second * 15,
+		Endpoints:      endpoints.NewRegistry(arylicTransport.Flavor_WS),
 	}
 }
 
-func (wrapper *ExternalWebsocketWrapper) ConnectEndpoint(target string, name string) error {
-	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*15)
+func (wrapper *ExternalWebsocketWrapper) ConnectEndpoint(target string, name string) (string, error) {
+	ctx, ctxCancel := context.WithTimeout(context.Background(), wrapper.ConnectTimeout)
 	defer ctxCancel()
 
 	transport, transportErr := websocket.New()
 	if transportErr != nil {
-		return transportErr
+		return "", transportErr
 	}
 	connectErr := transport.Connect(target)
 	if connectErr != nil {
-		return connectErr
+		return "", connectErr
 	}
 	rpc := websocketControl.New(transport)
 	_, statusErr := rpc.GetStatus(ctx)
 	if statusErr != nil {
-		return statusErr
+		return "", statusErr
 	}
 
 	wrapper.OpLock.Lock()
 	defer wrapper.OpLock.Unlock()
 
-	existingEndpoint, hasEndpoint := wrapper.HttpMediaCons[target]
-	if hasEndpoint {
-		closeErr := existingEndpoint.Close()
-		if closeErr != nil {
-			log.Printf("Error closing existing endpoint connection for %s: %s\n", name, closeErr)
-		}
-		delete(wrapper.HttpMediaCons, name)
-	}
+	name = wrapper.uniqueName(name, rpc)
+	wrapper.dropRenamed(name, target)
+	wrapper.disconnect(name)
+	wrapper.HttpMediaCons[name] = rpc
+	wrapper.Endpoints.Connected(name, target, func(ctx context.Context) error {
+		_, probeErr := rpc.GetStatus(ctx)
+		return probeErr
+	})
 
-	rpc.GetStatus(ctx)
+	return name, nil
+}
 
-	wrapper.HttpMediaCons[name] = rpc
+// uniqueName picks the key for a new connection. Names aren't unique, so if
+// another device already has the name the host is added to it.
+//
+// Callers must hold OpLock.
+func (wrapper *ExternalWebsocketWrapper) uniqueName(name string, connection *websocketControl.RPC) string {
+	host := upgrades.HostOf(connection.TransportTarget())
+	if name == "" {
+		return host
+	}
+	existing, hasEndpoint := wrapper.HttpMediaCons[name]
+	if !hasEndpoint || upgrades.HostOf(existing.TransportTarget()) == host {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, host)
+}
 
-	return nil
+// dropRenamed closes and forgets any other entry for the same host as target,
+// which is the device from before it was renamed, so it isn't listed twice.
+//
+// Callers must hold OpLock.
+func (wrapper *ExternalWebsocketWrapper) dropRenamed(name string, target string) {
+	host := upgrades.HostOf(target)
+	for _, known := range wrapper.Endpoints.List() {
+		if known.Name != name && upgrades.HostOf(known.Target) == host {
+			wrapper.disconnect(known.Name)
+			wrapper.Endpoints.Forget(known.Name)
+		}
+	}
 }
 
 type EndpointInfo struct {
@@ -86,6 +123,9 @@ func (wrapper *ExternalWebsocketWrapper) ConnectedEndpoints() []EndpointInfo {
 	endpoints := make([]EndpointInfo, 0)
 
 	for name, endpoint := range wrapper.HttpMediaCons {
+		if wrapper.Endpoints.Offline(name) {
+			continue
+		}
 		endpoints = append(endpoints, EndpointInfo{
 			Name:   name,
 			Target: "ws://" + endpoint.TransportTarget() + "/",
@@ -94,3 +134,19 @@ func (wrapper *ExternalWebsocketWrapper) ConnectedEndpoints() []EndpointInfo {
 
 	return endpoints
 }
+
+// endpoint looks up the connection for a target, refusing it while the device
+// is in the middle of a firmware upgrade.
+//
+// Callers must hold OpLock.
+func (wrapper *ExternalWebsocketWrapper) endpoint(target string) (*websocketControl.RPC, error) {
+	connection, hasConnection := wrapper.HttpMediaCons[target]
+	if !hasConnection {
+		return nil, errors.New("endpoint not found")
+	}
+	if wrapper.Upgrades.Upgrading(upgrades.HostOf(connection.TransportTarget())) {
+		return nil, upgrades.ErrUpgrading
+	}
+
+	return connection, nil
+}
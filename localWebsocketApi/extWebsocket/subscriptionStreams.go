@@ -2,7 +2,6 @@ package extWebsocket
 
 import (
 	"context"
-	"errors"
 	"github.com/ethereum/go-ethereum/rpc"
 )
 
@@ -10,9 +9,9 @@ func (wrapper *ExternalWebsocketWrapper) StatusChanges(ctx context.Context, targ
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.HttpMediaCons[target]
-	if !hasConnection {
-		return nil, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return nil, connErr
 	}
 
 	notifier, supported := rpc.NotifierFromContext(ctx)
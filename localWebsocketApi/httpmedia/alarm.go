@@ -0,0 +1,130 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpmedia
+
+import (
+	"arylic-connect/rpcWrapper/httpControl"
+	"context"
+)
+
+// GetAlarms queries every alarm slot on the device.
+func (wrapper *HttpMediaWrapper) GetAlarms(ctx context.Context, target string) ([]httpControl.Alarm, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return nil, connErr
+	}
+
+	alarms := make([]httpControl.Alarm, httpControl.AlarmSlots)
+	for slot := range alarms {
+		alarm, alarmErr := connection.GetAlarm(ctx, slot)
+		if alarmErr != nil {
+			return nil, alarmErr
+		}
+		alarms[slot] = alarm
+	}
+
+	return alarms, nil
+}
+
+func (wrapper *HttpMediaWrapper) GetAlarm(ctx context.Context, target string, slot int) (httpControl.Alarm, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return httpControl.Alarm{}, connErr
+	}
+
+	return connection.GetAlarm(ctx, slot)
+}
+
+func (wrapper *HttpMediaWrapper) SetAlarm(ctx context.Context, target string, alarm httpControl.Alarm) (httpControl.Alarm, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return httpControl.Alarm{}, connErr
+	}
+
+	return connection.SetAlarm(ctx, alarm)
+}
+
+func (wrapper *HttpMediaWrapper) ClearAlarm(ctx context.Context, target string, slot int) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.ClearAlarm(ctx, slot)
+}
+
+func (wrapper *HttpMediaWrapper) StopAlarm(ctx context.Context, target string) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.StopAlarm(ctx)
+}
+
+func (wrapper *HttpMediaWrapper) GetSleepTimer(ctx context.Context, target string) (int, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return -1, connErr
+	}
+
+	return connection.GetSleepTimer(ctx)
+}
+
+func (wrapper *HttpMediaWrapper) SetSleepTimer(ctx context.Context, target string, seconds int) (int, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return -1, connErr
+	}
+
+	return connection.SetSleepTimer(ctx, seconds)
+}
+
+func (wrapper *HttpMediaWrapper) CancelSleepTimer(ctx context.Context, target string) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.CancelSleepTimer(ctx)
+}
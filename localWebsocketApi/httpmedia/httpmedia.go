@@ -19,10 +19,14 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package httpmedia
 
 import (
+	"arylic-connect/localWebsocketApi/endpoints"
+	"arylic-connect/localWebsocketApi/upgrades"
 	"arylic-connect/rpcWrapper/httpControl"
+	arylicTransport "arylic-connect/transport"
 	"arylic-connect/transport/http"
 	"context"
-	"log"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -30,16 +34,30 @@ import (
 type HttpMediaWrapper struct {
 	HttpMediaCons map[string]*httpControl.RPC
 	OpLock        sync.RWMutex
+
+	pollers map[string]*poller
+	// pollerStarted is closed and replaced whenever a poller is started, so
+	// subscriptions waiting on a disconnected device know to look again.
+	pollerStarted chan struct{}
+
+	Upgrades  *upgrades.Tracker
+	Endpoints *endpoints.Registry
+	// ConnectTimeout bounds how long ConnectEndpoint waits for a device.
+	ConnectTimeout time.Duration
 }
 
 func New() *HttpMediaWrapper {
 	return &HttpMediaWrapper{
-		HttpMediaCons: make(map[string]*httpControl.RPC),
+		HttpMediaCons:  make(map[string]*httpControl.RPC),
+		pollers:        make(map[string]*poller),
+		pollerStarted:  make(chan struct{}),
+		ConnectTimeout: time.Second * 15,
+		Endpoints:      endpoints.NewRegistry(arylicTransport.Flavor_HTTP),
 	}
 }
 
 func (wrapper *HttpMediaWrapper) ConnectEndpoint(target string) (string, error) {
-	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*15)
+	ctx, ctxCancel := context.WithTimeout(context.Background(), wrapper.ConnectTimeout)
 	defer ctxCancel()
 
 	transport, _ := http.New()
@@ -56,18 +74,49 @@ func (wrapper *HttpMediaWrapper) ConnectEndpoint(target string) (string, error)
 	wrapper.OpLock.Lock()
 	defer wrapper.OpLock.Unlock()
 
-	existingEndpoint, hasEndpoint := wrapper.HttpMediaCons[status.DeviceName]
-	if hasEndpoint {
-		closeErr := existingEndpoint.Close()
-		if closeErr != nil {
-			log.Printf("Error closing existing endpoint connection for %s: %s\n", status.DeviceName, closeErr)
-		}
-		delete(wrapper.HttpMediaCons, status.DeviceName)
-	}
+	name := wrapper.uniqueName(status.DeviceName, rpc)
+	wrapper.dropRenamed(name, target)
+	wrapper.disconnect(name)
+	wrapper.HttpMediaCons[name] = rpc
+	wrapper.pollers[name] = newPoller(rpc)
+	close(wrapper.pollerStarted)
+	wrapper.pollerStarted = make(chan struct{})
+	wrapper.Endpoints.Connected(name, target, func(ctx context.Context) error {
+		_, probeErr := rpc.GetStatus(ctx)
+		return probeErr
+	})
+
+	return name, nil
+}
 
-	wrapper.HttpMediaCons[status.DeviceName] = rpc
+// uniqueName picks the key for a new connection. Names aren't unique, so if
+// another device already has the name the host is added to it.
+//
+// Callers must hold OpLock.
+func (wrapper *HttpMediaWrapper) uniqueName(name string, connection *httpControl.RPC) string {
+	host := upgrades.HostOf(connection.TransportTarget())
+	if name == "" {
+		return host
+	}
+	existing, hasEndpoint := wrapper.HttpMediaCons[name]
+	if !hasEndpoint || upgrades.HostOf(existing.TransportTarget()) == host {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, host)
+}
 
-	return status.DeviceName, nil
+// dropRenamed closes and forgets any other entry for the same host as target,
+// which is the device from before it was renamed, so it isn't listed twice.
+//
+// Callers must hold OpLock.
+func (wrapper *HttpMediaWrapper) dropRenamed(name string, target string) {
+	host := upgrades.HostOf(target)
+	for _, known := range wrapper.Endpoints.List() {
+		if known.Name != name && upgrades.HostOf(known.Target) == host {
+			wrapper.disconnect(known.Name)
+			wrapper.Endpoints.Forget(known.Name)
+		}
+	}
 }
 
 type EndpointInfo struct {
@@ -81,6 +130,9 @@ func (wrapper *HttpMediaWrapper) ConnectedEndpoints() []EndpointInfo {
 	endpoints := make([]EndpointInfo, 0)
 
 	for name, endpoint := range wrapper.HttpMediaCons {
+		if wrapper.Endpoints.Offline(name) {
+			continue
+		}
 		endpoints = append(endpoints, EndpointInfo{
 			Name:   name,
 			Target: endpoint.TransportTarget(),
@@ -89,3 +141,19 @@ func (wrapper *HttpMediaWrapper) ConnectedEndpoints() []EndpointInfo {
 
 	return endpoints
 }
+
+// endpoint looks up the connection for a target, refusing it while the device
+// is in the middle of a firmware upgrade.
+//
+// Callers must hold OpLock.
+func (wrapper *HttpMediaWrapper) endpoint(target string) (*httpControl.RPC, error) {
+	connection, hasConnection := wrapper.HttpMediaCons[target]
+	if !hasConnection {
+		return nil, errors.New("endpoint not found")
+	}
+	if wrapper.Upgrades.Upgrading(upgrades.HostOf(connection.TransportTarget())) {
+		return nil, upgrades.ErrUpgrading
+	}
+
+	return connection, nil
+}
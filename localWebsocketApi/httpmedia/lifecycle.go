@@ -0,0 +1,118 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpmedia
+
+import (
+	"arylic-connect/localWebsocketApi/endpoints"
+	"context"
+	"errors"
+	"log"
+)
+
+// disconnect closes and drops the connection for a target if there is one.
+//
+// Callers must hold OpLock.
+func (wrapper *HttpMediaWrapper) disconnect(target string) {
+	existingEndpoint, hasEndpoint := wrapper.HttpMediaCons[target]
+	if hasEndpoint {
+		closeErr := existingEndpoint.Close()
+		if closeErr != nil {
+			log.Printf("Error closing endpoint connection for %s: %s\n", target, closeErr)
+		}
+		delete(wrapper.HttpMediaCons, target)
+	}
+	existingPoller, hasPoller := wrapper.pollers[target]
+	if hasPoller {
+		existingPoller.stop()
+		delete(wrapper.pollers, target)
+	}
+}
+
+// CloseAll disconnects every device on shutdown. See serialmedia.CloseAll.
+func CloseAll(wrapper *HttpMediaWrapper) {
+	wrapper.OpLock.Lock()
+	defer wrapper.OpLock.Unlock()
+	for target := range wrapper.HttpMediaCons {
+		wrapper.disconnect(target)
+		wrapper.Endpoints.Disconnected(target)
+	}
+}
+
+// DropEndpoint closes the connection to a device that has left the network,
+// leaving it offline for discovery to reconnect. See serialmedia.DropEndpoint.
+func DropEndpoint(wrapper *HttpMediaWrapper, target string, reason error) {
+	wrapper.OpLock.Lock()
+	wrapper.disconnect(target)
+	wrapper.OpLock.Unlock()
+	wrapper.Endpoints.Failed(target, reason)
+}
+
+// DisconnectEndpoint closes the connection to a device. It stays listed, and
+// discovery leaves it alone until it's reconnected or forgotten.
+func (wrapper *HttpMediaWrapper) DisconnectEndpoint(ctx context.Context, target string) error {
+	_, known := wrapper.Endpoints.Get(target)
+	if !known {
+		return errors.New("endpoint not found")
+	}
+
+	wrapper.OpLock.Lock()
+	wrapper.disconnect(target)
+	wrapper.OpLock.Unlock()
+	wrapper.Endpoints.Disconnected(target)
+	return nil
+}
+
+// ReconnectEndpoint opens a fresh connection to a known device, whether it was
+// disconnected, offline or still connected.
+func (wrapper *HttpMediaWrapper) ReconnectEndpoint(ctx context.Context, target string) (endpoints.Endpoint, error) {
+	known, isKnown := wrapper.Endpoints.Get(target)
+	if !isKnown {
+		return endpoints.Endpoint{}, errors.New("endpoint not found")
+	}
+
+	name, connectErr := wrapper.ConnectEndpoint(known.Target)
+	if connectErr != nil {
+		wrapper.Endpoints.Failed(target, connectErr)
+		return endpoints.Endpoint{}, connectErr
+	}
+	if name != target {
+		// The device was renamed while we weren't connected.
+		wrapper.Endpoints.Forget(target)
+	}
+
+	reconnected, _ := wrapper.Endpoints.Get(name)
+	return reconnected, nil
+}
+
+// ForgetEndpoint disconnects a device and drops its record, so it only comes
+// back if discovery finds it again.
+func (wrapper *HttpMediaWrapper) ForgetEndpoint(ctx context.Context, target string) error {
+	wrapper.OpLock.Lock()
+	wrapper.disconnect(target)
+	wrapper.OpLock.Unlock()
+	if !wrapper.Endpoints.Forget(target) {
+		return errors.New("endpoint not found")
+	}
+	return nil
+}
+
+// ListEndpoints returns every known device with its connection state.
+func (wrapper *HttpMediaWrapper) ListEndpoints(ctx context.Context) []endpoints.Endpoint {
+	return wrapper.Endpoints.List()
+}
@@ -0,0 +1,97 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpmedia
+
+import (
+	"arylic-connect/rpcWrapper/httpControl"
+	"context"
+	"errors"
+)
+
+// LocalTrackPage is one page of the tracks on a device's USB drive or TF card.
+type LocalTrackPage struct {
+	Total    int                      `json:"total"`
+	Page     int                      `json:"page"`
+	PageSize int                      `json:"pageSize"`
+	Tracks   []httpControl.LocalTrack `json:"tracks"`
+}
+
+func (wrapper *HttpMediaWrapper) GetLocalTrackCount(ctx context.Context, target string) (int, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
+	}
+
+	return connection.GetLocalTrackCount(ctx)
+}
+
+// GetLocalTracks pages through the tracks on a device's USB drive or TF card.
+// Pages count from 0.
+func (wrapper *HttpMediaWrapper) GetLocalTracks(ctx context.Context, target string, page int, pageSize int) (LocalTrackPage, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	result := LocalTrackPage{Page: page, PageSize: pageSize, Tracks: make([]httpControl.LocalTrack, 0)}
+	if page < 0 || pageSize <= 0 {
+		return result, errors.New("invalid page")
+	}
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return result, connErr
+	}
+
+	total, countErr := connection.GetLocalTrackCount(ctx)
+	if countErr != nil {
+		return result, countErr
+	}
+	result.Total = total
+
+	start := page * pageSize
+	if start >= total {
+		return result, nil
+	}
+	count := pageSize
+	if start+count > total {
+		count = total - start
+	}
+
+	tracks, tracksErr := connection.GetLocalTracks(ctx, start, count)
+	if tracksErr != nil {
+		return result, tracksErr
+	}
+	result.Tracks = tracks
+
+	return result, nil
+}
+
+func (wrapper *HttpMediaWrapper) PlayLocalTrack(ctx context.Context, target string, index int) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.PlayLocalTrack(ctx, index)
+}
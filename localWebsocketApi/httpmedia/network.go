@@ -0,0 +1,62 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpmedia
+
+import (
+	"arylic-connect/rpcWrapper/httpControl"
+	"context"
+)
+
+func (wrapper *HttpMediaWrapper) SetEthernetDHCP(ctx context.Context, target string) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.SetEthernetDHCP(ctx)
+}
+
+// SetEthernetStatic returns false without an error when the address changed,
+// since the change can't be checked from the old address.
+func (wrapper *HttpMediaWrapper) SetEthernetStatic(ctx context.Context, target string, config httpControl.StaticIpConfig) (bool, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
+	}
+
+	return connection.SetEthernetStatic(ctx, config)
+}
+
+func (wrapper *HttpMediaWrapper) SetDNS(ctx context.Context, target string, primary string, secondary string) (bool, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
+	}
+
+	return connection.SetDNS(ctx, primary, secondary)
+}
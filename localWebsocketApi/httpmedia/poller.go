@@ -0,0 +1,254 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpmedia
+
+import (
+	"arylic-connect/rpcWrapper/httpControl"
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The HTTP API has no way to push changes, so each connected device gets a
+// poller that reads its state on an interval and works out what changed.
+// Polling speeds up while something is playing or a client is subscribed, and
+// backs right off when nobody cares.
+const (
+	pollWatchedPlaying = time.Second
+	pollWatched        = 3 * time.Second
+	pollPlaying        = 10 * time.Second
+	pollIdle           = 30 * time.Second
+
+	// The full status is a much bigger request, so it only refreshes this often
+	// no matter how fast the player status is being polled.
+	endpointStatusMaxAge = 15 * time.Second
+)
+
+// FieldChange is a single field that differed between two polls. Field is the
+// dotted JSON path, like "player.volume" or "status.wifi.rssi".
+type FieldChange struct {
+	Field    string      `json:"field"`
+	Value    interface{} `json:"value"`
+	Previous interface{} `json:"previous"`
+}
+
+// pollResult is what watchers get sent after every poll that changed something.
+type pollResult struct {
+	Changes []FieldChange
+	Player  httpControl.PlayerStatus
+	Status  httpControl.EndpointStatus
+}
+
+type poller struct {
+	connection *httpControl.RPC
+	cancel     context.CancelFunc
+	wake       chan struct{}
+
+	lock          sync.RWMutex
+	stopped       bool
+	watchers      map[chan<- pollResult]struct{}
+	hasPlayer     bool
+	player        httpControl.PlayerStatus
+	hasStatus     bool
+	status        httpControl.EndpointStatus
+	statusUpdated time.Time
+}
+
+func newPoller(connection *httpControl.RPC) *poller {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	p := &poller{
+		connection: connection,
+		cancel:     ctxCancel,
+		wake:       make(chan struct{}, 1),
+		watchers:   make(map[chan<- pollResult]struct{}),
+	}
+	go p.loop(ctx)
+	return p
+}
+
+// stop ends polling and closes every watcher's channel, so watchers know to
+// move on to the device's next poller or give up.
+func (p *poller) stop() {
+	p.cancel()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stopped = true
+	for watcher := range p.watchers {
+		close(watcher)
+	}
+	p.watchers = make(map[chan<- pollResult]struct{})
+}
+
+func (p *poller) interval() time.Duration {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	watched := len(p.watchers) > 0
+	playing := p.hasPlayer && p.player.Playing
+	switch {
+	case watched && playing:
+		return pollWatchedPlaying
+	case watched:
+		return pollWatched
+	case playing:
+		return pollPlaying
+	default:
+		return pollIdle
+	}
+}
+
+// watch registers a channel for poll results and kicks off a poll straight
+// away, so a new watcher doesn't sit through a slow idle interval. The channel
+// is closed when the poller stops.
+func (p *poller) watch(channel chan<- pollResult) {
+	p.lock.Lock()
+	if p.stopped {
+		p.lock.Unlock()
+		close(channel)
+		return
+	}
+	p.watchers[channel] = struct{}{}
+	p.lock.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *poller) unwatch(channel chan<- pollResult) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.watchers, channel)
+}
+
+// last returns the most recent poll, if there has been one.
+func (p *poller) last() (httpControl.PlayerStatus, httpControl.EndpointStatus, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.player, p.status, p.hasPlayer && p.hasStatus
+}
+
+func (p *poller) loop(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-p.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		p.poll(ctx)
+		timer.Reset(p.interval())
+	}
+}
+
+func (p *poller) poll(ctx context.Context) {
+	pollCtx, pollCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer pollCancel()
+
+	player, playerErr := p.connection.GetPlayerStatus(pollCtx)
+
+	p.lock.RLock()
+	refreshStatus := !p.hasStatus || time.Since(p.statusUpdated) > endpointStatusMaxAge
+	p.lock.RUnlock()
+	var status httpControl.EndpointStatus
+	var statusErr error
+	if refreshStatus {
+		status, statusErr = p.connection.GetStatus(pollCtx)
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	wasKnown := p.hasPlayer && p.hasStatus
+	var changes []FieldChange
+	if playerErr == nil {
+		if p.hasPlayer {
+			diffFields("player", reflect.ValueOf(p.player), reflect.ValueOf(player), &changes)
+		}
+		p.player = player
+		p.hasPlayer = true
+	}
+	if refreshStatus && statusErr == nil {
+		if p.hasStatus {
+			diffFields("status", reflect.ValueOf(p.status), reflect.ValueOf(status), &changes)
+		}
+		p.status = status
+		p.hasStatus = true
+		p.statusUpdated = time.Now()
+	}
+
+	// The first complete poll goes out even though nothing changed, so watchers
+	// that attached before there was any state get a starting point.
+	firstKnown := !wasKnown && p.hasPlayer && p.hasStatus
+	if len(changes) == 0 && !firstKnown {
+		return
+	}
+	result := pollResult{Changes: changes, Player: p.player, Status: p.status}
+	for watcher := range p.watchers {
+		select {
+		case watcher <- result:
+		default:
+			// just pass on send fails
+		}
+	}
+}
+
+// diffFields walks two values of the same struct type and records every leaf
+// field that differs.
+func diffFields(path string, previous reflect.Value, current reflect.Value, changes *[]FieldChange) {
+	if previous.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(previous.Interface(), current.Interface()) {
+			*changes = append(*changes, FieldChange{
+				Field:    path,
+				Value:    current.Interface(),
+				Previous: previous.Interface(),
+			})
+		}
+		return
+	}
+
+	fields := previous.Type()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		diffFields(path+"."+name, previous.Field(i), current.Field(i), changes)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpmedia
+
+import (
+	"context"
+)
+
+func (wrapper *HttpMediaWrapper) SetDeviceName(ctx context.Context, target string, name string) (string, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return "", connErr
+	}
+
+	return connection.SetDeviceName(ctx, name)
+}
+
+func (wrapper *HttpMediaWrapper) SetApSSID(ctx context.Context, target string, ssid string) (string, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return "", connErr
+	}
+
+	return connection.SetApSSID(ctx, ssid)
+}
+
+func (wrapper *HttpMediaWrapper) SetApPassword(ctx context.Context, target string, password string) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	return connection.SetApPassword(ctx, password)
+}
+
+func (wrapper *HttpMediaWrapper) SetHideSSID(ctx context.Context, target string, hide bool) (bool, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
+	}
+
+	return connection.SetHideSSID(ctx, hide)
+}
+
+func (wrapper *HttpMediaWrapper) SetVoicePrompt(ctx context.Context, target string, enable bool) (bool, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
+	}
+
+	return connection.SetVoicePrompt(ctx, enable)
+}
+
+func (wrapper *HttpMediaWrapper) SetLanguage(ctx context.Context, target string, language string) (string, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return "", connErr
+	}
+
+	return connection.SetLanguage(ctx, language)
+}
+
+func (wrapper *HttpMediaWrapper) SetTimeZone(ctx context.Context, target string, tz string) (string, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return "", connErr
+	}
+
+	return connection.SetTimeZone(ctx, tz)
+}
@@ -0,0 +1,239 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpmedia
+
+import (
+	"arylic-connect/rpcWrapper/httpControl"
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// MetadataChange mirrors what the serial API streams when the track changes.
+type MetadataChange struct {
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+}
+
+// subscribe hooks a new subscription up to the poller for a target. The handler
+// is called with every poll that changed something, and once up front with the
+// last known state marked as changed so clients start with a full picture. If
+// the device disconnects or reconnects the subscription carries on with its
+// next poller, starting again from the full picture.
+func (wrapper *HttpMediaWrapper) subscribe(ctx context.Context, target string, handler func(notifier *rpc.Notifier, sub *rpc.Subscription, result pollResult, initial bool)) (*rpc.Subscription, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	_, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return nil, connErr
+	}
+	poller, hasPoller := wrapper.pollers[target]
+	if !hasPoller {
+		return nil, errors.New("endpoint not found")
+	}
+
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	incomingChannel := make(chan pollResult, 4)
+	poller.watch(incomingChannel)
+	sub := notifier.CreateSubscription()
+
+	go func() {
+		subCtx, subCancel := context.WithCancel(context.Background())
+		defer subCancel()
+		go func() {
+			<-sub.Err()
+			subCancel()
+		}()
+
+		// Until a full picture has gone out, the next poll is sent as one.
+		initial := true
+		sendLast := func() {
+			player, status, hasLast := poller.last()
+			if hasLast {
+				handler(notifier, sub, pollResult{Player: player, Status: status}, true)
+				initial = false
+			}
+		}
+		sendLast()
+		for {
+			select {
+			case result, open := <-incomingChannel:
+				if !open {
+					incomingChannel = make(chan pollResult, 4)
+					poller = wrapper.attach(subCtx, target, incomingChannel)
+					if poller == nil {
+						return
+					}
+					initial = true
+					sendLast()
+					continue
+				}
+				handler(notifier, sub, result, initial)
+				initial = false
+			case <-subCtx.Done():
+				poller.unwatch(incomingChannel)
+				return
+			}
+		}
+	}()
+
+	return sub, nil
+}
+
+// attach watches the poller for a target, waiting for the device to be
+// connected again if it isn't. It returns nil if ctx ends first.
+func (wrapper *HttpMediaWrapper) attach(ctx context.Context, target string, channel chan<- pollResult) *poller {
+	for {
+		wrapper.OpLock.RLock()
+		poller, hasPoller := wrapper.pollers[target]
+		if hasPoller {
+			poller.watch(channel)
+		}
+		started := wrapper.pollerStarted
+		wrapper.OpLock.RUnlock()
+
+		if hasPoller {
+			return poller
+		}
+		select {
+		case <-started:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func hasChange(result pollResult, fields ...string) bool {
+	for _, change := range result.Changes {
+		for _, field := range fields {
+			if change.Field == field {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StatusChanges streams every field that changes between polls of either the
+// player or the device status.
+func (wrapper *HttpMediaWrapper) StatusChanges(ctx context.Context, target string) (*rpc.Subscription, error) {
+	return wrapper.subscribe(ctx, target, func(notifier *rpc.Notifier, sub *rpc.Subscription, result pollResult, initial bool) {
+		for _, change := range result.Changes {
+			notifier.Notify(sub.ID, change)
+		}
+	})
+}
+
+func (wrapper *HttpMediaWrapper) VolumeChanges(ctx context.Context, target string) (*rpc.Subscription, error) {
+	return wrapper.subscribe(ctx, target, func(notifier *rpc.Notifier, sub *rpc.Subscription, result pollResult, initial bool) {
+		if initial || hasChange(result, "player.volume") {
+			notifier.Notify(sub.ID, result.Player.Volume)
+		}
+	})
+}
+
+func (wrapper *HttpMediaWrapper) MuteChanges(ctx context.Context, target string) (*rpc.Subscription, error) {
+	return wrapper.subscribe(ctx, target, func(notifier *rpc.Notifier, sub *rpc.Subscription, result pollResult, initial bool) {
+		if initial || hasChange(result, "player.mute") {
+			notifier.Notify(sub.ID, result.Player.Mute)
+		}
+	})
+}
+
+func (wrapper *HttpMediaWrapper) PlayChanges(ctx context.Context, target string) (*rpc.Subscription, error) {
+	return wrapper.subscribe(ctx, target, func(notifier *rpc.Notifier, sub *rpc.Subscription, result pollResult, initial bool) {
+		if initial || hasChange(result, "player.playing") {
+			notifier.Notify(sub.ID, result.Player.Playing)
+		}
+	})
+}
+
+func (wrapper *HttpMediaWrapper) MetadataChanges(ctx context.Context, target string) (*rpc.Subscription, error) {
+	return wrapper.subscribe(ctx, target, func(notifier *rpc.Notifier, sub *rpc.Subscription, result pollResult, initial bool) {
+		if initial || hasChange(result, "player.title", "player.artist", "player.album") {
+			notifier.Notify(sub.ID, MetadataChange{
+				Title:  result.Player.Title,
+				Artist: result.Player.Artist,
+				Album:  result.Player.Album,
+			})
+		}
+	})
+}
+
+// PlayerStatusChannel streams the player status from the poller for a target
+// until the context is cancelled or the device is disconnected, starting with
+// the last known status. The channel is closed when it ends. It's a function
+// rather than a method so it isn't served as an RPC.
+func PlayerStatusChannel(ctx context.Context, wrapper *HttpMediaWrapper, target string) (<-chan httpControl.PlayerStatus, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	poller, hasPoller := wrapper.pollers[target]
+	if !hasPoller {
+		return nil, errors.New("endpoint not found")
+	}
+
+	outputChan := make(chan httpControl.PlayerStatus)
+	incomingChannel := make(chan pollResult, 4)
+	poller.watch(incomingChannel)
+
+	go func() {
+		defer func() {
+			poller.unwatch(incomingChannel)
+			close(outputChan)
+		}()
+
+		player, _, hasLast := poller.last()
+		if hasLast {
+			select {
+			case outputChan <- player:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case result, open := <-incomingChannel:
+				if !open {
+					return
+				}
+				// A result without changes is the first full poll, which always
+				// goes out.
+				if len(result.Changes) > 0 && !hasChange(result, "player.position", "player.playing", "player.state", "player.title", "player.artist", "player.album", "player.duration") {
+					continue
+				}
+				select {
+				case outputChan <- result.Player:
+				default:
+					// just pass on send fails
+				}
+			}
+		}
+	}()
+
+	return outputChan, nil
+}
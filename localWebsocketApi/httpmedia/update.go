@@ -0,0 +1,178 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpmedia
+
+import (
+	"arylic-connect/localWebsocketApi/upgrades"
+	"arylic-connect/rpcWrapper/httpControl"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/rpc"
+	"log"
+	"time"
+)
+
+// updateTimeout is how long an update gets to finish, including the reboot at
+// the end, before it is written off as failed.
+const updateTimeout = 30 * time.Minute
+
+// updateStartTimeout is how long the device gets to start downloading before
+// the update is written off as never having started.
+const updateStartTimeout = 2 * time.Minute
+
+func (wrapper *HttpMediaWrapper) CheckForUpdate(ctx context.Context, target string) (httpControl.UpdateInfo, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return httpControl.UpdateInfo{}, connErr
+	}
+
+	return connection.CheckForUpdate(ctx)
+}
+
+// StartUpdate kicks off a firmware update if one is available. Other commands
+// to the device are refused until the update finishes or fails.
+func (wrapper *HttpMediaWrapper) StartUpdate(ctx context.Context, target string) error {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
+	}
+
+	status, statusErr := connection.GetStatus(ctx)
+	if statusErr != nil {
+		return statusErr
+	}
+	if !status.Updates.UpdateAvailable {
+		return errors.New("no update available")
+	}
+
+	startErr := connection.StartUpdate(ctx)
+	if startErr != nil {
+		return startErr
+	}
+
+	host := upgrades.HostOf(connection.TransportTarget())
+	wrapper.Upgrades.Begin(host)
+	go wrapper.monitorUpdate(host, connection)
+
+	return nil
+}
+
+// monitorUpdate follows an update through to the end, feeding the progress to
+// the upgrade tracker.
+func (wrapper *HttpMediaWrapper) monitorUpdate(host string, connection *httpControl.RPC) {
+	ctx, ctxCancel := context.WithTimeout(context.Background(), updateTimeout)
+	defer ctxCancel()
+
+	progressChannel := connection.UpdateProgressChannel(ctx, 2*time.Second)
+	startTimer := time.NewTimer(updateStartTimeout)
+	defer startTimer.Stop()
+	started := false
+	for {
+		select {
+		case <-startTimer.C:
+			if !started {
+				log.Printf("Firmware update never started on %s\n", host)
+				wrapper.Upgrades.Finish(host, errors.New("update did not start"))
+				return
+			}
+		case progress, open := <-progressChannel:
+			if !open {
+				log.Printf("Firmware update timed out on %s\n", host)
+				wrapper.Upgrades.Finish(host, errors.New("timed out waiting for update to finish"))
+				return
+			}
+			wrapper.Upgrades.Progress(host, progress)
+			switch progress.State {
+			case httpControl.Update_Failed:
+				log.Printf("Firmware update failed on %s with code %d\n", host, progress.Code)
+				wrapper.Upgrades.Finish(host, fmt.Errorf("update failed with code %d", progress.Code))
+				return
+			case httpControl.Update_Idle:
+				// Coming back idle after the reboot is the end of a good update
+				if started {
+					log.Printf("Firmware update finished on %s\n", host)
+					wrapper.Upgrades.Finish(host, nil)
+					return
+				}
+			case httpControl.Update_Downloading, httpControl.Update_Writing:
+				// Still checking doesn't count, the check can end idle with
+				// nothing installed
+				started = true
+			}
+		}
+	}
+}
+
+func (wrapper *HttpMediaWrapper) GetUpdateState(ctx context.Context, target string) (upgrades.State, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, hasConnection := wrapper.HttpMediaCons[target]
+	if !hasConnection {
+		return upgrades.State{}, errors.New("endpoint not found")
+	}
+
+	return wrapper.Upgrades.State(upgrades.HostOf(connection.TransportTarget())), nil
+}
+
+func (wrapper *HttpMediaWrapper) ListUpdates(ctx context.Context) []upgrades.State {
+	return wrapper.Upgrades.States()
+}
+
+func (wrapper *HttpMediaWrapper) UpdateChanges(ctx context.Context, target string) (*rpc.Subscription, error) {
+	wrapper.OpLock.RLock()
+	defer wrapper.OpLock.RUnlock()
+
+	connection, hasConnection := wrapper.HttpMediaCons[target]
+	if !hasConnection {
+		return nil, errors.New("endpoint not found")
+	}
+
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	host := upgrades.HostOf(connection.TransportTarget())
+	incomingChannel := make(chan upgrades.State, 8)
+	wrapper.Upgrades.Watch(host, incomingChannel)
+	sub := notifier.CreateSubscription()
+
+	go func() {
+		notifier.Notify(sub.ID, wrapper.Upgrades.State(host))
+		for {
+			select {
+			case change := <-incomingChannel:
+				notifier.Notify(sub.ID, change)
+			case <-sub.Err():
+				wrapper.Upgrades.Unwatch(incomingChannel)
+				return
+			}
+		}
+	}()
+
+	return sub, nil
+}
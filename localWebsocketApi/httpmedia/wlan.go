@@ -21,16 +21,15 @@ package httpmedia
 import (
 	"arylic-connect/rpcWrapper/httpControl"
 	"context"
-	"errors"
 )
 
 func (wrapper *HttpMediaWrapper) GetApList(ctx context.Context, target string) ([]httpControl.DetectedWLAN, error) {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.HttpMediaCons[target]
-	if !hasConnection {
-		return nil, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return nil, connErr
 	}
 
 	return connection.GetApList(ctx)
@@ -40,9 +39,9 @@ func (wrapper *HttpMediaWrapper) GetWlanState(ctx context.Context, target string
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.HttpMediaCons[target]
-	if !hasConnection {
-		return httpControl.WLAN_FAIL, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return httpControl.WLAN_FAIL, connErr
 	}
 
 	return connection.GetWlanState(ctx)
@@ -52,9 +51,9 @@ func (wrapper *HttpMediaWrapper) ConnectToWifi(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.HttpMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.ConnectToWifi(ctx, ssid, channel, auth, encryption, password)
@@ -64,9 +63,9 @@ func (wrapper *HttpMediaWrapper) ConnectToHiddenWifi(ctx context.Context, target
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.HttpMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.ConnectToHiddenWifi(ctx, ssid, password)
@@ -0,0 +1,321 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package metrics exports transport and device measurements for Prometheus.
+package metrics
+
+import (
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/localWebsocketApi/endpoints"
+	"arylic-connect/localWebsocketApi/extWebsocket"
+	"arylic-connect/localWebsocketApi/httpmedia"
+	"arylic-connect/localWebsocketApi/serialmedia"
+	"arylic-connect/localWebsocketApi/upgrades"
+	"arylic-connect/transport"
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deviceInterval is how often device gauges are refreshed. Reading them on
+// scrape would make scrapes as slow as the slowest device.
+const deviceInterval = 15 * time.Second
+
+func flavorName(flavor transport.InterfaceFlavor) string {
+	switch flavor {
+	case transport.Flavor_TCP:
+		return string(devices.Transport_Serial)
+	case transport.Flavor_HTTP:
+		return string(devices.Transport_Http)
+	case transport.Flavor_WS:
+		return string(devices.Transport_Websocket)
+	}
+	return "unknown"
+}
+
+// Metrics implements transport.Observer and keeps the device gauges.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	devices              *devices.Registry
+	serialConnections    *serialmedia.SerialMediaWrapper
+	httpConnections      *httpmedia.HttpMediaWrapper
+	websocketConnections *extWebsocket.ExternalWebsocketWrapper
+
+	commands      *prometheus.CounterVec
+	timeouts      *prometheus.CounterVec
+	parseFailures *prometheus.CounterVec
+	reconnects    *prometheus.CounterVec
+	queueWait     *prometheus.HistogramVec
+	roundTrip     *prometheus.HistogramVec
+
+	deviceGauges *deviceCollector
+}
+
+// reading is one device's gauges as of the last refresh. Nil values weren't
+// available from any transport.
+type reading struct {
+	labels    []string
+	volume    *float32
+	mute      *bool
+	playing   *bool
+	connected map[string]float64
+	rssi      *float32
+	battery   *float32
+}
+
+// deviceCollector reports the device gauges from the last refresh. Each
+// refresh replaces the whole set at once, so devices that have gone away stop
+// being reported without scrapes ever seeing the set half filled.
+type deviceCollector struct {
+	volume       *prometheus.Desc
+	mute         *prometheus.Desc
+	playing      *prometheus.Desc
+	connected    *prometheus.Desc
+	rssi         *prometheus.Desc
+	batteryLevel *prometheus.Desc
+
+	lock     sync.RWMutex
+	readings []reading
+}
+
+func newDeviceCollector(deviceLabels []string) *deviceCollector {
+	return &deviceCollector{
+		volume:       prometheus.NewDesc("arylic_device_volume_ratio", "Device volume, from 0 to 1.", deviceLabels, nil),
+		mute:         prometheus.NewDesc("arylic_device_muted", "1 if the device is muted.", deviceLabels, nil),
+		playing:      prometheus.NewDesc("arylic_device_playing", "1 if the device is playing.", deviceLabels, nil),
+		connected:    prometheus.NewDesc("arylic_device_connected", "1 if the transport to the device is connected and responding.", append(deviceLabels, "transport"), nil),
+		rssi:         prometheus.NewDesc("arylic_device_wifi_rssi_dbm", "Wi-Fi signal strength reported by the device.", deviceLabels, nil),
+		batteryLevel: prometheus.NewDesc("arylic_device_battery_ratio", "Battery level from 0 to 1, for devices with a battery.", deviceLabels, nil),
+	}
+}
+
+func (collector *deviceCollector) Describe(descriptions chan<- *prometheus.Desc) {
+	descriptions <- collector.volume
+	descriptions <- collector.mute
+	descriptions <- collector.playing
+	descriptions <- collector.connected
+	descriptions <- collector.rssi
+	descriptions <- collector.batteryLevel
+}
+
+func (collector *deviceCollector) Collect(metrics chan<- prometheus.Metric) {
+	collector.lock.RLock()
+	defer collector.lock.RUnlock()
+	gauge := func(description *prometheus.Desc, value float64, labels ...string) {
+		metrics <- prometheus.MustNewConstMetric(description, prometheus.GaugeValue, value, labels...)
+	}
+	for _, current := range collector.readings {
+		if current.volume != nil {
+			gauge(collector.volume, float64(*current.volume), current.labels...)
+		}
+		if current.mute != nil {
+			gauge(collector.mute, boolGauge(*current.mute), current.labels...)
+		}
+		if current.playing != nil {
+			gauge(collector.playing, boolGauge(*current.playing), current.labels...)
+		}
+		for transportName, state := range current.connected {
+			gauge(collector.connected, state, append(append([]string{}, current.labels...), transportName)...)
+		}
+		if current.rssi != nil {
+			gauge(collector.rssi, float64(*current.rssi), current.labels...)
+		}
+		if current.battery != nil {
+			gauge(collector.batteryLevel, float64(*current.battery), current.labels...)
+		}
+	}
+}
+
+func (collector *deviceCollector) set(readings []reading) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	collector.readings = readings
+}
+
+func New(registry *devices.Registry, serial *serialmedia.SerialMediaWrapper, http *httpmedia.HttpMediaWrapper, websocket *extWebsocket.ExternalWebsocketWrapper) *Metrics {
+	transportLabels := []string{"transport", "host"}
+	deviceLabels := []string{"device", "name"}
+	latencyBuckets := []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	metrics := &Metrics{
+		registry:             prometheus.NewRegistry(),
+		devices:              registry,
+		serialConnections:    serial,
+		httpConnections:      http,
+		websocketConnections: websocket,
+
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "arylic_transport_commands_sent_total",
+			Help: "Messages put on the wire to a device.",
+		}, transportLabels),
+		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "arylic_transport_timeouts_total",
+			Help: "Requests that gave up waiting on the connection or for a reply.",
+		}, transportLabels),
+		parseFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "arylic_transport_parse_failures_total",
+			Help: "Replies from a device that couldn't be understood.",
+		}, transportLabels),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "arylic_transport_reconnects_total",
+			Help: "Connections to a device that had been connected before.",
+		}, transportLabels),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "arylic_transport_queue_wait_seconds",
+			Help:    "Time messages wait for the connection to take them.",
+			Buckets: latencyBuckets,
+		}, transportLabels),
+		roundTrip: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "arylic_transport_round_trip_seconds",
+			Help:    "Time from sending a request to receiving its reply.",
+			Buckets: latencyBuckets,
+		}, transportLabels),
+
+		deviceGauges: newDeviceCollector(deviceLabels),
+	}
+
+	metrics.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.commands, metrics.timeouts, metrics.parseFailures, metrics.reconnects,
+		metrics.queueWait, metrics.roundTrip,
+		metrics.deviceGauges,
+	)
+	return metrics
+}
+
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+func (metrics *Metrics) CommandSent(flavor transport.InterfaceFlavor, target string) {
+	metrics.commands.WithLabelValues(flavorName(flavor), upgrades.HostOf(target)).Inc()
+}
+
+func (metrics *Metrics) QueueWait(flavor transport.InterfaceFlavor, target string, wait time.Duration) {
+	metrics.queueWait.WithLabelValues(flavorName(flavor), upgrades.HostOf(target)).Observe(wait.Seconds())
+}
+
+func (metrics *Metrics) RoundTrip(flavor transport.InterfaceFlavor, target string, elapsed time.Duration) {
+	metrics.roundTrip.WithLabelValues(flavorName(flavor), upgrades.HostOf(target)).Observe(elapsed.Seconds())
+}
+
+func (metrics *Metrics) Timeout(flavor transport.InterfaceFlavor, target string) {
+	metrics.timeouts.WithLabelValues(flavorName(flavor), upgrades.HostOf(target)).Inc()
+}
+
+func (metrics *Metrics) ParseFailure(flavor transport.InterfaceFlavor, target string) {
+	metrics.parseFailures.WithLabelValues(flavorName(flavor), upgrades.HostOf(target)).Inc()
+}
+
+func (metrics *Metrics) Reconnect(flavor transport.InterfaceFlavor, target string) {
+	metrics.reconnects.WithLabelValues(flavorName(flavor), upgrades.HostOf(target)).Inc()
+}
+
+func boolGauge(state bool) float64 {
+	if state {
+		return 1
+	}
+	return 0
+}
+
+// connectedState reports whether a wrapper's endpoint is up and responding.
+func connectedState(registry *endpoints.Registry, key string) float64 {
+	if key == "" {
+		return 0
+	}
+	endpoint, known := registry.Get(key)
+	return boolGauge(known && endpoint.State == endpoints.State_Connected)
+}
+
+// refreshDevices re-reads the device gauges. Devices are read at the same
+// time, so one slow device doesn't use up the others' time, and the reads
+// aren't counted in the transport metrics they'd otherwise skew.
+func (metrics *Metrics) refreshDevices(ctx context.Context) {
+	ctx, ctxCancel := context.WithTimeout(transport.Unobserved(ctx), deviceInterval)
+	defer ctxCancel()
+
+	list := metrics.devices.ListDevices(ctx)
+	readings := make([]reading, len(list))
+	var wait sync.WaitGroup
+	for index, info := range list {
+		current := &readings[index]
+		current.labels = []string{info.ID, info.Name}
+		current.connected = map[string]float64{
+			string(devices.Transport_Serial):    connectedState(metrics.serialConnections.Endpoints, info.SerialName),
+			string(devices.Transport_Http):      connectedState(metrics.httpConnections.Endpoints, info.HttpName),
+			string(devices.Transport_Websocket): connectedState(metrics.websocketConnections.Endpoints, info.WebsocketName),
+		}
+
+		ref := info.ID
+		wait.Add(4)
+		go func() {
+			defer wait.Done()
+			volume, volumeErr := metrics.devices.GetVolume(ctx, ref)
+			if volumeErr == nil {
+				current.volume = &volume.Volume
+			}
+		}()
+		go func() {
+			defer wait.Done()
+			mute, muteErr := metrics.devices.GetMute(ctx, ref)
+			if muteErr == nil {
+				current.mute = &mute.Mute
+			}
+		}()
+		go func() {
+			defer wait.Done()
+			player, playerErr := metrics.devices.GetPlayerStatus(ctx, ref)
+			if playerErr == nil {
+				current.playing = &player.Status.Playing
+			}
+		}()
+		go func() {
+			defer wait.Done()
+			status, statusErr := metrics.devices.GetStatus(ctx, ref)
+			if statusErr == nil {
+				current.rssi = &status.Status.Wifi.RSSI
+				if status.Status.Battery.Present {
+					current.battery = &status.Status.Battery.Level
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	metrics.deviceGauges.set(readings)
+}
+
+// Run keeps the device gauges up to date until ctx is cancelled.
+func (metrics *Metrics) Run(ctx context.Context) error {
+	ticker := time.NewTicker(deviceInterval)
+	defer ticker.Stop()
+	metrics.refreshDevices(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			metrics.refreshDevices(ctx)
+		}
+	}
+}
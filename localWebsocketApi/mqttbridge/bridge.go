@@ -0,0 +1,244 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mqttbridge publishes device state to an MQTT broker, takes commands
+// back from it, and announces devices to Home Assistant through its MQTT
+// discovery protocol.
+//
+// Topics, under the configured prefix:
+//
+//	<prefix>/bridge/status            online or offline, the bridge's will
+//	<prefix>/<device>/availability    online or offline
+//	<prefix>/<device>/state           the whole state as JSON
+//	<prefix>/<device>/<field>         volume, mute, source, playback, title, artist, album
+//	<prefix>/<device>/<field>/set     volume (0 - 1), mute (ON/OFF), source,
+//	                                  playback (PLAY, PAUSE, TOGGLE, STOP, NEXT, PREVIOUS)
+//
+// <device> is the device ID, which the registry keeps on the hardware's UUID
+// or MAC across restarts. A device only known by its address until then is
+// moved to its new ID once it identifies itself, and everything published
+// under the old ID is cleared.
+//
+// All state topics are retained.
+package mqttbridge
+
+import (
+	"arylic-connect/localWebsocketApi/config"
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/localWebsocketApi/extWebsocket"
+	"arylic-connect/localWebsocketApi/httpmedia"
+	"arylic-connect/localWebsocketApi/serialmedia"
+	"context"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// syncInterval is how often the device list is checked for devices coming
+// and going.
+const syncInterval = 10 * time.Second
+
+var topicUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// topicID turns a device ID into something safe to use as a topic level and
+// as part of a Home Assistant unique ID.
+func topicID(id string) string {
+	return topicUnsafe.ReplaceAllString(id, "_")
+}
+
+type Bridge struct {
+	config               config.MQTT
+	devices              *devices.Registry
+	serialConnections    *serialmedia.SerialMediaWrapper
+	httpConnections      *httpmedia.HttpMediaWrapper
+	websocketConnections *extWebsocket.ExternalWebsocketWrapper
+
+	client mqtt.Client
+
+	lock    sync.Mutex
+	workers map[string]*worker // by topic ID
+}
+
+func New(mqttConfig config.MQTT, registry *devices.Registry, serial *serialmedia.SerialMediaWrapper, http *httpmedia.HttpMediaWrapper, websocket *extWebsocket.ExternalWebsocketWrapper) *Bridge {
+	return &Bridge{
+		config:               mqttConfig,
+		devices:              registry,
+		serialConnections:    serial,
+		httpConnections:      http,
+		websocketConnections: websocket,
+		workers:              make(map[string]*worker),
+	}
+}
+
+func (bridge *Bridge) statusTopic() string {
+	return bridge.config.TopicPrefix + "/bridge/status"
+}
+
+// publish sends a retained message, logging rather than returning failures as
+// the next state change will publish again anyway.
+func (bridge *Bridge) publish(topic string, payload interface{}) {
+	token := bridge.client.Publish(topic, 1, true, payload)
+	go func() {
+		if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+			log.Printf("Error publishing to %s: %s\n", topic, token.Error())
+		}
+	}()
+}
+
+// onConnect runs on every (re)connection to the broker, as the broker may
+// have lost the subscriptions and any non-persistent retained messages.
+func (bridge *Bridge) onConnect(client mqtt.Client) {
+	log.Printf("Connected to MQTT broker %s\n", bridge.config.Broker)
+	bridge.publish(bridge.statusTopic(), "online")
+
+	commandTopic := bridge.config.TopicPrefix + "/+/+/set"
+	token := client.Subscribe(commandTopic, 1, bridge.onCommand)
+	go func() {
+		if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+			log.Printf("Error subscribing to %s: %s\n", commandTopic, token.Error())
+		}
+	}()
+
+	bridge.lock.Lock()
+	defer bridge.lock.Unlock()
+	for _, current := range bridge.workers {
+		current.republish()
+	}
+}
+
+// Run connects to the broker and keeps the published devices in step with the
+// registry until ctx is cancelled, when it marks the bridge offline and
+// disconnects. It returns early if the first connection can't be set up.
+func (bridge *Bridge) Run(ctx context.Context) error {
+	connectErr := bridge.connect()
+	if connectErr != nil {
+		return connectErr
+	}
+
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	bridge.sync(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			bridge.close()
+			return nil
+		case <-ticker.C:
+			bridge.sync(ctx)
+		}
+	}
+}
+
+// connect sets up the client, which keeps reconnecting by itself.
+func (bridge *Bridge) connect() error {
+	options := mqtt.NewClientOptions().
+		AddBroker(bridge.config.Broker).
+		SetClientID(bridge.config.ClientID).
+		SetUsername(bridge.config.Username).
+		SetPassword(bridge.config.Password).
+		SetWill(bridge.statusTopic(), "offline", 1, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOnConnectHandler(bridge.onConnect).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Printf("Lost connection to MQTT broker: %s\n", err)
+		})
+	bridge.client = mqtt.NewClient(options)
+	token := bridge.client.Connect()
+	// With ConnectRetry the token only completes once connected, keep going
+	// meanwhile; publishes queue up until then.
+	if token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+// close stops the workers and leaves the broker cleanly. A clean disconnect
+// doesn't fire the will, so the offline status is published by hand.
+func (bridge *Bridge) close() {
+	bridge.lock.Lock()
+	for id, existing := range bridge.workers {
+		existing.stop()
+		delete(bridge.workers, id)
+	}
+	bridge.lock.Unlock()
+
+	bridge.client.Publish(bridge.statusTopic(), 1, true, "offline").WaitTimeout(2 * time.Second)
+	bridge.client.Disconnect(250)
+}
+
+// sync starts a worker for every new device and retires those that are gone.
+func (bridge *Bridge) sync(ctx context.Context) {
+	ctx, ctxCancel := context.WithTimeout(ctx, syncInterval)
+	defer ctxCancel()
+	bridge.apply(bridge.devices.ListDevices(ctx))
+}
+
+// sameDevice reports whether two records are the same hardware, going by
+// whichever of the UUID, MAC or address both have.
+func sameDevice(a devices.DeviceInfo, b devices.DeviceInfo) bool {
+	switch {
+	case a.UUID != "" && b.UUID != "":
+		return a.UUID == b.UUID
+	case a.MAC != "" && b.MAC != "":
+		return a.MAC == b.MAC
+	}
+	return a.Host != "" && a.Host == b.Host
+}
+
+// apply brings the workers in line with the current device list.
+func (bridge *Bridge) apply(current []devices.DeviceInfo) {
+	bridge.lock.Lock()
+	defer bridge.lock.Unlock()
+
+	seen := make(map[string]bool)
+	for _, info := range current {
+		id := topicID(info.ID)
+		seen[id] = true
+		existing, hasWorker := bridge.workers[id]
+		if hasWorker && existing.sameConnections(info) {
+			continue
+		}
+		if hasWorker {
+			existing.stop()
+		}
+		// A device that now has a different ID leaves its old topics and
+		// entities behind otherwise
+		for oldID, old := range bridge.workers {
+			if oldID != id && sameDevice(old.info, info) {
+				old.stop()
+				old.wait()
+				old.clear()
+				delete(bridge.workers, oldID)
+			}
+		}
+		started := newWorker(bridge, id, info)
+		bridge.workers[id] = started
+		go started.run()
+	}
+
+	for id, existing := range bridge.workers {
+		if !seen[id] {
+			existing.stop()
+			bridge.publish(existing.topic+"/availability", "offline")
+			delete(bridge.workers, id)
+		}
+	}
+}
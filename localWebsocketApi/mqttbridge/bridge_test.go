@@ -0,0 +1,307 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mqttbridge
+
+import (
+	"arylic-connect/localWebsocketApi/config"
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/localWebsocketApi/extWebsocket"
+	"arylic-connect/localWebsocketApi/httpmedia"
+	"arylic-connect/localWebsocketApi/serialmedia"
+	"arylic-connect/localWebsocketApi/upgrades"
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker is just enough of an MQTT 3.1.1 broker to keep the retained
+// messages a client publishes.
+type testBroker struct {
+	listener net.Listener
+
+	lock     sync.Mutex
+	retained map[string]string
+}
+
+func startBroker(t *testing.T) *testBroker {
+	listener, listenErr := net.Listen("tcp", "127.0.0.1:0")
+	if listenErr != nil {
+		t.Fatal(listenErr)
+	}
+	broker := &testBroker{listener: listener, retained: make(map[string]string)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (broker *testBroker) url() string {
+	return "tcp://" + broker.listener.Addr().String()
+}
+
+func (broker *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		header, headerErr := reader.ReadByte()
+		if headerErr != nil {
+			return
+		}
+		length, lengthErr := binary.ReadUvarint(reader)
+		if lengthErr != nil {
+			return
+		}
+		body := make([]byte, length)
+		_, readErr := io.ReadFull(reader, body)
+		if readErr != nil {
+			return
+		}
+
+		switch header >> 4 {
+		case 1: // CONNECT
+			conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		case 3: // PUBLISH
+			topicLength := int(binary.BigEndian.Uint16(body))
+			topic := string(body[2 : 2+topicLength])
+			rest := body[2+topicLength:]
+			qos := (header >> 1) & 0x03
+			if qos > 0 {
+				conn.Write([]byte{0x40, 0x02, rest[0], rest[1]})
+				rest = rest[2:]
+			}
+			if header&0x01 != 0 {
+				broker.lock.Lock()
+				if len(rest) == 0 {
+					delete(broker.retained, topic)
+				} else {
+					broker.retained[topic] = string(rest)
+				}
+				broker.lock.Unlock()
+			}
+		case 8: // SUBSCRIBE
+			granted := make([]byte, 0)
+			for index := 2; index < len(body); {
+				filterLength := int(binary.BigEndian.Uint16(body[index:]))
+				index += 2 + filterLength + 1
+				granted = append(granted, 0x01)
+			}
+			conn.Write(append([]byte{0x90, byte(2 + len(granted)), body[0], body[1]}, granted...))
+		case 12: // PINGREQ
+			conn.Write([]byte{0xD0, 0x00})
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// waitFor polls the retained messages until check passes or time runs out.
+func (broker *testBroker) waitFor(t *testing.T, what string, check func(retained map[string]string) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		broker.lock.Lock()
+		passed := check(broker.retained)
+		broker.lock.Unlock()
+		if passed {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// testDevice answers the HTTP API calls a worker's player stream makes, and
+// reports each title it serves.
+type testDevice struct {
+	lock   sync.Mutex
+	title  string
+	polled chan string
+}
+
+func startDevice(t *testing.T, title string) (*testDevice, string) {
+	device := &testDevice{title: title, polled: make(chan string, 1)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("command") {
+		case "getStatusEx":
+			fmt.Fprint(w, `{"DeviceName":"Kitchen"}`)
+		case "getPlayerStatus":
+			device.lock.Lock()
+			title := device.title
+			device.lock.Unlock()
+			fmt.Fprintf(w, `{"status":"play","curpos":"1000","totlen":"200000","Title":"%s","vol":"30","mute":"0"}`, hex.EncodeToString([]byte(title)))
+			select {
+			case device.polled <- title:
+			default:
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return device, server.URL + "/httpapi.asp"
+}
+
+func (device *testDevice) setTitle(title string) {
+	device.lock.Lock()
+	defer device.lock.Unlock()
+	device.title = title
+}
+
+// waitPolled waits for the device to serve a title.
+func (device *testDevice) waitPolled(t *testing.T, title string) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case served := <-device.polled:
+			if served == title {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for %q to be polled", title)
+		}
+	}
+}
+
+func TestBridgeRetiresChangedIDs(t *testing.T) {
+	broker := startBroker(t)
+	device, deviceTarget := startDevice(t, "Old Song")
+	httpConnections := httpmedia.New()
+	httpName, httpErr := httpConnections.ConnectEndpoint(deviceTarget)
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	defer httpmedia.CloseAll(httpConnections)
+
+	registry, registryErr := devices.New(serialmedia.New(), httpmedia.New(), extWebsocket.New(), upgrades.New(), filepath.Join(t.TempDir(), "devices.yaml"))
+	if registryErr != nil {
+		t.Fatal(registryErr)
+	}
+	bridge := New(config.MQTT{
+		Broker:          broker.url(),
+		ClientID:        "bridge-test",
+		TopicPrefix:     "arylic",
+		Discovery:       true,
+		DiscoveryPrefix: "homeassistant",
+	}, registry, nil, httpConnections, nil)
+	connectErr := bridge.connect()
+	if connectErr != nil {
+		t.Fatal(connectErr)
+	}
+	defer bridge.close()
+
+	oldConfig := "homeassistant/number/arylic_192_168_1_20/volume/config"
+	newConfig := "homeassistant/number/arylic_FF31F09E/volume/config"
+
+	// Known only by its address at first
+	bridge.apply([]devices.DeviceInfo{{ID: "192.168.1.20", Host: "192.168.1.20", Name: "Kitchen", HttpName: httpName}})
+	broker.waitFor(t, "the address keyed device", func(retained map[string]string) bool {
+		return retained[oldConfig] != "" && retained["arylic/192_168_1_20/availability"] == "online" &&
+			retained["arylic/192_168_1_20/title"] == "Old Song"
+	})
+
+	// Hold the old worker up in the middle of publishing a track change, and
+	// change the ID while it's stuck there
+	bridge.lock.Lock()
+	old := bridge.workers["192_168_1_20"]
+	bridge.lock.Unlock()
+	old.lock.Lock()
+	device.setTitle("New Song")
+	device.waitPolled(t, "New Song")
+	time.Sleep(100 * time.Millisecond)
+
+	applied := make(chan struct{})
+	go func() {
+		bridge.apply([]devices.DeviceInfo{{ID: "FF31F09E", UUID: "FF31F09E", Host: "192.168.1.20", Name: "Kitchen", HttpName: httpName}})
+		close(applied)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	old.lock.Unlock()
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out changing the ID")
+	}
+	select {
+	case <-old.done:
+	default:
+		t.Error("old worker still running after its ID was retired")
+	}
+
+	broker.waitFor(t, "the old ID to be cleared", func(retained map[string]string) bool {
+		_, oldLeft := retained[oldConfig]
+		_, oldAvailable := retained["arylic/192_168_1_20/availability"]
+		return !oldLeft && !oldAvailable && retained[newConfig] != ""
+	})
+	broker.lock.Lock()
+	for topic := range broker.retained {
+		if filepath.Base(filepath.Dir(topic)) == "arylic_192_168_1_20" || filepath.Dir(topic) == "arylic/192_168_1_20" {
+			t.Errorf("%s still retained", topic)
+		}
+	}
+	broker.lock.Unlock()
+
+	bridge.lock.Lock()
+	_, oldWorker := bridge.workers["192_168_1_20"]
+	bridge.lock.Unlock()
+	if oldWorker {
+		t.Error("worker for the old ID still running")
+	}
+}
+
+func TestNormalizeSource(t *testing.T) {
+	cases := map[string]string{
+		"Network":   "Network",
+		"wifi":      "Network",
+		"Line-In":   "Line-In",
+		"line_in":   "Line-In",
+		"LINE-IN2":  "Line-In2",
+		"BT":        "Bluetooth",
+		"optical":   "Optical",
+		"co-axial":  "Coax",
+		"USBDAC":    "USBDAC",
+		"Unknown":   "",
+		"None":      "",
+		"something": "",
+	}
+	for input, expected := range cases {
+		if got := normalizeSource(input); got != expected {
+			t.Errorf("normalizeSource(%q) = %q, want %q", input, got, expected)
+		}
+	}
+	for _, option := range sourceOptions {
+		if got := normalizeSource(option); got != option {
+			t.Errorf("source option %q normalizes to %q", option, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mqttbridge
+
+import (
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/rpcWrapper/serialMediaControl"
+	"context"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandTimeout bounds how long a command from MQTT may take, failover
+// included.
+const commandTimeout = 20 * time.Second
+
+// onCommand handles a message on <prefix>/<device>/<field>/set.
+func (bridge *Bridge) onCommand(client mqtt.Client, message mqtt.Message) {
+	levels := strings.Split(strings.TrimPrefix(message.Topic(), bridge.config.TopicPrefix+"/"), "/")
+	if len(levels) != 3 {
+		return
+	}
+	id, field := levels[0], levels[1]
+
+	bridge.lock.Lock()
+	target, hasWorker := bridge.workers[id]
+	bridge.lock.Unlock()
+	if !hasWorker {
+		log.Printf("MQTT command for unknown device %s\n", id)
+		return
+	}
+
+	// Commands can take a while with failover, so don't hold up the
+	// client's message handling.
+	go func() {
+		ctx, ctxCancel := context.WithTimeout(context.Background(), commandTimeout)
+		defer ctxCancel()
+		commandErr := bridge.command(ctx, target.info.ID, field, strings.TrimSpace(string(message.Payload())))
+		if commandErr != nil {
+			log.Printf("MQTT command %s for %s failed: %s\n", field, target.info.Name, commandErr)
+		}
+		target.requestPoll()
+	}()
+}
+
+func parseSwitch(payload string) (bool, error) {
+	switch strings.ToUpper(payload) {
+	case "ON", "TRUE", "1":
+		return true, nil
+	case "OFF", "FALSE", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("not an on/off value: %q", payload)
+}
+
+func (bridge *Bridge) command(ctx context.Context, ref string, field string, payload string) error {
+	switch field {
+	case "volume":
+		level, parseErr := strconv.ParseFloat(payload, 32)
+		if parseErr != nil || level < 0 || level > 1 {
+			return errors.New("volume must be between 0 and 1")
+		}
+		_, err := bridge.devices.SetVolume(ctx, ref, float32(level))
+		return err
+	case "mute":
+		state, parseErr := parseSwitch(payload)
+		if parseErr != nil {
+			return parseErr
+		}
+		_, err := bridge.devices.SetMute(ctx, ref, state)
+		return err
+	case "source":
+		var source serialMediaControl.InputSource
+		source.UnmarshalText([]byte(payload))
+		if source == serialMediaControl.Input_Unknown {
+			return fmt.Errorf("unknown source %q", payload)
+		}
+		_, err := bridge.devices.SetSource(ctx, ref, source)
+		return err
+	case "playback":
+		var run func(ctx context.Context, ref string) (devices.Served, error)
+		switch strings.ToUpper(payload) {
+		case "PLAY":
+			run = bridge.devices.RequestPlay
+		case "PAUSE":
+			run = bridge.devices.RequestPause
+		case "TOGGLE":
+			run = bridge.devices.RequestPlayPause
+		case "STOP":
+			run = bridge.devices.RequestStop
+		case "NEXT":
+			run = bridge.devices.RequestNext
+		case "PREVIOUS":
+			run = bridge.devices.RequestPrevious
+		default:
+			return fmt.Errorf("unknown playback command %q", payload)
+		}
+		_, err := run(ctx, ref)
+		return err
+	}
+	return fmt.Errorf("unknown field %q", field)
+}
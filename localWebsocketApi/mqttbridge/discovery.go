@@ -0,0 +1,158 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mqttbridge
+
+import (
+	"arylic-connect/localWebsocketApi/devices"
+	"encoding/json"
+	"fmt"
+)
+
+// sourceOptions are the inputs offered in Home Assistant, named as the source
+// topic takes them.
+var sourceOptions = []string{"Network", "USB", "USBDAC", "Line-In", "Line-In2", "Bluetooth", "Optical", "Coax", "I2S", "HDMI"}
+
+type entity struct {
+	component string
+	key       string
+	config    map[string]interface{}
+}
+
+// discoveryTopic is where Home Assistant looks for an entity's config.
+func (bridge *Bridge) discoveryTopic(component string, id string, key string) string {
+	return fmt.Sprintf("%s/%s/arylic_%s/%s/config", bridge.config.DiscoveryPrefix, component, id, key)
+}
+
+// entities lists what a device is made of in Home Assistant. There's no MQTT
+// media_player platform, so the device is made of several entities that Home
+// Assistant groups under one device.
+func (bridge *Bridge) entities(id string, info devices.DeviceInfo) []entity {
+	topic := bridge.config.TopicPrefix + "/" + id
+
+	button := func(key string, name string, payload string, icon string) entity {
+		return entity{"button", key, map[string]interface{}{
+			"name":          name,
+			"command_topic": topic + "/playback/set",
+			"payload_press": payload,
+			"icon":          icon,
+		}}
+	}
+	sensor := func(key string, name string, icon string) entity {
+		return entity{"sensor", key, map[string]interface{}{
+			"name":        name,
+			"state_topic": topic + "/" + key,
+			"icon":        icon,
+		}}
+	}
+
+	entities := []entity{
+		{"number", "volume", map[string]interface{}{
+			"name":                "Volume",
+			"state_topic":         topic + "/volume",
+			"command_topic":       topic + "/volume/set",
+			"value_template":      "{{ (value | float * 100) | round(0) }}",
+			"command_template":    "{{ value / 100 }}",
+			"min":                 0,
+			"max":                 100,
+			"step":                1,
+			"unit_of_measurement": "%",
+			"icon":                "mdi:volume-high",
+		}},
+		{"switch", "mute", map[string]interface{}{
+			"name":          "Mute",
+			"state_topic":   topic + "/mute",
+			"command_topic": topic + "/mute/set",
+			"payload_on":    "ON",
+			"payload_off":   "OFF",
+			"icon":          "mdi:volume-off",
+		}},
+		sensor("playback", "Playback", "mdi:play-pause"),
+		sensor("title", "Title", "mdi:music"),
+		sensor("artist", "Artist", "mdi:account-music"),
+		sensor("album", "Album", "mdi:album"),
+		button("play", "Play", "PLAY", "mdi:play"),
+		button("pause", "Pause", "PAUSE", "mdi:pause"),
+		button("stop", "Stop", "STOP", "mdi:stop"),
+		button("next", "Next", "NEXT", "mdi:skip-next"),
+		button("previous", "Previous", "PREVIOUS", "mdi:skip-previous"),
+	}
+	if info.SerialName != "" {
+		// Only the serial API can switch inputs
+		entities = append(entities, entity{"select", "source", map[string]interface{}{
+			"name":          "Source",
+			"state_topic":   topic + "/source",
+			"command_topic": topic + "/source/set",
+			"options":       sourceOptions,
+			"icon":          "mdi:import",
+		}})
+	} else {
+		entities = append(entities, sensor("source", "Source", "mdi:import"))
+	}
+	return entities
+}
+
+// publishDiscovery announces a device to Home Assistant.
+func (bridge *Bridge) publishDiscovery(id string, info devices.DeviceInfo) {
+	device := map[string]interface{}{
+		"identifiers":  []string{"arylic_" + id},
+		"name":         info.Name,
+		"manufacturer": "Arylic",
+	}
+	if info.Model != "" {
+		device["model"] = info.Model
+	}
+	if info.MAC != "" {
+		device["connections"] = [][]string{{"mac", info.MAC}}
+	}
+	availability := []map[string]string{
+		{"topic": bridge.statusTopic()},
+		{"topic": bridge.config.TopicPrefix + "/" + id + "/availability"},
+	}
+
+	for _, current := range bridge.entities(id, info) {
+		current.config["unique_id"] = fmt.Sprintf("arylic_%s_%s", id, current.key)
+		current.config["object_id"] = fmt.Sprintf("%s_%s", info.Name, current.key)
+		current.config["device"] = device
+		current.config["availability"] = availability
+		current.config["availability_mode"] = "all"
+
+		encoded, _ := json.Marshal(current.config)
+		bridge.publish(bridge.discoveryTopic(current.component, id, current.key), encoded)
+	}
+	// The source is a select or a sensor depending on the serial connection,
+	// so drop whichever it was before
+	if info.SerialName != "" {
+		bridge.publish(bridge.discoveryTopic("sensor", id, "source"), "")
+	} else {
+		bridge.publish(bridge.discoveryTopic("select", id, "source"), "")
+	}
+}
+
+// clearDiscovery removes a device's entities from Home Assistant. An empty
+// retained config deletes an entity.
+func (bridge *Bridge) clearDiscovery(id string, info devices.DeviceInfo) {
+	for _, current := range bridge.entities(id, info) {
+		bridge.publish(bridge.discoveryTopic(current.component, id, current.key), "")
+	}
+	if info.SerialName != "" {
+		bridge.publish(bridge.discoveryTopic("sensor", id, "source"), "")
+	} else {
+		bridge.publish(bridge.discoveryTopic("select", id, "source"), "")
+	}
+}
@@ -0,0 +1,368 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mqttbridge
+
+import (
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/localWebsocketApi/httpmedia"
+	"arylic-connect/rpcWrapper/httpControl"
+	"arylic-connect/rpcWrapper/serialMediaControl"
+	"arylic-connect/rpcWrapper/websocketControl"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often state is re-read in full, to catch anything the
+// push streams missed.
+const pollInterval = 30 * time.Second
+
+// State is what's published for a device.
+type State struct {
+	Volume   float32 `json:"volume"` // 0 - 1
+	Mute     bool    `json:"mute"`
+	Source   string  `json:"source"`
+	Playback string  `json:"playback"` // playing, paused, stopped or loading
+	Title    string  `json:"title"`
+	Artist   string  `json:"artist"`
+	Album    string  `json:"album"`
+}
+
+// fields is the state as the payloads of its individual topics.
+func (state State) fields() map[string]string {
+	mute := "OFF"
+	if state.Mute {
+		mute = "ON"
+	}
+	return map[string]string{
+		"volume":   strconv.FormatFloat(float64(state.Volume), 'f', 2, 32),
+		"mute":     mute,
+		"source":   state.Source,
+		"playback": state.Playback,
+		"title":    state.Title,
+		"artist":   state.Artist,
+		"album":    state.Album,
+	}
+}
+
+// sourceAliases maps the ways the transports name inputs, lower cased and
+// without separators, onto the names the source topic takes.
+var sourceAliases = map[string]string{
+	"network":   "Network",
+	"net":       "Network",
+	"wifi":      "Network",
+	"usb":       "USB",
+	"udisk":     "USB",
+	"usbdac":    "USBDAC",
+	"pcusb":     "USBDAC",
+	"linein":    "Line-In",
+	"linein1":   "Line-In",
+	"aux":       "Line-In",
+	"linein2":   "Line-In2",
+	"bluetooth": "Bluetooth",
+	"bt":        "Bluetooth",
+	"optical":   "Optical",
+	"opt":       "Optical",
+	"coax":      "Coax",
+	"coaxial":   "Coax",
+	"i2s":       "I2S",
+	"hdmi":      "HDMI",
+}
+
+var sourceSeparators = strings.NewReplacer("-", "", "_", "", " ", "")
+
+// normalizeSource turns a source name from any transport into one the source
+// topic takes, or empty when it isn't one of those.
+func normalizeSource(name string) string {
+	return sourceAliases[sourceSeparators.Replace(strings.ToLower(name))]
+}
+
+func playbackName(deviceState string) string {
+	switch deviceState {
+	case "play":
+		return "playing"
+	case "pause":
+		return "paused"
+	case "stop":
+		return "stopped"
+	case "load":
+		return "loading"
+	}
+	return deviceState
+}
+
+// worker follows one device, publishing its state as it changes.
+type worker struct {
+	bridge *Bridge
+	id     string
+	topic  string
+	info   devices.DeviceInfo
+
+	ctx     context.Context
+	cancel  func()
+	done    chan struct{} // closed when run returns
+	pollNow chan struct{}
+
+	lock      sync.Mutex
+	state     State
+	published map[string]string
+}
+
+func newWorker(bridge *Bridge, id string, info devices.DeviceInfo) *worker {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	return &worker{
+		bridge:    bridge,
+		id:        id,
+		topic:     bridge.config.TopicPrefix + "/" + id,
+		info:      info,
+		ctx:       ctx,
+		cancel:    ctxCancel,
+		done:      make(chan struct{}),
+		pollNow:   make(chan struct{}, 1),
+		published: make(map[string]string),
+	}
+}
+
+// sameConnections reports whether a device still has the connections the
+// worker is following. A reconnect means new streams to subscribe to.
+func (w *worker) sameConnections(info devices.DeviceInfo) bool {
+	return w.info.SerialName == info.SerialName &&
+		w.info.HttpName == info.HttpName &&
+		w.info.WebsocketName == info.WebsocketName
+}
+
+func (w *worker) stop() {
+	w.cancel()
+}
+
+// wait blocks until a stopped worker's run has returned, so nothing it had in
+// flight can publish after it.
+func (w *worker) wait() {
+	<-w.done
+}
+
+// requestPoll asks for a full re-read, such as after a command.
+func (w *worker) requestPoll() {
+	select {
+	case w.pollNow <- struct{}{}:
+	default:
+	}
+}
+
+// update applies a change to the state and publishes whatever it altered.
+func (w *worker) update(change func(state *State)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	change(&w.state)
+	changed := false
+	for field, payload := range w.state.fields() {
+		if w.published[field] == payload {
+			continue
+		}
+		w.published[field] = payload
+		w.bridge.publish(w.topic+"/"+field, payload)
+		changed = true
+	}
+	if changed {
+		encoded, _ := json.Marshal(w.state)
+		w.bridge.publish(w.topic+"/state", encoded)
+	}
+}
+
+// clear removes everything published for the device, for when it has moved
+// to a new ID. An empty retained message deletes the one before it. The worker
+// must have been stopped and waited for.
+func (w *worker) clear() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.bridge.config.Discovery {
+		w.bridge.clearDiscovery(w.id, w.info)
+	}
+	for field := range w.published {
+		w.bridge.publish(w.topic+"/"+field, "")
+	}
+	w.published = make(map[string]string)
+	w.bridge.publish(w.topic+"/state", "")
+	w.bridge.publish(w.topic+"/availability", "")
+}
+
+// republish sends everything again, for a broker that may have lost it.
+func (w *worker) republish() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.bridge.publish(w.topic+"/availability", "online")
+	if w.bridge.config.Discovery {
+		w.bridge.publishDiscovery(w.id, w.info)
+	}
+	for field, payload := range w.published {
+		w.bridge.publish(w.topic+"/"+field, payload)
+	}
+	encoded, _ := json.Marshal(w.state)
+	w.bridge.publish(w.topic+"/state", encoded)
+}
+
+// poll reads everything the device can tell us through the registry, skipping
+// whatever it has no transport for.
+func (w *worker) poll() {
+	ctx, ctxCancel := context.WithTimeout(w.ctx, pollInterval/2)
+	defer ctxCancel()
+	ref := w.info.ID
+
+	volume, volumeErr := w.bridge.devices.GetVolume(ctx, ref)
+	if volumeErr == nil {
+		w.update(func(state *State) { state.Volume = volume.Volume })
+	}
+	mute, muteErr := w.bridge.devices.GetMute(ctx, ref)
+	if muteErr == nil {
+		w.update(func(state *State) { state.Mute = mute.Mute })
+	}
+	source, sourceErr := w.bridge.devices.GetSource(ctx, ref)
+	if sourceErr == nil {
+		name, _ := source.Source.MarshalText()
+		w.update(func(state *State) { state.Source = normalizeSource(string(name)) })
+	}
+	player, playerErr := w.bridge.devices.GetPlayerStatus(ctx, ref)
+	if playerErr == nil {
+		w.update(func(state *State) {
+			state.Playback = playbackName(player.Status.State)
+			state.Title = player.Status.Title
+			state.Artist = player.Status.Artist
+			state.Album = player.Status.Album
+		})
+	}
+}
+
+func (w *worker) run() {
+	defer close(w.done)
+	w.republish()
+	w.poll()
+
+	var serialMetadata <-chan serialMediaControl.MetadataChangeMessage
+	var serialVolume <-chan float32
+	var serialMute <-chan bool
+	var serialPlay <-chan bool
+	var websocketStatus <-chan websocketControl.StatusChangeMessage
+	var httpPlayer <-chan httpControl.PlayerStatus
+
+	if w.info.SerialName != "" {
+		w.bridge.serialConnections.OpLock.RLock()
+		connection, hasConnection := w.bridge.serialConnections.SerialMediaCons[w.info.SerialName]
+		w.bridge.serialConnections.OpLock.RUnlock()
+		if hasConnection {
+			serialMetadata = connection.MetadataChangeChannel(w.ctx)
+			serialVolume = connection.VolumeChannel(w.ctx)
+			serialMute = connection.MuteChannel(w.ctx)
+			serialPlay = connection.PlayChannel(w.ctx)
+		}
+	}
+	if w.info.WebsocketName != "" {
+		w.bridge.websocketConnections.OpLock.RLock()
+		connection, hasConnection := w.bridge.websocketConnections.HttpMediaCons[w.info.WebsocketName]
+		w.bridge.websocketConnections.OpLock.RUnlock()
+		if hasConnection {
+			websocketStatus = connection.StatusChangeChannel(w.ctx)
+		}
+	}
+	if w.info.HttpName != "" && websocketStatus == nil {
+		// The websocket pushes the same things without polling
+		httpPlayer, _ = httpmedia.PlayerStatusChannel(w.ctx, w.bridge.httpConnections, w.info.HttpName)
+	}
+	hasSerial := serialMetadata != nil
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-ticker.C:
+			w.poll()
+		case <-w.pollNow:
+			w.poll()
+		case metadata, ok := <-serialMetadata:
+			if !ok {
+				serialMetadata = nil
+				continue
+			}
+			w.update(func(state *State) {
+				state.Title = metadata.Title
+				state.Artist = metadata.Artist
+				state.Album = metadata.Album
+			})
+		case volume, ok := <-serialVolume:
+			if !ok {
+				serialVolume = nil
+				continue
+			}
+			w.update(func(state *State) { state.Volume = volume })
+		case mute, ok := <-serialMute:
+			if !ok {
+				serialMute = nil
+				continue
+			}
+			w.update(func(state *State) { state.Mute = mute })
+		case playing, ok := <-serialPlay:
+			if !ok {
+				serialPlay = nil
+				continue
+			}
+			w.update(func(state *State) {
+				state.Playback = "paused"
+				if playing {
+					state.Playback = "playing"
+				}
+			})
+		case status, ok := <-websocketStatus:
+			if !ok {
+				websocketStatus = nil
+				continue
+			}
+			w.update(func(state *State) {
+				state.Volume = float32(status.Volume) / 100
+				state.Playback = playbackName(status.State)
+				state.Title = status.Title
+				state.Artist = status.Artist
+				state.Album = status.Album
+				// The serial API's source is read directly when there is one
+				if !hasSerial {
+					state.Source = normalizeSource(status.Input)
+				}
+			})
+		case player, ok := <-httpPlayer:
+			if !ok {
+				httpPlayer = nil
+				continue
+			}
+			w.update(func(state *State) {
+				state.Volume = player.Volume
+				state.Mute = player.Mute
+				state.Playback = playbackName(player.State)
+				state.Title = player.Title
+				state.Artist = player.Artist
+				state.Album = player.Album
+			})
+		}
+	}
+}
@@ -0,0 +1,342 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package nowplaying
+
+import (
+	"arylic-connect/localWebsocketApi/endpoints"
+	"arylic-connect/localWebsocketApi/extWebsocket"
+	"arylic-connect/localWebsocketApi/httpmedia"
+	"arylic-connect/localWebsocketApi/serialmedia"
+	"context"
+	"errors"
+	"github.com/ethereum/go-ethereum/rpc"
+	"sync"
+	"time"
+)
+
+// tickInterval is how often subscribers get an interpolated position while
+// something is playing.
+const tickInterval = time.Second
+
+// idleTimeout is how long a tracker keeps its feed running after GetAnchor
+// with nobody subscribed, so polling clients share one feed.
+const idleTimeout = time.Minute
+
+// A tracker whose feed ends or can't be started retries it, waiting twice as
+// long each time up to maxFeedRetry. Reconnecting the device retries at once.
+const (
+	minFeedRetry = time.Second
+	maxFeedRetry = 30 * time.Second
+)
+
+// Service keeps a tracker per device, fed from the best transport available
+// for it. The websocket API pushes position with every change, HTTP gets it by
+// polling, and the serial API only knows when the track or play state changes.
+type Service struct {
+	serialConnections    *serialmedia.SerialMediaWrapper
+	httpConnections      *httpmedia.HttpMediaWrapper
+	websocketConnections *extWebsocket.ExternalWebsocketWrapper
+
+	lock     sync.Mutex
+	trackers map[string]*tracker
+}
+
+func New(serial *serialmedia.SerialMediaWrapper, http *httpmedia.HttpMediaWrapper, websocket *extWebsocket.ExternalWebsocketWrapper) *Service {
+	service := &Service{
+		serialConnections:    serial,
+		httpConnections:      http,
+		websocketConnections: websocket,
+		trackers:             make(map[string]*tracker),
+	}
+	for _, registry := range []*endpoints.Registry{serial.Endpoints, http.Endpoints, websocket.Endpoints} {
+		registry.OnChange(service.endpointChanged)
+	}
+	return service
+}
+
+// endpointChanged moves a tracker's feed when a connection for its device is
+// opened or lost, so it doesn't stay bound to a connection the wrapper has
+// replaced. Wrappers can call this with their lock held, so the tracker is
+// looked up separately.
+func (service *Service) endpointChanged(change endpoints.Change) {
+	if change.Endpoint.State == endpoints.State_Connected && !change.NewConnection {
+		return
+	}
+	go func() {
+		service.lock.Lock()
+		t, hasTracker := service.trackers[change.Endpoint.Name]
+		service.lock.Unlock()
+		if hasTracker {
+			t.restartFeed()
+		}
+	}()
+}
+
+// trackerFor returns the tracker for a target, starting one and its feed if
+// there isn't one running.
+func (service *Service) trackerFor(target string) (*tracker, error) {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+
+	existing, hasTracker := service.trackers[target]
+	if hasTracker {
+		return existing, nil
+	}
+
+	t := newTracker()
+	feedCtx, feedCancel := context.WithCancel(context.Background())
+	samples, feedErr := service.startFeed(feedCtx, target)
+	if feedErr != nil {
+		feedCancel()
+		return nil, feedErr
+	}
+	service.trackers[target] = t
+
+	go service.run(target, t, samples, feedCancel)
+	return t, nil
+}
+
+// run feeds samples into a tracker until it goes idle, then drops it so the
+// next request starts over. If the feed ends or can't be restarted the tracker
+// stays, so its subscribers carry on once the device is back, and the feed is
+// retried with backoff.
+func (service *Service) run(target string, t *tracker, samples <-chan Sample, stopFeed context.CancelFunc) {
+	defer func() {
+		stopFeed()
+	}()
+
+	retryWait := minFeedRetry
+	var retry <-chan time.Time
+	feedLost := func() {
+		samples = nil
+		retry = time.After(retryWait)
+		retryWait *= 2
+		if retryWait > maxFeedRetry {
+			retryWait = maxFeedRetry
+		}
+	}
+	restartFeed := func() {
+		stopFeed()
+		feedCtx, feedCancel := context.WithCancel(context.Background())
+		stopFeed = feedCancel
+		var feedErr error
+		samples, feedErr = service.startFeed(feedCtx, target)
+		if feedErr != nil {
+			feedLost()
+			return
+		}
+		retry = nil
+	}
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case sample, ok := <-samples:
+			if !ok {
+				feedLost()
+				continue
+			}
+			retryWait = minFeedRetry
+			t.update(sample)
+		case <-t.restart:
+			retryWait = minFeedRetry
+			restartFeed()
+		case <-retry:
+			restartFeed()
+		case now := <-ticker.C:
+			t.tick()
+			service.lock.Lock()
+			t.lock.Lock()
+			idle := t.idle(now)
+			t.lock.Unlock()
+			if idle && service.trackers[target] == t {
+				delete(service.trackers, target)
+			}
+			service.lock.Unlock()
+			if idle {
+				return
+			}
+		}
+	}
+}
+
+// emit passes a sample on from a feed, giving up when the feed is stopped.
+func emit(ctx context.Context, samples chan<- Sample, sample Sample) bool {
+	select {
+	case samples <- sample:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// startFeed picks the best transport connected for a target and turns its
+// updates into samples. The channel closes when the transport stops sending
+// or ctx is cancelled.
+func (service *Service) startFeed(ctx context.Context, target string) (<-chan Sample, error) {
+	service.websocketConnections.OpLock.RLock()
+	wsConnection, hasWs := service.websocketConnections.HttpMediaCons[target]
+	service.websocketConnections.OpLock.RUnlock()
+	if hasWs {
+		samples := make(chan Sample)
+		go func() {
+			defer close(samples)
+			statusChannel := wsConnection.StatusChangeChannel(ctx)
+			initial, initialErr := wsConnection.GetStatus(ctx)
+			if initialErr == nil {
+				if !emit(ctx, samples, Sample{
+					Source:      "websocket",
+					HasMetadata: true, Title: initial.Title, Artist: initial.Artist, Album: initial.Album, Duration: initial.Duration,
+					HasElapsed: true, Elapsed: initial.Elapsed,
+					HasPlaying: true, Playing: initial.State == "play",
+				}) {
+					return
+				}
+			}
+			for status := range statusChannel {
+				if !emit(ctx, samples, Sample{
+					Source:      "websocket",
+					HasMetadata: true, Title: status.Title, Artist: status.Artist, Album: status.Album, Duration: status.Duration,
+					HasElapsed: true, Elapsed: status.Elapsed,
+					HasPlaying: true, Playing: status.State == "play",
+				}) {
+					return
+				}
+			}
+		}()
+		return samples, nil
+	}
+
+	playerChannel, httpErr := httpmedia.PlayerStatusChannel(ctx, service.httpConnections, target)
+	if httpErr == nil {
+		samples := make(chan Sample)
+		go func() {
+			defer close(samples)
+			for player := range playerChannel {
+				if !emit(ctx, samples, Sample{
+					Source:      "http",
+					HasMetadata: true, Title: player.Title, Artist: player.Artist, Album: player.Album, Duration: player.Duration,
+					HasElapsed: true, Elapsed: player.Position,
+					HasPlaying: true, Playing: player.Playing,
+				}) {
+					return
+				}
+			}
+		}()
+		return samples, nil
+	}
+
+	service.serialConnections.OpLock.RLock()
+	serialConnection, hasSerial := service.serialConnections.SerialMediaCons[target]
+	service.serialConnections.OpLock.RUnlock()
+	if hasSerial {
+		samples := make(chan Sample)
+		go func() {
+			defer close(samples)
+			metadataChannel := serialConnection.MetadataChangeChannel(ctx)
+			playChannel := serialConnection.PlayChannel(ctx)
+			status, statusErr := serialConnection.GetStatus(ctx)
+			if statusErr == nil {
+				if !emit(ctx, samples, Sample{Source: "serial", HasPlaying: true, Playing: status.Playing}) {
+					return
+				}
+			}
+			for {
+				select {
+				case metadata, ok := <-metadataChannel:
+					if !ok {
+						return
+					}
+					if !emit(ctx, samples, Sample{
+						Source:      "serial",
+						HasMetadata: true, Title: metadata.Title, Artist: metadata.Artist, Album: metadata.Album,
+					}) {
+						return
+					}
+				case playing, ok := <-playChannel:
+					if !ok {
+						return
+					}
+					if !emit(ctx, samples, Sample{Source: "serial", HasPlaying: true, Playing: playing}) {
+						return
+					}
+				}
+			}
+		}()
+		return samples, nil
+	}
+
+	return nil, errors.New("endpoint not found")
+}
+
+// GetAnchor returns the last known position of a device, for clients that
+// would rather interpolate it themselves.
+func (service *Service) GetAnchor(ctx context.Context, target string) (Anchor, error) {
+	t, trackerErr := service.trackerFor(target)
+	if trackerErr != nil {
+		return Anchor{}, trackerErr
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.lastRead = time.Now()
+	return t.anchor, nil
+}
+
+// PositionChanges streams position updates for a device: every change the
+// device reports, plus an interpolated tick every second while playing.
+func (service *Service) PositionChanges(ctx context.Context, target string) (*rpc.Subscription, error) {
+	t, trackerErr := service.trackerFor(target)
+	if trackerErr != nil {
+		return nil, trackerErr
+	}
+
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
+	incomingChannel := make(chan Update, 4)
+	t.lock.Lock()
+	t.watchers[incomingChannel] = struct{}{}
+	initial := Update{Event: Event_Sync, Anchor: t.anchor, Position: t.anchor.PositionAt(time.Now())}
+	known := t.known
+	t.lock.Unlock()
+	sub := notifier.CreateSubscription()
+
+	go func() {
+		if known {
+			notifier.Notify(sub.ID, initial)
+		}
+		for {
+			select {
+			case update := <-incomingChannel:
+				notifier.Notify(sub.ID, update)
+			case <-sub.Err():
+				t.lock.Lock()
+				delete(t.watchers, incomingChannel)
+				t.lock.Unlock()
+				return
+			}
+		}
+	}()
+
+	return sub, nil
+}
@@ -0,0 +1,223 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package nowplaying tracks the play position of each device between the
+// updates it sends, so clients get a smooth position instead of one that jumps
+// every few seconds.
+package nowplaying
+
+import (
+	"sync"
+	"time"
+)
+
+// seekThreshold is how far off the predicted position an update has to be
+// before it counts as a seek instead of normal drift.
+const seekThreshold = 2 * time.Second
+
+type Event string
+
+const (
+	Event_Sync  Event = "sync"  // Regular update, position resynced
+	Event_Track Event = "track" // New track started
+	Event_Seek  Event = "seek"  // Position jumped within the same track
+	Event_Play  Event = "play"  // Playback started or resumed
+	Event_Pause Event = "pause" // Playback paused or stopped
+	Event_Tick  Event = "tick"  // Interpolated position while playing
+)
+
+// Anchor is the last known position and when it was true. While Playing, the
+// position at any time is Elapsed plus however long it has been since
+// AnchorTime, so clients can run their own progress bars off it.
+type Anchor struct {
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Duration int    `json:"duration"` // Milliseconds, 0 if unknown
+
+	Elapsed    int   `json:"elapsed"`    // Milliseconds at AnchorTime
+	AnchorTime int64 `json:"anchorTime"` // Unix milliseconds
+	Playing    bool  `json:"playing"`
+
+	Source string `json:"source"` // Which transport the last update came from
+}
+
+// PositionAt works out the position in milliseconds at a given time.
+func (anchor Anchor) PositionAt(at time.Time) int {
+	if !anchor.Playing {
+		return anchor.Elapsed
+	}
+	position := anchor.Elapsed + int(at.UnixMilli()-anchor.AnchorTime)
+	if anchor.Duration > 0 && position > anchor.Duration {
+		return anchor.Duration
+	}
+	return position
+}
+
+// Update is what gets sent to subscribers.
+type Update struct {
+	Event    Event  `json:"event"`
+	Anchor   Anchor `json:"anchor"`
+	Position int    `json:"position"` // Milliseconds when this update was sent
+}
+
+// Sample is one update from a device. Not every transport knows everything,
+// so the Has fields mark what is filled in.
+type Sample struct {
+	Source string
+
+	HasMetadata bool
+	Title       string
+	Artist      string
+	Album       string
+	Duration    int
+
+	HasElapsed bool
+	Elapsed    int
+
+	HasPlaying bool
+	Playing    bool
+}
+
+type tracker struct {
+	lock     sync.Mutex
+	anchor   Anchor
+	known    bool
+	watchers map[chan<- Update]struct{}
+	// lastRead is when the anchor was last asked for outside a subscription
+	lastRead time.Time
+	restart  chan struct{}
+}
+
+func newTracker() *tracker {
+	return &tracker{
+		watchers: make(map[chan<- Update]struct{}),
+		lastRead: time.Now(),
+		restart:  make(chan struct{}, 1),
+	}
+}
+
+// restartFeed has the tracker move its feed to whatever is connected now.
+func (t *tracker) restartFeed() {
+	select {
+	case t.restart <- struct{}{}:
+	default: // already restarting
+	}
+}
+
+// idle checks if nobody has watched or read the tracker lately.
+//
+// Callers must hold the lock.
+func (t *tracker) idle(now time.Time) bool {
+	return len(t.watchers) == 0 && now.Sub(t.lastRead) > idleTimeout
+}
+
+// apply folds a sample into the anchor and works out what kind of change it
+// was.
+//
+// Callers must hold the lock.
+func (t *tracker) apply(sample Sample, now time.Time) Event {
+	previous := t.anchor
+	predicted := previous.PositionAt(now)
+	next := previous
+	next.Source = sample.Source
+	next.AnchorTime = now.UnixMilli()
+	next.Elapsed = predicted
+
+	event := Event_Sync
+	trackChanged := sample.HasMetadata && (!t.known ||
+		sample.Title != previous.Title ||
+		sample.Artist != previous.Artist ||
+		sample.Album != previous.Album ||
+		(sample.Duration != previous.Duration && sample.Duration > 0))
+
+	if sample.HasMetadata {
+		next.Title = sample.Title
+		next.Artist = sample.Artist
+		next.Album = sample.Album
+		if sample.Duration > 0 || trackChanged {
+			next.Duration = sample.Duration
+		}
+	}
+	if sample.HasPlaying {
+		next.Playing = sample.Playing
+	}
+
+	switch {
+	case trackChanged:
+		event = Event_Track
+		next.Elapsed = 0
+		if sample.HasElapsed {
+			next.Elapsed = sample.Elapsed
+		}
+	case sample.HasPlaying && sample.Playing != previous.Playing:
+		event = Event_Pause
+		if sample.Playing {
+			event = Event_Play
+		}
+		if sample.HasElapsed {
+			next.Elapsed = sample.Elapsed
+		}
+	case sample.HasElapsed:
+		drift := time.Duration(sample.Elapsed-predicted) * time.Millisecond
+		if drift > seekThreshold || drift < -seekThreshold {
+			event = Event_Seek
+		}
+		next.Elapsed = sample.Elapsed
+	}
+
+	t.anchor = next
+	t.known = true
+	return event
+}
+
+// publish sends an update to every watcher.
+//
+// Callers must hold the lock.
+func (t *tracker) publish(event Event, now time.Time) {
+	update := Update{
+		Event:    event,
+		Anchor:   t.anchor,
+		Position: t.anchor.PositionAt(now),
+	}
+	for watcher := range t.watchers {
+		select {
+		case watcher <- update:
+		default:
+			// just pass on send fails
+		}
+	}
+}
+
+func (t *tracker) update(sample Sample) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+	t.publish(t.apply(sample, now), now)
+}
+
+// tick sends the interpolated position to watchers while playing.
+func (t *tracker) tick() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.known && t.anchor.Playing {
+		t.publish(Event_Tick, time.Now())
+	}
+}
@@ -0,0 +1,157 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rest
+
+import (
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type object = map[string]interface{}
+
+var (
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	timeType          = reflect.TypeOf(time.Time{})
+)
+
+// schemaOf describes a Go type as a JSON schema, following the same rules
+// encoding/json uses to marshal it.
+func schemaOf(t reflect.Type) object {
+	if t == rawMessageType || t.Kind() == reflect.Interface {
+		return object{}
+	}
+	if t == timeType {
+		return object{"type": "string", "format": "date-time"}
+	}
+	if t.Implements(textMarshalerType) {
+		return object{"type": "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return object{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := object{}
+		addFields(t, properties)
+		return object{"type": "object", "properties": properties}
+	}
+	return object{}
+}
+
+// addFields adds the JSON fields of a struct to a schema's properties,
+// flattening embedded structs the way encoding/json does.
+func addFields(t reflect.Type, properties object) {
+	for index := 0; index < t.NumField(); index++ {
+		field := t.Field(index)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addFields(field.Type, properties)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type)
+	}
+}
+
+// openApi builds the OpenAPI document from the endpoint table, so it can't
+// drift from what's actually served.
+func (api *API) openApi() object {
+	paths := object{}
+	for _, current := range api.endpoints {
+		operation := object{
+			"summary": current.summary,
+			"responses": object{
+				"200": object{
+					"description": "OK",
+					"content": object{
+						"application/json": object{"schema": schemaOf(reflect.TypeOf(current.reply))},
+					},
+				},
+				"default": object{
+					"description": "Error",
+					"content": object{
+						"application/json": object{"schema": schemaOf(reflect.TypeOf(errorReply{}))},
+					},
+				},
+			},
+		}
+
+		parameters := make([]object, 0)
+		for _, part := range strings.Split(current.path, "/") {
+			if strings.HasPrefix(part, "{") {
+				parameters = append(parameters, object{
+					"name":     strings.Trim(part, "{}"),
+					"in":       "path",
+					"required": true,
+					"schema":   object{"type": "string"},
+				})
+			}
+		}
+		if len(parameters) != 0 {
+			operation["parameters"] = parameters
+		}
+		if current.request != nil {
+			operation["requestBody"] = object{
+				"required": true,
+				"content": object{
+					"application/json": object{"schema": schemaOf(reflect.TypeOf(current.request))},
+				},
+			}
+		}
+
+		pathItem, hasPath := paths[current.path].(object)
+		if !hasPath {
+			pathItem = object{}
+			paths[current.path] = pathItem
+		}
+		pathItem[strings.ToLower(current.method)] = operation
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   "arylic-connect",
+			"version": "1",
+		},
+		"paths": paths,
+	}
+}
@@ -0,0 +1,201 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package rest is a resource-oriented HTTP API over the device registry, for
+// clients that can't hold a websocket open for JSON-RPC.
+package rest
+
+import (
+	"arylic-connect/localWebsocketApi/auth"
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/localWebsocketApi/upgrades"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/rpc"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Prefix is where the API is mounted on the broker's web server.
+const Prefix = "/api/"
+
+// callTimeout bounds each request, as there's no client to cancel it if a
+// device stops responding.
+const callTimeout = 30 * time.Second
+
+// maxBodySize caps request bodies, which are only ever small JSON documents.
+const maxBodySize = 1 << 20
+
+type params map[string]string
+
+type endpoint struct {
+	method string
+	path   string // segments in braces are parameters, like {id}
+	// rpcMethod is the JSON-RPC method the endpoint stands in for, which
+	// decides the scope needed to call it.
+	rpcMethod string
+	summary   string
+	request   interface{} // example body, nil if the endpoint takes none
+	reply     interface{} // example response
+	handle    func(ctx context.Context, values params, body []byte) (interface{}, error)
+}
+
+// API serves the REST endpoints and their OpenAPI document.
+type API struct {
+	devices   *devices.Registry
+	rpcClient *rpc.Client
+	endpoints []endpoint
+}
+
+// New builds the API. The JSON-RPC server is used for /api/call, which exposes
+// every JSON-RPC method over plain HTTP.
+func New(registry *devices.Registry, rpcServer *rpc.Server) *API {
+	api := &API{
+		devices:   registry,
+		rpcClient: rpc.DialInProc(rpcServer),
+	}
+	api.endpoints = api.routes()
+	return api
+}
+
+// errorReply is the body sent back with any error status.
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, auth.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, devices.ErrDeviceNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, devices.ErrUnsupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, upgrades.ErrUpgrading):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+var errBadRequest = errors.New("bad request")
+
+func badRequest(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errBadRequest, fmt.Sprintf(format, args...))
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// match checks a request path against an endpoint path, returning the path
+// parameters if it fits.
+func match(pattern string, path string) (params, bool) {
+	patternParts := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathParts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(patternParts) != len(pathParts) {
+		return nil, false
+	}
+
+	values := make(params)
+	for index, part := range patternParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			values[strings.Trim(part, "{}")] = pathParts[index]
+			continue
+		}
+		if part != pathParts[index] {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+func (api *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == Prefix+"openapi.json" {
+		writeJSON(w, http.StatusOK, api.openApi())
+		return
+	}
+
+	allowed := make([]string, 0)
+	for _, candidate := range api.endpoints {
+		values, matched := match(candidate.path, r.URL.Path)
+		if !matched {
+			continue
+		}
+		if candidate.method != r.Method {
+			allowed = append(allowed, candidate.method)
+			continue
+		}
+
+		if candidate.rpcMethod != "" {
+			allowedErr := auth.Allowed(r.Context(), candidate.rpcMethod)
+			if allowedErr != nil {
+				writeJSON(w, http.StatusForbidden, errorReply{Error: allowedErr.Error()})
+				return
+			}
+		}
+
+		body, readErr := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+		if readErr != nil {
+			writeJSON(w, http.StatusBadRequest, errorReply{Error: readErr.Error()})
+			return
+		}
+
+		ctx, ctxCancel := context.WithTimeout(r.Context(), callTimeout)
+		defer ctxCancel()
+		reply, handleErr := candidate.handle(ctx, values, body)
+		if handleErr != nil {
+			writeJSON(w, statusFor(handleErr), errorReply{Error: handleErr.Error()})
+			return
+		}
+		if reply == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, reply)
+		return
+	}
+
+	if len(allowed) != 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSON(w, http.StatusMethodNotAllowed, errorReply{Error: "method not allowed"})
+		return
+	}
+	writeJSON(w, http.StatusNotFound, errorReply{Error: "not found"})
+}
+
+// decode parses a JSON request body, insisting on one being there.
+func decode(body []byte, into interface{}) error {
+	if len(body) == 0 {
+		return badRequest("request body required")
+	}
+	decodeErr := json.Unmarshal(body, into)
+	if decodeErr != nil {
+		return badRequest("%s", decodeErr)
+	}
+	return nil
+}
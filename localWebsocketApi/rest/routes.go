@@ -0,0 +1,224 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rest
+
+import (
+	"arylic-connect/localWebsocketApi/auth"
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/rpcWrapper/serialMediaControl"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/ethereum/go-ethereum/rpc"
+	"net/http"
+)
+
+type volumeBody struct {
+	Volume *float32 `json:"volume"` // 0 - 1
+}
+
+type muteBody struct {
+	Mute *bool `json:"mute"`
+}
+
+type sourceBody struct {
+	Source *serialMediaControl.InputSource `json:"source"`
+}
+
+// action maps a POST with no body onto a playback command.
+func (api *API) action(path string, rpcMethod string, summary string, run func(ctx context.Context, ref string) (devices.Served, error)) endpoint {
+	return endpoint{
+		method:    http.MethodPost,
+		path:      path,
+		rpcMethod: rpcMethod,
+		summary:   summary,
+		reply:     devices.Served{},
+		handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+			return run(ctx, values["id"])
+		},
+	}
+}
+
+func (api *API) routes() []endpoint {
+	return []endpoint{
+		{
+			method:    http.MethodGet,
+			path:      "/api/devices",
+			rpcMethod: "devices_listDevices",
+			summary:   "List connected devices",
+			reply:     []devices.DeviceInfo{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				return api.devices.ListDevices(ctx), nil
+			},
+		},
+		{
+			method:    http.MethodGet,
+			path:      "/api/devices/{id}",
+			rpcMethod: "devices_getDevice",
+			summary:   "Get a device by ID, UUID, MAC, host or name",
+			reply:     devices.DeviceInfo{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				return api.devices.GetDevice(ctx, values["id"])
+			},
+		},
+		{
+			method:    http.MethodGet,
+			path:      "/api/devices/{id}/status",
+			rpcMethod: "devices_getStatus",
+			summary:   "Get the full device status",
+			reply:     devices.StatusResult{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				return api.devices.GetStatus(ctx, values["id"])
+			},
+		},
+		{
+			method:    http.MethodGet,
+			path:      "/api/devices/{id}/player",
+			rpcMethod: "devices_getPlayerStatus",
+			summary:   "Get the playback state",
+			reply:     devices.PlayerStatusResult{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				return api.devices.GetPlayerStatus(ctx, values["id"])
+			},
+		},
+		{
+			method:    http.MethodGet,
+			path:      "/api/devices/{id}/volume",
+			rpcMethod: "devices_getVolume",
+			summary:   "Get the volume, from 0 to 1",
+			reply:     devices.VolumeResult{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				return api.devices.GetVolume(ctx, values["id"])
+			},
+		},
+		{
+			method:    http.MethodPut,
+			path:      "/api/devices/{id}/volume",
+			rpcMethod: "devices_setVolume",
+			summary:   "Set the volume, from 0 to 1",
+			request:   volumeBody{},
+			reply:     devices.VolumeResult{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				request := volumeBody{}
+				decodeErr := decode(body, &request)
+				if decodeErr != nil {
+					return nil, decodeErr
+				}
+				if request.Volume == nil || *request.Volume < 0 || *request.Volume > 1 {
+					return nil, badRequest("volume must be between 0 and 1")
+				}
+				return api.devices.SetVolume(ctx, values["id"], *request.Volume)
+			},
+		},
+		{
+			method:    http.MethodGet,
+			path:      "/api/devices/{id}/mute",
+			rpcMethod: "devices_getMute",
+			summary:   "Get whether the device is muted",
+			reply:     devices.MuteResult{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				return api.devices.GetMute(ctx, values["id"])
+			},
+		},
+		{
+			method:    http.MethodPut,
+			path:      "/api/devices/{id}/mute",
+			rpcMethod: "devices_setMute",
+			summary:   "Mute or unmute the device",
+			request:   muteBody{},
+			reply:     devices.MuteResult{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				request := muteBody{}
+				decodeErr := decode(body, &request)
+				if decodeErr != nil {
+					return nil, decodeErr
+				}
+				if request.Mute == nil {
+					return nil, badRequest("mute must be set")
+				}
+				return api.devices.SetMute(ctx, values["id"], *request.Mute)
+			},
+		},
+		{
+			method:    http.MethodGet,
+			path:      "/api/devices/{id}/source",
+			rpcMethod: "devices_getSource",
+			summary:   "Get the input source",
+			reply:     devices.SourceResult{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				return api.devices.GetSource(ctx, values["id"])
+			},
+		},
+		{
+			method:    http.MethodPut,
+			path:      "/api/devices/{id}/source",
+			rpcMethod: "devices_setSource",
+			summary:   "Switch the input source",
+			request:   sourceBody{},
+			reply:     devices.SourceResult{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				request := sourceBody{}
+				decodeErr := decode(body, &request)
+				if decodeErr != nil {
+					return nil, decodeErr
+				}
+				if request.Source == nil || *request.Source == serialMediaControl.Input_Unknown {
+					return nil, badRequest("source must be a known input")
+				}
+				return api.devices.SetSource(ctx, values["id"], *request.Source)
+			},
+		},
+		api.action("/api/devices/{id}/play", "devices_requestPlay", "Resume playback", api.devices.RequestPlay),
+		api.action("/api/devices/{id}/pause", "devices_requestPause", "Pause playback", api.devices.RequestPause),
+		api.action("/api/devices/{id}/playpause", "devices_requestPlayPause", "Toggle between playing and paused", api.devices.RequestPlayPause),
+		api.action("/api/devices/{id}/stop", "devices_requestStop", "Stop playback", api.devices.RequestStop),
+		api.action("/api/devices/{id}/next", "devices_requestNext", "Skip to the next track", api.devices.RequestNext),
+		api.action("/api/devices/{id}/previous", "devices_requestPrevious", "Go back to the previous track", api.devices.RequestPrevious),
+		{
+			method:  http.MethodPost,
+			path:    "/api/call/{method}",
+			summary: "Call any JSON-RPC method, such as httpmedia_getStatus, with a JSON array of its parameters as the body",
+			request: []interface{}{},
+			reply:   json.RawMessage{},
+			handle: func(ctx context.Context, values params, body []byte) (interface{}, error) {
+				allowedErr := auth.Allowed(ctx, values["method"])
+				if allowedErr != nil {
+					return nil, allowedErr
+				}
+				args := make([]interface{}, 0)
+				if len(body) != 0 {
+					decodeErr := decode(body, &args)
+					if decodeErr != nil {
+						return nil, decodeErr
+					}
+				}
+				result := json.RawMessage{}
+				callErr := api.rpcClient.CallContext(ctx, &result, values["method"], args...)
+				if callErr != nil {
+					var rpcErr rpc.Error
+					if errors.As(callErr, &rpcErr) && rpcErr.ErrorCode() == -32601 {
+						return nil, badRequest("%s", callErr)
+					}
+					return nil, callErr
+				}
+				return result, nil
+			},
+		},
+	}
+}
@@ -0,0 +1,197 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package scan finds devices by probing every address in configured ranges,
+// for networks where SSDP multicast is blocked.
+package scan
+
+import (
+	"arylic-connect/localWebsocketApi/config"
+	"arylic-connect/transport/tcp"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRangeSize stops a typo like /8 from turning into a 16 million host scan.
+const maxRangeSize = 1 << 16
+
+// Scanner probes address ranges for devices.
+type Scanner struct {
+	ranges      []*net.IPNet
+	interval    time.Duration
+	concurrency int
+	spacing     time.Duration
+	timeout     time.Duration
+	serialPort  int
+	client      *http.Client
+
+	// Skip reports hosts that don't need probing, like ones already
+	// connected.
+	Skip func(host string) bool
+	// Found is called for each host that answers.
+	Found func(host string)
+}
+
+func New(scanConfig config.Scan, serialPort int) (*Scanner, error) {
+	scanner := &Scanner{
+		interval:    scanConfig.Interval,
+		concurrency: scanConfig.Concurrency,
+		spacing:     time.Second / time.Duration(scanConfig.Rate),
+		timeout:     scanConfig.Timeout,
+		serialPort:  serialPort,
+		client:      &http.Client{Timeout: scanConfig.Timeout},
+		Skip:        func(host string) bool { return false },
+		Found:       func(host string) {},
+	}
+	for _, cidr := range scanConfig.Ranges {
+		_, network, parseErr := net.ParseCIDR(cidr)
+		if parseErr != nil {
+			return nil, fmt.Errorf("scan range: %w", parseErr)
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones > 16 {
+			return nil, fmt.Errorf("scan range %s is larger than %d addresses", cidr, maxRangeSize)
+		}
+		scanner.ranges = append(scanner.ranges, network)
+	}
+	return scanner, nil
+}
+
+// hosts lists the addresses in a range, leaving out the network and
+// broadcast addresses of IPv4 ranges that have them.
+func hosts(network *net.IPNet) []net.IP {
+	ones, bits := network.Mask.Size()
+	size := 1 << (bits - ones)
+	base := network.IP.Mask(network.Mask)
+
+	list := make([]net.IP, 0, size)
+	for offset := 0; offset < size; offset++ {
+		if bits == 32 && size > 2 && (offset == 0 || offset == size-1) {
+			continue
+		}
+		address := make(net.IP, len(base))
+		copy(address, base)
+		// Add the offset to the low 32 bits; ranges are at most 2^16.
+		low := binary.BigEndian.Uint32(address[len(address)-4:])
+		binary.BigEndian.PutUint32(address[len(address)-4:], low+uint32(offset))
+		list = append(list, address)
+	}
+	return list
+}
+
+// probeHttp asks for the status the HTTP API gives, which any Linkplay device
+// answers with a JSON object.
+func (scanner *Scanner) probeHttp(ctx context.Context, host string) bool {
+	request, requestErr := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/httpapi.asp?command=getStatusEx", host), nil)
+	if requestErr != nil {
+		return false
+	}
+	response, responseErr := scanner.client.Do(request)
+	if responseErr != nil {
+		return false
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return false
+	}
+	status := make(map[string]interface{})
+	decodeErr := json.NewDecoder(io.LimitReader(response.Body, 1<<16)).Decode(&status)
+	if decodeErr != nil {
+		return false
+	}
+	_, hasUuid := status["uuid"]
+	_, hasName := status["DeviceName"]
+	return hasUuid || hasName
+}
+
+// probeSerial checks for the serial API tunnel by asking for the version.
+func (scanner *Scanner) probeSerial(ctx context.Context, host string) bool {
+	target := net.JoinHostPort(host, strconv.Itoa(scanner.serialPort))
+	return tcp.Probe(ctx, target, "MCU+PAS+RAKOIT:VER&") == nil
+}
+
+func (scanner *Scanner) probe(ctx context.Context, host string) bool {
+	ctx, ctxCancel := context.WithTimeout(ctx, scanner.timeout)
+	defer ctxCancel()
+	return scanner.probeHttp(ctx, host) || scanner.probeSerial(ctx, host)
+}
+
+// Scan probes every range once, starting probes no faster than the rate and
+// with no more than the concurrency limit in flight.
+func (scanner *Scanner) Scan(ctx context.Context) {
+	pacer := time.NewTicker(scanner.spacing)
+	defer pacer.Stop()
+	slots := make(chan struct{}, scanner.concurrency)
+	var probes sync.WaitGroup
+	defer probes.Wait()
+
+	for _, network := range scanner.ranges {
+		for _, address := range hosts(network) {
+			host := address.String()
+			if scanner.Skip(host) {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-pacer.C:
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case slots <- struct{}{}:
+			}
+
+			probes.Add(1)
+			go func() {
+				defer probes.Done()
+				defer func() { <-slots }()
+				if scanner.probe(ctx, host) {
+					scanner.Found(host)
+				}
+			}()
+		}
+	}
+}
+
+// Run scans every interval until ctx is cancelled.
+func (scanner *Scanner) Run(ctx context.Context) error {
+	ticker := time.NewTicker(scanner.interval)
+	defer ticker.Stop()
+	for {
+		started := time.Now()
+		scanner.Scan(ctx)
+		if ctx.Err() == nil {
+			log.Printf("Scanned for devices in %s\n", time.Since(started).Round(time.Second))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
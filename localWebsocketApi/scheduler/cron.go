@@ -0,0 +1,223 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package scheduler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed five field cron expression: minute, hour, day of
+// month, month and day of week. Each field is a bit set of allowed values.
+type Schedule struct {
+	minute, hour, day, month, weekday uint64
+	// anyDay and anyWeekday mark fields left as *. Like cron, when both day
+	// fields are restricted a time matching either one runs.
+	anyDay, anyWeekday bool
+}
+
+type field struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minuteField  = field{name: "minute", min: 0, max: 59}
+	hourField    = field{name: "hour", min: 0, max: 23}
+	dayField     = field{name: "day of month", min: 1, max: 31}
+	monthField   = field{name: "month", min: 1, max: 12, names: map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}}
+	weekdayField = field{name: "day of week", min: 0, max: 7, names: map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}}
+)
+
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseSchedule parses a cron expression like "30 7 * * mon-fri", or one of
+// the shorthands like @daily. Fields take *, lists, ranges and steps, and
+// months and days of the week take their three letter names.
+func ParseSchedule(expression string) (*Schedule, error) {
+	expression = strings.TrimSpace(strings.ToLower(expression))
+	shorthand, isShorthand := shorthands[expression]
+	if isShorthand {
+		expression = shorthand
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q needs 5 fields: minute hour day month weekday", expression)
+	}
+
+	schedule := &Schedule{
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+	targets := []*uint64{&schedule.minute, &schedule.hour, &schedule.day, &schedule.month, &schedule.weekday}
+	for index, spec := range []field{minuteField, hourField, dayField, monthField, weekdayField} {
+		bits, parseErr := spec.parse(fields[index])
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		*targets[index] = bits
+	}
+	// 7 is also Sunday
+	if schedule.weekday&(1<<7) != 0 {
+		schedule.weekday |= 1
+	}
+	return schedule, nil
+}
+
+func (spec field) parse(text string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(text, ",") {
+		step := 1
+		slash := strings.Index(part, "/")
+		if slash != -1 {
+			var stepErr error
+			step, stepErr = strconv.Atoi(part[slash+1:])
+			if stepErr != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in %s field %q", spec.name, text)
+			}
+			part = part[:slash]
+		}
+
+		low, high := spec.min, spec.max
+		if part != "*" {
+			dash := strings.Index(part, "-")
+			var lowErr, highErr error
+			if dash == -1 {
+				low, lowErr = spec.value(part)
+				high = low
+				// a single value with a step runs to the end, like 5/15
+				if slash != -1 {
+					high = spec.max
+				}
+			} else {
+				low, lowErr = spec.value(part[:dash])
+				high, highErr = spec.value(part[dash+1:])
+			}
+			if lowErr != nil {
+				return 0, lowErr
+			}
+			if highErr != nil {
+				return 0, highErr
+			}
+			if low > high {
+				return 0, fmt.Errorf("backwards range in %s field %q", spec.name, text)
+			}
+		}
+		for value := low; value <= high; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func (spec field) value(text string) (int, error) {
+	named, isNamed := spec.names[text]
+	if isNamed {
+		return named, nil
+	}
+	value, convErr := strconv.Atoi(text)
+	if convErr != nil || value < spec.min || value > spec.max {
+		return 0, fmt.Errorf("%s must be %d-%d, not %q", spec.name, spec.min, spec.max, text)
+	}
+	return value, nil
+}
+
+func (schedule *Schedule) dayMatches(t time.Time) bool {
+	dayMatch := schedule.day&(1<<t.Day()) != 0
+	weekdayMatch := schedule.weekday&(1<<t.Weekday()) != 0
+	if schedule.anyDay || schedule.anyWeekday {
+		return dayMatch && weekdayMatch
+	}
+	return dayMatch || weekdayMatch
+}
+
+// allHours is an hour field that matches every hour.
+const allHours = 1<<24 - 1
+
+// repeated reports whether a wall clock time already happened earlier the
+// same day, because the clocks went back in between.
+func repeated(t time.Time) bool {
+	_, offsetNow := t.Zone()
+	_, offsetBefore := t.Add(-2 * time.Hour).Zone()
+	if offsetBefore <= offsetNow {
+		return false
+	}
+	earlier := t.Add(-time.Duration(offsetBefore-offsetNow) * time.Second)
+	return earlier.Day() == t.Day() && earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute()
+}
+
+// Next returns the first time after after that the schedule matches, in the
+// given location, or the zero time if there isn't one in the next five years
+// (like the 31st of February). Times skipped by a daylight saving change
+// don't run that day. Times repeated by one run the first time round, unless
+// the schedule runs every hour anyway.
+func (schedule *Schedule) Next(after time.Time, location *time.Location) time.Time {
+	t := after.In(location).Truncate(time.Minute).Add(time.Minute)
+	yearLimit := t.Year() + 5
+
+	// Each field steps forward until it matches, going back to the start
+	// whenever a larger field rolls over.
+wrap:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+	for schedule.month&(1<<t.Month()) == 0 {
+		t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location).AddDate(0, 1, 0)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+	for !schedule.dayMatches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location).AddDate(0, 0, 1)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+	// Hours and minutes step in absolute time, as the wall clock hour can
+	// repeat or be skipped when the clocks change
+	for schedule.hour&(1<<t.Hour()) == 0 {
+		previous := t
+		t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+		if t.Day() != previous.Day() {
+			goto wrap
+		}
+	}
+	for schedule.minute&(1<<t.Minute()) == 0 {
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+	if schedule.hour != allHours && repeated(t) {
+		t = t.Add(time.Minute)
+		goto wrap
+	}
+	return t
+}
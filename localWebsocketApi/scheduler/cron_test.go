@@ -0,0 +1,95 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package scheduler
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestNextAcrossDaylightSaving(t *testing.T) {
+	cases := []struct {
+		name     string
+		zone     string
+		schedule string
+		after    string // in the zone, with its abbreviation to pick repeated times
+		next     string
+	}{
+		// Clocks go forward 02:00 EST to 03:00 EDT on 8 March 2026
+		{"new york skipped time runs next day", "America/New_York", "30 2 * * *", "2026-03-08 00:00 EST", "2026-03-09 02:30 EDT"},
+		{"new york after the gap", "America/New_York", "0 3 * * *", "2026-03-08 01:00 EST", "2026-03-08 03:00 EDT"},
+		{"new york hourly over the gap", "America/New_York", "0 * * * *", "2026-03-08 01:30 EST", "2026-03-08 03:00 EDT"},
+		// Clocks go back 02:00 EDT to 01:00 EST on 1 November 2026
+		{"new york after the repeat", "America/New_York", "0 3 * * *", "2026-11-01 00:30 EDT", "2026-11-01 03:00 EST"},
+		{"new york repeated time first", "America/New_York", "30 1 * * *", "2026-11-01 00:00 EDT", "2026-11-01 01:30 EDT"},
+		{"new york repeated time once", "America/New_York", "30 1 * * *", "2026-11-01 01:30 EDT", "2026-11-02 01:30 EST"},
+		{"new york every half hour through the repeat", "America/New_York", "*/30 * * * *", "2026-11-01 01:45 EDT", "2026-11-01 01:00 EST"},
+
+		// Clocks go forward 01:00 GMT to 02:00 BST on 29 March 2026
+		{"london skipped time runs next day", "Europe/London", "15 1 * * *", "2026-03-29 00:00 GMT", "2026-03-30 01:15 BST"},
+		{"london after the gap", "Europe/London", "0 2 * * *", "2026-03-29 00:30 GMT", "2026-03-29 02:00 BST"},
+		// Clocks go back 02:00 BST to 01:00 GMT on 25 October 2026
+		{"london after the repeat", "Europe/London", "0 4 * * *", "2026-10-25 00:30 BST", "2026-10-25 04:00 GMT"},
+		{"london repeated time first", "Europe/London", "45 1 * * *", "2026-10-25 00:00 BST", "2026-10-25 01:45 BST"},
+		{"london repeated time once", "Europe/London", "45 1 * * *", "2026-10-25 01:45 BST", "2026-10-26 01:45 GMT"},
+		{"london hourly through the repeat", "Europe/London", "0 * * * *", "2026-10-25 01:30 BST", "2026-10-25 01:00 GMT"},
+
+		// Clocks go back 03:00 AEDT to 02:00 AEST on 5 April 2026
+		{"sydney after the repeat", "Australia/Sydney", "0 4 * * *", "2026-04-05 01:00 AEDT", "2026-04-05 04:00 AEST"},
+		{"sydney repeated time once", "Australia/Sydney", "30 2 * * *", "2026-04-05 02:30 AEDT", "2026-04-06 02:30 AEST"},
+		// Clocks go forward 02:00 AEST to 03:00 AEDT on 4 October 2026
+		{"sydney skipped time runs next day", "Australia/Sydney", "30 2 * * *", "2026-10-04 00:00 AEST", "2026-10-05 02:30 AEDT"},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			location, locationErr := time.LoadLocation(test.zone)
+			if locationErr != nil {
+				t.Fatal(locationErr)
+			}
+			after, afterErr := time.ParseInLocation("2006-01-02 15:04 MST", test.after, location)
+			if afterErr != nil {
+				t.Fatal(afterErr)
+			}
+			expected, expectedErr := time.ParseInLocation("2006-01-02 15:04 MST", test.next, location)
+			if expectedErr != nil {
+				t.Fatal(expectedErr)
+			}
+			schedule, parseErr := ParseSchedule(test.schedule)
+			if parseErr != nil {
+				t.Fatal(parseErr)
+			}
+
+			// Next used to loop forever over a repeated hour
+			done := make(chan time.Time, 1)
+			go func() {
+				done <- schedule.Next(after, location)
+			}()
+			select {
+			case next := <-done:
+				if !next.Equal(expected) {
+					t.Errorf("Next(%s) = %s, want %s", test.after, next.In(location).Format("2006-01-02 15:04 MST"), test.next)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("Next didn't return")
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package scheduler
+
+import (
+	"arylic-connect/rpcWrapper/serialMediaControl"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Action is what a step does on each target device.
+type Action string
+
+const (
+	Action_SetSource  Action = "setSource"
+	Action_SetVolume  Action = "setVolume"  // to Volume
+	Action_RampVolume Action = "rampVolume" // from the current volume to Volume over Duration
+	Action_SetMute    Action = "setMute"
+	Action_Play       Action = "play"
+	Action_Pause      Action = "pause"
+	Action_PlayPause  Action = "playPause"
+	Action_Stop       Action = "stop"
+	Action_Next       Action = "next"
+	Action_Previous   Action = "previous"
+	Action_Standby    Action = "standby"
+	Action_Wait       Action = "wait" // for Duration before the next step
+)
+
+// Step is one action of a job. Only the fields its action uses are read.
+type Step struct {
+	Action   Action                          `json:"action" yaml:"action"`
+	Source   *serialMediaControl.InputSource `json:"source,omitempty" yaml:"source,omitempty"`
+	Volume   float32                         `json:"volume,omitempty" yaml:"volume,omitempty"`
+	Mute     bool                            `json:"mute,omitempty" yaml:"mute,omitempty"`
+	Duration string                          `json:"duration,omitempty" yaml:"duration,omitempty"` // like 30s or 10m
+}
+
+// Targets picks the devices a job runs on. Zone members get their volume
+// offsets.
+type Targets struct {
+	Devices []string `json:"devices,omitempty" yaml:"devices,omitempty"` // ID, UUID, MAC, host or name
+	Zones   []string `json:"zones,omitempty" yaml:"zones,omitempty"`
+	All     bool     `json:"all,omitempty" yaml:"all,omitempty"` // every connected device
+}
+
+// Job runs its steps on its targets whenever its schedule matches. The steps
+// run in order on each device, with the devices going at the same time.
+type Job struct {
+	ID       string  `json:"id" yaml:"id"`
+	Name     string  `json:"name" yaml:"name"`
+	Schedule string  `json:"schedule" yaml:"schedule"`                     // cron expression, like "0 7 * * mon-fri"
+	TimeZone string  `json:"timeZone,omitempty" yaml:"timeZone,omitempty"` // like Europe/London; the broker's own when empty
+	Disabled bool    `json:"disabled,omitempty" yaml:"disabled,omitempty"`
+	Targets  Targets `json:"targets" yaml:"targets"`
+	Steps    []Step  `json:"steps" yaml:"steps"`
+}
+
+// location loads the job's time zone.
+func (job *Job) location() (*time.Location, error) {
+	if job.TimeZone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(job.TimeZone)
+}
+
+func (job *Job) validate() error {
+	if job.Name == "" {
+		return errors.New("a job needs a name")
+	}
+	_, scheduleErr := ParseSchedule(job.Schedule)
+	if scheduleErr != nil {
+		return scheduleErr
+	}
+	_, locationErr := job.location()
+	if locationErr != nil {
+		return fmt.Errorf("unknown time zone %q", job.TimeZone)
+	}
+	if !job.Targets.All && len(job.Targets.Devices) == 0 && len(job.Targets.Zones) == 0 {
+		return errors.New("a job needs devices, zones or all as targets")
+	}
+	if len(job.Steps) == 0 {
+		return errors.New("a job needs steps")
+	}
+	for index, step := range job.Steps {
+		stepErr := step.validate()
+		if stepErr != nil {
+			return fmt.Errorf("step %d: %w", index+1, stepErr)
+		}
+	}
+	return nil
+}
+
+func (step *Step) validate() error {
+	switch step.Action {
+	case Action_SetSource:
+		if step.Source == nil {
+			return errors.New("setSource needs a source")
+		}
+		// Unrecognised names still parse, as Input_Unknown
+		if *step.Source == serialMediaControl.Input_Unknown {
+			return errors.New("unknown source")
+		}
+	case Action_SetVolume, Action_RampVolume:
+		if step.Volume < 0 || step.Volume > 1 {
+			return errors.New("volume must be between 0 and 1")
+		}
+	case Action_SetMute, Action_Play, Action_Pause, Action_PlayPause, Action_Stop, Action_Next, Action_Previous, Action_Standby:
+	case Action_Wait:
+	default:
+		return fmt.Errorf("unknown action %q", step.Action)
+	}
+	if step.Action == Action_RampVolume || step.Action == Action_Wait {
+		duration, durationErr := time.ParseDuration(step.Duration)
+		if durationErr != nil || duration <= 0 {
+			return fmt.Errorf("%s needs a duration like 30s or 10m", step.Action)
+		}
+	}
+	return nil
+}
+
+// duration is the parsed Duration, already checked by validate.
+func (step *Step) duration() time.Duration {
+	duration, _ := time.ParseDuration(step.Duration)
+	return duration
+}
@@ -0,0 +1,201 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package scheduler
+
+import (
+	"arylic-connect/localWebsocketApi/config"
+	"arylic-connect/localWebsocketApi/zones"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rampInterval is how often a volume ramp moves the volume.
+const rampInterval = 2 * time.Second
+
+// Result is how one step went on one device. Step 0 is working out the
+// targets, like a zone that no longer exists.
+type Result struct {
+	Step   int    `json:"step" yaml:"step"`
+	Action Action `json:"action,omitempty" yaml:"action,omitempty"`
+	Device string `json:"device" yaml:"device"`
+	Error  string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Run is a record of a job running.
+type Run struct {
+	Job      string    `json:"job" yaml:"job"`
+	Name     string    `json:"name" yaml:"name"`
+	Manual   bool      `json:"manual,omitempty" yaml:"manual,omitempty"` // started with RunJob
+	Started  time.Time `json:"started" yaml:"started"`
+	Finished time.Time `json:"finished" yaml:"finished"`
+	Failed   int       `json:"failed" yaml:"failed"`
+	Results  []Result  `json:"results" yaml:"results"`
+}
+
+// resolve lists the devices a job runs on, with zone volume offsets. A
+// device listed more than once runs once, with the first offset found, even
+// when it's listed by different references.
+func (service *Service) resolve(ctx context.Context, targets Targets) ([]zones.Member, []Result) {
+	members := make([]config.ZoneMember, 0)
+	problems := make([]Result, 0)
+	seen := make(map[string]bool)
+	add := func(member config.ZoneMember) {
+		if seen[member.Device] {
+			return
+		}
+		seen[member.Device] = true
+		members = append(members, member)
+	}
+
+	for _, device := range targets.Devices {
+		add(config.ZoneMember{Device: device})
+	}
+	for _, name := range targets.Zones {
+		zone, zoneErr := service.zones.GetZone(ctx, name)
+		if zoneErr != nil {
+			problems = append(problems, Result{Device: name, Error: fmt.Sprintf("zone %s: %s", name, zoneErr.Error())})
+			continue
+		}
+		for _, member := range zone.Members {
+			add(member)
+		}
+	}
+	if targets.All {
+		for _, device := range service.devices.ListDevices(ctx) {
+			add(config.ZoneMember{Device: device.ID})
+		}
+	}
+	return zones.ResolveMembers(ctx, service.devices, members), problems
+}
+
+// execute runs a job's steps in order on each target, with the targets
+// going at the same time. A failed step is recorded and the rest still run,
+// so a device that won't change source still starts playing.
+func (service *Service) execute(ctx context.Context, job Job, manual bool) Run {
+	run := Run{Job: job.ID, Name: job.Name, Manual: manual, Started: time.Now()}
+	members, problems := service.resolve(ctx, job.Targets)
+	run.Results = append(run.Results, problems...)
+
+	var resultsLock sync.Mutex
+	var running sync.WaitGroup
+	for _, member := range members {
+		running.Add(1)
+		go func(member zones.Member) {
+			defer running.Done()
+			for index, step := range job.Steps {
+				if ctx.Err() != nil {
+					return
+				}
+				result := Result{Step: index + 1, Action: step.Action, Device: member.Device}
+				stepErr := service.perform(ctx, step, member)
+				if stepErr != nil {
+					result.Error = stepErr.Error()
+				}
+				resultsLock.Lock()
+				run.Results = append(run.Results, result)
+				resultsLock.Unlock()
+			}
+		}(member)
+	}
+	running.Wait()
+
+	sort.SliceStable(run.Results, func(i, j int) bool {
+		if run.Results[i].Device != run.Results[j].Device {
+			return run.Results[i].Device < run.Results[j].Device
+		}
+		return run.Results[i].Step < run.Results[j].Step
+	})
+	for _, result := range run.Results {
+		if result.Error != "" {
+			run.Failed++
+		}
+	}
+	run.Finished = time.Now()
+	return run
+}
+
+// perform does one step on one device.
+func (service *Service) perform(ctx context.Context, step Step, member zones.Member) (err error) {
+	ref := member.Ref()
+	switch step.Action {
+	case Action_SetSource:
+		_, err = service.devices.SetSource(ctx, ref, *step.Source)
+	case Action_SetVolume:
+		_, err = service.devices.SetVolume(ctx, ref, member.OffsetVolume(step.Volume))
+	case Action_RampVolume:
+		err = service.ramp(ctx, ref, member.OffsetVolume(step.Volume), step.duration())
+	case Action_SetMute:
+		_, err = service.devices.SetMute(ctx, ref, step.Mute)
+	case Action_Play:
+		_, err = service.devices.RequestPlay(ctx, ref)
+	case Action_Pause:
+		_, err = service.devices.RequestPause(ctx, ref)
+	case Action_PlayPause:
+		_, err = service.devices.RequestPlayPause(ctx, ref)
+	case Action_Stop:
+		_, err = service.devices.RequestStop(ctx, ref)
+	case Action_Next:
+		_, err = service.devices.RequestNext(ctx, ref)
+	case Action_Previous:
+		_, err = service.devices.RequestPrevious(ctx, ref)
+	case Action_Standby:
+		_, err = service.devices.RequestStandby(ctx, ref)
+	case Action_Wait:
+		timer := time.NewTimer(step.duration())
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-timer.C:
+		}
+	default:
+		err = fmt.Errorf("unknown action %q", step.Action)
+	}
+	return
+}
+
+// ramp moves the volume from where it is to target in even steps.
+func (service *Service) ramp(ctx context.Context, ref string, target float32, duration time.Duration) error {
+	start, volumeErr := service.devices.GetVolume(ctx, ref)
+	if volumeErr != nil {
+		return volumeErr
+	}
+	steps := int(duration / rampInterval)
+	if steps < 1 {
+		steps = 1
+	}
+	ticker := time.NewTicker(duration / time.Duration(steps))
+	defer ticker.Stop()
+	for index := 1; index <= steps; index++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		level := start.Volume + (target-start.Volume)*float32(index)/float32(steps)
+		_, setErr := service.devices.SetVolume(ctx, ref, level)
+		if setErr != nil {
+			return setErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,427 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package scheduler runs device actions on cron schedules, like switching to
+// the network source and ramping the volume up on weekday mornings. Jobs and
+// their run history are kept in a file so they survive restarts. Runs missed
+// while the broker was down aren't made up.
+package scheduler
+
+import (
+	"arylic-connect/localWebsocketApi/config"
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/localWebsocketApi/zones"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	// so time zones work on hosts without a zoneinfo database
+	_ "time/tzdata"
+)
+
+var ErrJobNotFound = errors.New("job not found")
+var ErrJobRunning = errors.New("job is already running")
+var ErrNotRunning = errors.New("scheduler is not running")
+
+// JobStatus is a job with when it next runs and how it last went.
+type JobStatus struct {
+	Job
+	Next    *time.Time `json:"next,omitempty"` // nil when disabled
+	Running bool       `json:"running"`
+	LastRun *Run       `json:"lastRun,omitempty"`
+}
+
+// saved is the layout of the scheduler file.
+type saved struct {
+	Jobs    []Job `yaml:"jobs"`
+	History []Run `yaml:"history,omitempty"`
+}
+
+type Service struct {
+	devices *devices.Registry
+	zones   *zones.Service
+	path    string
+	limit   int
+
+	lock    sync.Mutex
+	jobs    map[string]Job
+	next    map[string]time.Time // by job ID, zero when disabled
+	history []Run                // oldest first
+	running map[string]bool
+	changed chan struct{}
+
+	// runs are cancelled with the Loop context, and Loop waits for them
+	loopCtx context.Context
+	active  sync.WaitGroup
+}
+
+// New loads the jobs and history saved in the scheduler file. An empty
+// path uses the user config directory.
+func New(registry *devices.Registry, zoneService *zones.Service, schedulerConfig config.Scheduler) (*Service, error) {
+	path := schedulerConfig.File
+	if path == "" {
+		configDir, dirErr := os.UserConfigDir()
+		if dirErr != nil {
+			return nil, dirErr
+		}
+		path = filepath.Join(configDir, "arylic-connect", "schedule.yaml")
+	}
+	service := &Service{
+		devices: registry,
+		zones:   zoneService,
+		path:    path,
+		limit:   schedulerConfig.History,
+		jobs:    make(map[string]Job),
+		next:    make(map[string]time.Time),
+		history: make([]Run, 0),
+		running: make(map[string]bool),
+		changed: make(chan struct{}, 1),
+	}
+
+	data, readErr := os.ReadFile(path)
+	if errors.Is(readErr, os.ErrNotExist) {
+		return service, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	state := saved{}
+	unmarshalErr := yaml.Unmarshal(data, &state)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, unmarshalErr)
+	}
+	for _, job := range state.Jobs {
+		validateErr := job.validate()
+		if validateErr != nil {
+			return nil, fmt.Errorf("job %s in %s: %w", job.Name, path, validateErr)
+		}
+		service.jobs[job.ID] = job
+		service.next[job.ID] = nextRun(job, time.Now(), time.Time{})
+	}
+	service.history = append(service.history, state.History...)
+	return service, nil
+}
+
+// save writes out the jobs and history.
+//
+// Callers must hold the lock.
+func (service *Service) save() error {
+	state := saved{Jobs: service.sortedJobs(), History: service.history}
+	return config.WriteYAML(service.path, state)
+}
+
+// Callers must hold the lock.
+func (service *Service) sortedJobs() []Job {
+	list := make([]Job, 0, len(service.jobs))
+	for _, job := range service.jobs {
+		list = append(list, job)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// nextRun is when a job runs next after now. last is when it was last due,
+// so a time repeated when the clocks go back doesn't run twice.
+func nextRun(job Job, now time.Time, last time.Time) time.Time {
+	if job.Disabled {
+		return time.Time{}
+	}
+	schedule, scheduleErr := ParseSchedule(job.Schedule)
+	location, locationErr := job.location()
+	if scheduleErr != nil || locationErr != nil {
+		return time.Time{}
+	}
+	next := schedule.Next(now, location)
+	const wallClock = "2006-01-02 15:04"
+	if !last.IsZero() && !next.IsZero() && next.Format(wallClock) == last.In(location).Format(wallClock) {
+		next = schedule.Next(next, location)
+	}
+	return next
+}
+
+// Callers must hold the lock.
+func (service *Service) status(job Job) JobStatus {
+	status := JobStatus{Job: job, Running: service.running[job.ID]}
+	next := service.next[job.ID]
+	if !next.IsZero() {
+		status.Next = &next
+	}
+	for index := len(service.history) - 1; index >= 0; index-- {
+		if service.history[index].Job == job.ID {
+			lastRun := service.history[index]
+			status.LastRun = &lastRun
+			break
+		}
+	}
+	return status
+}
+
+// wake has Loop look at the jobs again after a change.
+func (service *Service) wake() {
+	select {
+	case service.changed <- struct{}{}:
+	default: // already woken
+	}
+}
+
+// start runs a job in the background, recording it in the history when it's
+// done. Runs of the same job don't overlap.
+//
+// Callers must hold the lock.
+func (service *Service) start(job Job, manual bool) error {
+	if service.loopCtx == nil {
+		return ErrNotRunning
+	}
+	if service.running[job.ID] {
+		return ErrJobRunning
+	}
+	service.running[job.ID] = true
+	service.active.Add(1)
+	go func(ctx context.Context) {
+		defer service.active.Done()
+		run := service.execute(ctx, job, manual)
+		if run.Failed != 0 {
+			log.Printf("Scheduled job %s had %d failures\n", job.Name, run.Failed)
+		}
+
+		service.lock.Lock()
+		defer service.lock.Unlock()
+		delete(service.running, job.ID)
+		service.history = append(service.history, run)
+		if service.limit > 0 && len(service.history) > service.limit {
+			service.history = service.history[len(service.history)-service.limit:]
+		}
+		saveErr := service.save()
+		if saveErr != nil {
+			log.Printf("Error saving schedule history: %s\n", saveErr.Error())
+		}
+	}(service.loopCtx)
+	return nil
+}
+
+// Loop starts jobs when they're due until ctx is done, then waits for
+// running jobs to stop.
+func Loop(ctx context.Context, service *Service) error {
+	service.lock.Lock()
+	service.loopCtx = ctx
+	now := time.Now()
+	for id, job := range service.jobs {
+		service.next[id] = nextRun(job, now, time.Time{})
+	}
+	service.lock.Unlock()
+	defer func() {
+		service.lock.Lock()
+		service.loopCtx = nil
+		service.lock.Unlock()
+		service.active.Wait()
+	}()
+
+	for {
+		service.lock.Lock()
+		now := time.Now()
+		for id, due := range service.next {
+			if due.IsZero() || due.After(now) {
+				continue
+			}
+			job := service.jobs[id]
+			startErr := service.start(job, false)
+			if startErr != nil {
+				log.Printf("Skipping scheduled job %s: %s\n", job.Name, startErr.Error())
+			}
+			service.next[id] = nextRun(job, now, due)
+		}
+		// wake at least hourly in case the clock is changed
+		wait := time.Hour
+		for _, due := range service.next {
+			if !due.IsZero() && due.Sub(now) < wait {
+				wait = due.Sub(now)
+			}
+		}
+		service.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-service.changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+func (service *Service) ListJobs(ctx context.Context) []JobStatus {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	list := make([]JobStatus, 0, len(service.jobs))
+	for _, job := range service.sortedJobs() {
+		list = append(list, service.status(job))
+	}
+	return list
+}
+
+func (service *Service) GetJob(ctx context.Context, id string) (JobStatus, error) {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	job, exists := service.jobs[id]
+	if !exists {
+		return JobStatus{}, ErrJobNotFound
+	}
+	return service.status(job), nil
+}
+
+// SetJob adds a job when it has no ID, or replaces the job with its ID.
+func (service *Service) SetJob(ctx context.Context, job Job) (JobStatus, error) {
+	validateErr := job.validate()
+	if validateErr != nil {
+		return JobStatus{}, validateErr
+	}
+
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	previous, existed := service.jobs[job.ID]
+	if job.ID == "" {
+		id := make([]byte, 8)
+		_, randErr := rand.Read(id)
+		if randErr != nil {
+			return JobStatus{}, randErr
+		}
+		job.ID = hex.EncodeToString(id)
+	} else if !existed {
+		return JobStatus{}, ErrJobNotFound
+	}
+
+	service.jobs[job.ID] = job
+	saveErr := service.save()
+	if saveErr != nil {
+		if existed {
+			service.jobs[job.ID] = previous
+		} else {
+			delete(service.jobs, job.ID)
+		}
+		return JobStatus{}, saveErr
+	}
+	service.next[job.ID] = nextRun(job, time.Now(), time.Time{})
+	service.wake()
+	return service.status(job), nil
+}
+
+// SetJobEnabled turns a job's schedule on or off without changing the rest.
+func (service *Service) SetJobEnabled(ctx context.Context, id string, enabled bool) (JobStatus, error) {
+	service.lock.Lock()
+	job, exists := service.jobs[id]
+	service.lock.Unlock()
+	if !exists {
+		return JobStatus{}, ErrJobNotFound
+	}
+	job.Disabled = !enabled
+	return service.SetJob(ctx, job)
+}
+
+// DeleteJob removes a job. A run in progress finishes, and its history is
+// kept.
+func (service *Service) DeleteJob(ctx context.Context, id string) error {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	previous, exists := service.jobs[id]
+	if !exists {
+		return ErrJobNotFound
+	}
+	delete(service.jobs, id)
+	saveErr := service.save()
+	if saveErr != nil {
+		service.jobs[id] = previous
+		return saveErr
+	}
+	delete(service.next, id)
+	service.wake()
+	return nil
+}
+
+// RunJob starts a job now, whether or not it's enabled. It returns once the
+// job has started; the run shows up in the history when it's done.
+func (service *Service) RunJob(ctx context.Context, id string) error {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	job, exists := service.jobs[id]
+	if !exists {
+		return ErrJobNotFound
+	}
+	return service.start(job, true)
+}
+
+// GetHistory returns past runs newest first, for one job or for all of them
+// when id is empty. A limit of 0 returns everything kept.
+func (service *Service) GetHistory(ctx context.Context, id string, limit int) []Run {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	runs := make([]Run, 0)
+	for index := len(service.history) - 1; index >= 0; index-- {
+		if limit > 0 && len(runs) == limit {
+			break
+		}
+		if id == "" || service.history[index].Job == id {
+			runs = append(runs, service.history[index])
+		}
+	}
+	return runs
+}
+
+// GetNextRuns lists when a schedule would run, to check an expression
+// before saving a job with it.
+func (service *Service) GetNextRuns(ctx context.Context, schedule string, timeZone string, count int) ([]time.Time, error) {
+	parsed, parseErr := ParseSchedule(schedule)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	job := Job{TimeZone: timeZone}
+	location, locationErr := job.location()
+	if locationErr != nil {
+		return nil, fmt.Errorf("unknown time zone %q", timeZone)
+	}
+	if count <= 0 {
+		count = 5
+	}
+	if count > 100 {
+		count = 100
+	}
+	runs := make([]time.Time, 0, count)
+	next := time.Now()
+	for len(runs) < count {
+		next = parsed.Next(next, location)
+		if next.IsZero() {
+			break
+		}
+		runs = append(runs, next)
+	}
+	return runs, nil
+}
@@ -20,16 +20,15 @@ package serialmedia
 
 import (
 	"context"
-	"errors"
 )
 
 func (wrapper *SerialMediaWrapper) GetBass(ctx context.Context, target string) (float32, error) {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.GetBass(ctx)
@@ -39,9 +38,9 @@ func (wrapper *SerialMediaWrapper) SetBass(ctx context.Context, target string, l
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.SetBass(ctx, level)
@@ -51,9 +50,9 @@ func (wrapper *SerialMediaWrapper) GetTreble(ctx context.Context, target string)
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.GetTreble(ctx)
@@ -63,9 +62,9 @@ func (wrapper *SerialMediaWrapper) SetTreble(ctx context.Context, target string,
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.SetTreble(ctx, level)
@@ -75,9 +74,9 @@ func (wrapper *SerialMediaWrapper) GetVirtualBass(ctx context.Context, target st
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetVirtualBass(ctx)
@@ -87,9 +86,9 @@ func (wrapper *SerialMediaWrapper) SetVirtualBass(ctx context.Context, target st
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetVirtualBass(ctx, state)
@@ -99,9 +98,9 @@ func (wrapper *SerialMediaWrapper) ToggleVirtualBass(ctx context.Context, target
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.ToggleVirtualBass(ctx)
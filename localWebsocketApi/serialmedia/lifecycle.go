@@ -0,0 +1,116 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package serialmedia
+
+import (
+	"arylic-connect/localWebsocketApi/endpoints"
+	"context"
+	"errors"
+	"log"
+)
+
+// disconnect closes and drops the connection for a target if there is one.
+//
+// Callers must hold OpLock.
+func (wrapper *SerialMediaWrapper) disconnect(target string) {
+	existingEndpoint, hasEndpoint := wrapper.SerialMediaCons[target]
+	if hasEndpoint {
+		closeErr := existingEndpoint.Close()
+		if closeErr != nil {
+			log.Printf("Error closing endpoint connection for %s: %s\n", target, closeErr)
+		}
+		delete(wrapper.SerialMediaCons, target)
+	}
+}
+
+// CloseAll disconnects every device when the broker shuts down. It's a function
+// rather than a method so that it isn't exposed over JSON-RPC.
+func CloseAll(wrapper *SerialMediaWrapper) {
+	wrapper.OpLock.Lock()
+	defer wrapper.OpLock.Unlock()
+	for target := range wrapper.SerialMediaCons {
+		wrapper.disconnect(target)
+		wrapper.Endpoints.Disconnected(target)
+	}
+}
+
+// DropEndpoint closes the connection to a device that announced it's leaving
+// the network. Unlike DisconnectEndpoint it's marked offline rather than held
+// disconnected, so discovery reconnects it when it's back. It's a function
+// for the same reason as CloseAll.
+func DropEndpoint(wrapper *SerialMediaWrapper, target string, reason error) {
+	wrapper.OpLock.Lock()
+	wrapper.disconnect(target)
+	wrapper.OpLock.Unlock()
+	wrapper.Endpoints.Failed(target, reason)
+}
+
+// DisconnectEndpoint closes the connection to a device. It stays listed, and
+// discovery leaves it alone until it's reconnected or forgotten.
+func (wrapper *SerialMediaWrapper) DisconnectEndpoint(ctx context.Context, target string) error {
+	_, known := wrapper.Endpoints.Get(target)
+	if !known {
+		return errors.New("endpoint not found")
+	}
+
+	wrapper.OpLock.Lock()
+	wrapper.disconnect(target)
+	wrapper.OpLock.Unlock()
+	wrapper.Endpoints.Disconnected(target)
+	return nil
+}
+
+// ReconnectEndpoint opens a fresh connection to a known device, whether it was
+// disconnected, offline or still connected.
+func (wrapper *SerialMediaWrapper) ReconnectEndpoint(ctx context.Context, target string) (endpoints.Endpoint, error) {
+	known, isKnown := wrapper.Endpoints.Get(target)
+	if !isKnown {
+		return endpoints.Endpoint{}, errors.New("endpoint not found")
+	}
+
+	name, connectErr := wrapper.ConnectEndpoint(known.Target)
+	if connectErr != nil {
+		wrapper.Endpoints.Failed(target, connectErr)
+		return endpoints.Endpoint{}, connectErr
+	}
+	if name != target {
+		// The device was renamed while we weren't connected.
+		wrapper.Endpoints.Forget(target)
+	}
+
+	reconnected, _ := wrapper.Endpoints.Get(name)
+	return reconnected, nil
+}
+
+// ForgetEndpoint disconnects a device and drops its record, so it only comes
+// back if discovery finds it again.
+func (wrapper *SerialMediaWrapper) ForgetEndpoint(ctx context.Context, target string) error {
+	wrapper.OpLock.Lock()
+	wrapper.disconnect(target)
+	wrapper.OpLock.Unlock()
+	if !wrapper.Endpoints.Forget(target) {
+		return errors.New("endpoint not found")
+	}
+	return nil
+}
+
+// ListEndpoints returns every known device with its connection state.
+func (wrapper *SerialMediaWrapper) ListEndpoints(ctx context.Context) []endpoints.Endpoint {
+	return wrapper.Endpoints.List()
+}
@@ -21,16 +21,15 @@ package serialmedia
 import (
 	"arylic-connect/rpcWrapper/serialMediaControl"
 	"context"
-	"errors"
 )
 
 func (wrapper *SerialMediaWrapper) GetMultiroomMode(ctx context.Context, target string) (serialMediaControl.MultiroomMode, error) {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return serialMediaControl.Mode_None, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return serialMediaControl.Mode_None, connErr
 	}
 
 	return connection.GetMultiroomMode(ctx)
@@ -40,9 +39,9 @@ func (wrapper *SerialMediaWrapper) GetChannelConfig(ctx context.Context, target
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return serialMediaControl.Channel_Stereo, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return serialMediaControl.Channel_Stereo, connErr
 	}
 
 	return connection.GetChannelConfig(ctx)
@@ -52,9 +51,9 @@ func (wrapper *SerialMediaWrapper) GetVolumeSync(ctx context.Context, target str
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetVolumeSync(ctx)
@@ -64,9 +63,9 @@ func (wrapper *SerialMediaWrapper) SetVolumeSync(ctx context.Context, target str
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetVolumeSync(ctx, mode)
@@ -20,16 +20,15 @@ package serialmedia
 
 import (
 	"context"
-	"errors"
 )
 
 func (wrapper *SerialMediaWrapper) GetInternet(ctx context.Context, target string) (bool, error) {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetInternet(ctx)
@@ -39,9 +38,9 @@ func (wrapper *SerialMediaWrapper) SetInternet(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetInternet(ctx, enable)
@@ -51,9 +50,9 @@ func (wrapper *SerialMediaWrapper) GetEthernet(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetEthernet(ctx)
@@ -63,9 +62,9 @@ func (wrapper *SerialMediaWrapper) SetEthernet(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetEthernet(ctx, enable)
@@ -75,9 +74,9 @@ func (wrapper *SerialMediaWrapper) GetWifi(ctx context.Context, target string) (
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetWifi(ctx)
@@ -87,9 +86,9 @@ func (wrapper *SerialMediaWrapper) SetWifi(ctx context.Context, target string, e
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetWifi(ctx, enable)
@@ -99,9 +98,9 @@ func (wrapper *SerialMediaWrapper) RequestWifiReset(ctx context.Context, target
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.RequestWifiReset(ctx)
@@ -111,9 +110,9 @@ func (wrapper *SerialMediaWrapper) GetBluetooth(ctx context.Context, target stri
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetBluetooth(ctx)
@@ -123,9 +122,9 @@ func (wrapper *SerialMediaWrapper) SetBluetooth(ctx context.Context, target stri
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.SetBluetooth(ctx, enable)
@@ -135,9 +134,9 @@ func (wrapper *SerialMediaWrapper) GetWifiPlayback(ctx context.Context, target s
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetWifiPlayback(ctx)
@@ -19,10 +19,14 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package serialmedia
 
 import (
+	"arylic-connect/localWebsocketApi/endpoints"
+	"arylic-connect/localWebsocketApi/upgrades"
 	"arylic-connect/rpcWrapper/serialMediaControl"
+	arylicTransport "arylic-connect/transport"
 	"arylic-connect/transport/tcp"
 	"context"
-	"log"
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 )
@@ -30,16 +34,23 @@ import (
 type SerialMediaWrapper struct {
 	SerialMediaCons map[string]*serialMediaControl.RPC
 	OpLock          sync.RWMutex
+
+	Upgrades  *upgrades.Tracker
+	Endpoints *endpoints.Registry
+	// ConnectTimeout bounds how long ConnectEndpoint waits for a device.
+	ConnectTimeout time.Duration
 }
 
 func New() *SerialMediaWrapper {
 	return &SerialMediaWrapper{
 		SerialMediaCons: make(map[string]*serialMediaControl.RPC),
+		ConnectTimeout:  time.Second * 15,
+		Endpoints:       endpoints.NewRegistry(arylicTransport.Flavor_TCP),
 	}
 }
 
 func (wrapper *SerialMediaWrapper) ConnectEndpoint(target string) (string, error) {
-	ctx, ctxCancel := context.WithTimeout(context.Background(), time.Second*15)
+	ctx, ctxCancel := context.WithTimeout(context.Background(), wrapper.ConnectTimeout)
 	defer ctxCancel()
 
 	transport, _ := tcp.New()
@@ -52,24 +63,60 @@ func (wrapper *SerialMediaWrapper) ConnectEndpoint(target string) (string, error
 	if nameErr != nil {
 		return "", nameErr
 	}
+	// A new connection is usually the device back from a reboot, so this
+	// clears the flag left by an upgrade the old connection never saw finish.
+	status, _ := rpc.GetStatus(ctx)
+	wrapper.observeUpgrade(rpc, status)
 
 	wrapper.OpLock.Lock()
 	defer wrapper.OpLock.Unlock()
 
-	existingEndpoint, hasEndpoint := wrapper.SerialMediaCons[name]
-	if hasEndpoint {
-		closeErr := existingEndpoint.Close()
-		if closeErr != nil {
-			log.Printf("Error closing existing endpoint connection for %s: %s\n", name, closeErr)
-		}
-		delete(wrapper.SerialMediaCons, name)
-	}
-
+	name = wrapper.uniqueName(name, rpc)
+	wrapper.dropRenamed(name, target)
+	wrapper.disconnect(name)
 	wrapper.SerialMediaCons[name] = rpc
+	// Probing with the status also keeps the upgrading flag current.
+	wrapper.Endpoints.Connected(name, target, func(ctx context.Context) error {
+		status, probeErr := rpc.GetStatus(ctx)
+		if probeErr == nil {
+			wrapper.observeUpgrade(rpc, status)
+		}
+		return probeErr
+	})
 
 	return name, nil
 }
 
+// uniqueName picks the key for a new connection. Names aren't unique, so if
+// another device already has the name the host is added to it.
+//
+// Callers must hold OpLock.
+func (wrapper *SerialMediaWrapper) uniqueName(name string, connection *serialMediaControl.RPC) string {
+	host := upgrades.HostOf(connection.TransportTarget())
+	if name == "" {
+		return host
+	}
+	existing, hasEndpoint := wrapper.SerialMediaCons[name]
+	if !hasEndpoint || upgrades.HostOf(existing.TransportTarget()) == host {
+		return name
+	}
+	return fmt.Sprintf("%s (%s)", name, host)
+}
+
+// dropRenamed closes and forgets any other entry for the same host as target,
+// which is the device from before it was renamed, so it isn't listed twice.
+//
+// Callers must hold OpLock.
+func (wrapper *SerialMediaWrapper) dropRenamed(name string, target string) {
+	host := upgrades.HostOf(target)
+	for _, known := range wrapper.Endpoints.List() {
+		if known.Name != name && upgrades.HostOf(known.Target) == host {
+			wrapper.disconnect(known.Name)
+			wrapper.Endpoints.Forget(known.Name)
+		}
+	}
+}
+
 type EndpointInfo struct {
 	Name   string
 	Target string
@@ -81,6 +128,9 @@ func (wrapper *SerialMediaWrapper) ConnectedEndpoints() []EndpointInfo {
 	endpoints := make([]EndpointInfo, 0)
 
 	for name, endpoint := range wrapper.SerialMediaCons {
+		if wrapper.Endpoints.Offline(name) {
+			continue
+		}
 		endpoints = append(endpoints, EndpointInfo{
 			Name:   name,
 			Target: endpoint.TransportTarget(),
@@ -89,3 +139,19 @@ func (wrapper *SerialMediaWrapper) ConnectedEndpoints() []EndpointInfo {
 
 	return endpoints
 }
+
+// endpoint looks up the connection for a target, refusing it while the device
+// is in the middle of a firmware upgrade.
+//
+// Callers must hold OpLock.
+func (wrapper *SerialMediaWrapper) endpoint(target string) (*serialMediaControl.RPC, error) {
+	connection, hasConnection := wrapper.SerialMediaCons[target]
+	if !hasConnection {
+		return nil, errors.New("endpoint not found")
+	}
+	if wrapper.Upgrades.Upgrading(upgrades.HostOf(connection.TransportTarget())) {
+		return nil, upgrades.ErrUpgrading
+	}
+
+	return connection, nil
+}
@@ -20,16 +20,15 @@ package serialmedia
 
 import (
 	"context"
-	"errors"
 )
 
 func (wrapper *SerialMediaWrapper) GetLED(ctx context.Context, target string) (bool, error) {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetLED(ctx)
@@ -39,9 +38,9 @@ func (wrapper *SerialMediaWrapper) SetLED(ctx context.Context, target string, en
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetLED(ctx, enable)
@@ -51,9 +50,9 @@ func (wrapper *SerialMediaWrapper) ToggleLED(ctx context.Context, target string)
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.ToggleLED(ctx)
@@ -63,9 +62,9 @@ func (wrapper *SerialMediaWrapper) GetBeep(ctx context.Context, target string) (
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetBeep(ctx)
@@ -75,9 +74,9 @@ func (wrapper *SerialMediaWrapper) SetBeep(ctx context.Context, target string, e
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetBeep(ctx, enable)
@@ -87,9 +86,9 @@ func (wrapper *SerialMediaWrapper) GetName(ctx context.Context, target string) (
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return "", errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return "", connErr
 	}
 
 	return connection.GetName(ctx)
@@ -99,9 +98,9 @@ func (wrapper *SerialMediaWrapper) SetName(ctx context.Context, target string, n
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return "", errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return "", connErr
 	}
 
 	return connection.SetName(ctx, name)
@@ -111,9 +110,9 @@ func (wrapper *SerialMediaWrapper) GetVoicePrompt(ctx context.Context, target st
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetVoicePrompt(ctx)
@@ -123,9 +122,9 @@ func (wrapper *SerialMediaWrapper) SetVoicePrompt(ctx context.Context, target st
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetVoicePrompt(ctx, enable)
@@ -21,16 +21,15 @@ package serialmedia
 import (
 	"arylic-connect/rpcWrapper/serialMediaControl"
 	"context"
-	"errors"
 )
 
 func (wrapper *SerialMediaWrapper) GetSource(ctx context.Context, target string) (serialMediaControl.InputSource, error) {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return serialMediaControl.Input_Unknown, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return serialMediaControl.Input_Unknown, connErr
 	}
 
 	return connection.GetSource(ctx)
@@ -40,9 +39,9 @@ func (wrapper *SerialMediaWrapper) SetSource(ctx context.Context, target string,
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return serialMediaControl.Input_Unknown, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return serialMediaControl.Input_Unknown, connErr
 	}
 
 	return connection.SetSource(ctx, source)
@@ -52,9 +51,9 @@ func (wrapper *SerialMediaWrapper) GetDefaultSource(ctx context.Context, target
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return serialMediaControl.Input_Unknown, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return serialMediaControl.Input_Unknown, connErr
 	}
 
 	return connection.GetDefaultSource(ctx)
@@ -64,9 +63,9 @@ func (wrapper *SerialMediaWrapper) SetDefaultSource(ctx context.Context, target
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return serialMediaControl.Input_Unknown, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return serialMediaControl.Input_Unknown, connErr
 	}
 
 	return connection.SetDefaultSource(ctx, source)
@@ -76,9 +75,9 @@ func (wrapper *SerialMediaWrapper) GetInputAutoswitch(ctx context.Context, targe
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetInputAutoswitch(ctx)
@@ -88,9 +87,9 @@ func (wrapper *SerialMediaWrapper) SetInputAutoswitch(ctx context.Context, targe
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetInputAutoswitch(ctx, enable)
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package serialmedia
 
 import (
+	"arylic-connect/localWebsocketApi/upgrades"
 	"arylic-connect/rpcWrapper/serialMediaControl"
 	"context"
 	"errors"
@@ -33,5 +34,25 @@ func (wrapper *SerialMediaWrapper) GetStatus(ctx context.Context, target string)
 		return serialMediaControl.EndpointStatus{}, errors.New("endpoint not found")
 	}
 
-	return connection.GetStatus(ctx)
+	// Status stays readable mid-upgrade
+	status, statusErr := connection.GetStatus(ctx)
+	if statusErr == nil {
+		wrapper.observeUpgrade(connection, status)
+	}
+
+	return status, statusErr
+}
+
+// observeUpgrade passes the upgrading flag from a status read on to the
+// tracker, which is how upgrades started outside the broker get noticed.
+// Status from firmware without the flag counts as not upgrading.
+func (wrapper *SerialMediaWrapper) observeUpgrade(connection *serialMediaControl.RPC, status serialMediaControl.EndpointStatus) {
+	upgrading := false
+	for _, valid := range status.ValidValues {
+		if valid == "Upgrading" {
+			upgrading = status.Upgrading
+			break
+		}
+	}
+	wrapper.Upgrades.ObserveSerial(upgrades.HostOf(connection.TransportTarget()), upgrading)
 }
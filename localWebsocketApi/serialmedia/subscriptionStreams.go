@@ -2,7 +2,6 @@ package serialmedia
 
 import (
 	"context"
-	"errors"
 	"github.com/ethereum/go-ethereum/rpc"
 )
 
@@ -10,9 +9,9 @@ func (wrapper *SerialMediaWrapper) MetadataChanges(ctx context.Context, target s
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return nil, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return nil, connErr
 	}
 
 	notifier, supported := rpc.NotifierFromContext(ctx)
@@ -43,9 +42,9 @@ func (wrapper *SerialMediaWrapper) VolumeChanges(ctx context.Context, target str
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return nil, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return nil, connErr
 	}
 
 	notifier, supported := rpc.NotifierFromContext(ctx)
@@ -76,9 +75,9 @@ func (wrapper *SerialMediaWrapper) MuteChanges(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return nil, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return nil, connErr
 	}
 
 	notifier, supported := rpc.NotifierFromContext(ctx)
@@ -109,9 +108,9 @@ func (wrapper *SerialMediaWrapper) PlayChanges(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return nil, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return nil, connErr
 	}
 
 	notifier, supported := rpc.NotifierFromContext(ctx)
@@ -142,9 +141,9 @@ func (wrapper *SerialMediaWrapper) MediaReady(ctx context.Context, target string
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return nil, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return nil, connErr
 	}
 
 	notifier, supported := rpc.NotifierFromContext(ctx)
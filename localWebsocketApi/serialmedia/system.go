@@ -20,16 +20,15 @@ package serialmedia
 
 import (
 	"context"
-	"errors"
 )
 
 func (wrapper *SerialMediaWrapper) RequestReboot(ctx context.Context, target string) error {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.RequestReboot(ctx)
@@ -39,9 +38,9 @@ func (wrapper *SerialMediaWrapper) RequestStandby(ctx context.Context, target st
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.RequestStandby(ctx)
@@ -51,9 +50,9 @@ func (wrapper *SerialMediaWrapper) RequestReset(ctx context.Context, target stri
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.RequestReset(ctx)
@@ -63,9 +62,9 @@ func (wrapper *SerialMediaWrapper) RequestRecover(ctx context.Context, target st
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.RequestRecover(ctx)
@@ -21,16 +21,15 @@ package serialmedia
 import (
 	"arylic-connect/rpcWrapper/serialMediaControl"
 	"context"
-	"errors"
 )
 
 func (wrapper *SerialMediaWrapper) RequestPlayPause(ctx context.Context, target string) error {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.RequestPlayPause(ctx)
@@ -40,9 +39,9 @@ func (wrapper *SerialMediaWrapper) RequestNext(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.RequestNext(ctx)
@@ -52,9 +51,9 @@ func (wrapper *SerialMediaWrapper) RequestPrevious(ctx context.Context, target s
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.RequestPrevious(ctx)
@@ -64,9 +63,9 @@ func (wrapper *SerialMediaWrapper) RequestStop(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return connErr
 	}
 
 	return connection.RequestStop(ctx)
@@ -76,9 +75,9 @@ func (wrapper *SerialMediaWrapper) GetLoopMode(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return serialMediaControl.Loop_Sequence, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return serialMediaControl.Loop_Sequence, connErr
 	}
 
 	return connection.GetLoopMode(ctx)
@@ -88,9 +87,9 @@ func (wrapper *SerialMediaWrapper) SetLoopMode(ctx context.Context, target strin
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return serialMediaControl.Loop_Sequence, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return serialMediaControl.Loop_Sequence, connErr
 	}
 
 	return connection.SetLoopMode(ctx, mode)
@@ -21,16 +21,15 @@ package serialmedia
 import (
 	"arylic-connect/rpcWrapper/serialMediaControl"
 	"context"
-	"errors"
 )
 
 func (wrapper *SerialMediaWrapper) GetVersion(ctx context.Context, target string) (serialMediaControl.EndpointVersion, error) {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return serialMediaControl.EndpointVersion{}, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return serialMediaControl.EndpointVersion{}, connErr
 	}
 
 	return connection.GetVersion(ctx)
@@ -20,16 +20,15 @@ package serialmedia
 
 import (
 	"context"
-	"errors"
 )
 
 func (wrapper *SerialMediaWrapper) GetVolume(ctx context.Context, target string) (float32, error) {
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.GetVolume(ctx)
@@ -39,9 +38,9 @@ func (wrapper *SerialMediaWrapper) SetVolume(ctx context.Context, target string,
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.SetVolume(ctx, level)
@@ -51,9 +50,9 @@ func (wrapper *SerialMediaWrapper) GetMute(ctx context.Context, target string) (
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetMute(ctx)
@@ -63,9 +62,9 @@ func (wrapper *SerialMediaWrapper) SetMute(ctx context.Context, target string, s
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetMute(ctx, state)
@@ -75,9 +74,9 @@ func (wrapper *SerialMediaWrapper) ToggleMute(ctx context.Context, target string
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.ToggleMute(ctx)
@@ -87,9 +86,9 @@ func (wrapper *SerialMediaWrapper) GetFixedVolume(ctx context.Context, target st
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.GetFixedVolume(ctx)
@@ -99,9 +98,9 @@ func (wrapper *SerialMediaWrapper) SetFixedVolume(ctx context.Context, target st
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return false, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return false, connErr
 	}
 
 	return connection.SetFixedVolume(ctx, state)
@@ -111,9 +110,9 @@ func (wrapper *SerialMediaWrapper) GetMaxVolume(ctx context.Context, target stri
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.GetMaxVolume(ctx)
@@ -123,9 +122,9 @@ func (wrapper *SerialMediaWrapper) SetMaxVolume(ctx context.Context, target stri
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.SetMaxVolume(ctx, level)
@@ -135,9 +134,9 @@ func (wrapper *SerialMediaWrapper) GetBalance(ctx context.Context, target string
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.GetBalance(ctx)
@@ -147,9 +146,9 @@ func (wrapper *SerialMediaWrapper) SetBalance(ctx context.Context, target string
 	wrapper.OpLock.RLock()
 	defer wrapper.OpLock.RUnlock()
 
-	connection, hasConnection := wrapper.SerialMediaCons[target]
-	if !hasConnection {
-		return 0, errors.New("endpoint not found")
+	connection, connErr := wrapper.endpoint(target)
+	if connErr != nil {
+		return 0, connErr
 	}
 
 	return connection.SetBalance(ctx, level)
@@ -0,0 +1,98 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package localWebsocketApi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	restartDelay    = time.Second
+	maxRestartDelay = time.Minute
+)
+
+// supervisor runs the broker's background loops, restarting any that return
+// or panic until its context is cancelled.
+type supervisor struct {
+	ctx     context.Context
+	running sync.WaitGroup
+}
+
+func (loops *supervisor) run(name string, loop func(ctx context.Context) error) {
+	loops.running.Add(1)
+	go func() {
+		defer loops.running.Done()
+		delay := restartDelay
+		for {
+			started := time.Now()
+			loopErr := loops.runOnce(loop)
+			if loops.ctx.Err() != nil {
+				return
+			}
+			if loopErr == nil {
+				loopErr = errors.New("returned early")
+			}
+			// Back off while it keeps failing straight away.
+			if time.Since(started) > maxRestartDelay {
+				delay = restartDelay
+			}
+			log.Printf("%s stopped, restarting in %s: %s\n", name, delay, loopErr.Error())
+			select {
+			case <-loops.ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay *= 2
+			if delay > maxRestartDelay {
+				delay = maxRestartDelay
+			}
+		}
+	}()
+}
+
+func (loops *supervisor) runOnce(loop func(ctx context.Context) error) (loopErr error) {
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			loopErr = fmt.Errorf("panic: %v", recovered)
+		}
+	}()
+	return loop(loops.ctx)
+}
+
+// wait blocks until every loop has returned after the context is cancelled,
+// or until ctx runs out.
+func (loops *supervisor) wait(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		loops.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
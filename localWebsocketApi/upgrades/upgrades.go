@@ -0,0 +1,279 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package upgrades tracks which devices are in the middle of a firmware
+// upgrade, so the broker can keep other commands away from them until they
+// come back.
+package upgrades
+
+import (
+	"arylic-connect/rpcWrapper/httpControl"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrUpgrading = errors.New("device is upgrading firmware")
+
+// serialTimeout is how long the serial upgrading flag holds without the serial
+// status confirming it again. A device that reboots at the end of an upgrade
+// leaves a dead connection behind that will never report it finished.
+const serialTimeout = 5 * time.Minute
+
+// State is what is known about a device's upgrade. A device counts as upgrading
+// if either an update started through the broker is still running, or the
+// serial status reports it is upgrading.
+type State struct {
+	Host            string                     `json:"host"`
+	Upgrading       bool                       `json:"upgrading"`
+	SerialUpgrading bool                       `json:"serialUpgrading"`
+	Progress        httpControl.UpdateProgress `json:"progress"`
+	Started         time.Time                  `json:"started"`
+	Finished        time.Time                  `json:"finished"`
+	Error           string                     `json:"error"`
+
+	serialSeen time.Time // when the serial status last said upgrading
+}
+
+func (state State) active() bool {
+	return state.Upgrading || state.SerialUpgrading
+}
+
+// expire clears a serial upgrading flag that hasn't been confirmed lately.
+//
+// Callers must hold the write lock.
+func (tracker *Tracker) expire(state *State) {
+	if state.SerialUpgrading && time.Since(state.serialSeen) > serialTimeout {
+		state.SerialUpgrading = false
+		tracker.notify(state)
+	}
+}
+
+type Tracker struct {
+	lock      sync.RWMutex
+	hosts     map[string]*State
+	listeners map[chan<- State]string
+}
+
+func New() *Tracker {
+	return &Tracker{
+		hosts:     make(map[string]*State),
+		listeners: make(map[chan<- State]string),
+	}
+}
+
+// HostOf pulls the host out of any of the transport target formats, so that
+// the different connections to one device can be matched up.
+func HostOf(target string) string {
+	if strings.Contains(target, "://") {
+		parsed, parseErr := url.Parse(target)
+		if parseErr == nil {
+			return parsed.Hostname()
+		}
+	}
+	host, _, splitErr := net.SplitHostPort(target)
+	if splitErr == nil {
+		return host
+	}
+	return target
+}
+
+// stateFor returns the entry for a host, creating it if needed.
+//
+// Callers must hold the write lock.
+func (tracker *Tracker) stateFor(host string) *State {
+	state, hasState := tracker.hosts[host]
+	if !hasState {
+		state = &State{Host: host}
+		tracker.hosts[host] = state
+	}
+	return state
+}
+
+// notify passes the state for a host on to anyone watching it.
+//
+// Callers must hold the write lock.
+func (tracker *Tracker) notify(state *State) {
+	for listener, host := range tracker.listeners {
+		if host != state.Host {
+			continue
+		}
+		select {
+		case listener <- *state:
+		default:
+			// just pass on send fails
+		}
+	}
+}
+
+// Begin marks a host as upgrading through the broker.
+func (tracker *Tracker) Begin(host string) {
+	if tracker == nil {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	state := tracker.stateFor(host)
+	state.Upgrading = true
+	state.Progress = httpControl.UpdateProgress{State: httpControl.Update_Checking}
+	state.Started = time.Now()
+	state.Finished = time.Time{}
+	state.Error = ""
+	tracker.notify(state)
+}
+
+// Progress records the latest progress for a running upgrade.
+func (tracker *Tracker) Progress(host string, progress httpControl.UpdateProgress) {
+	if tracker == nil {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	state := tracker.stateFor(host)
+	if state.Progress == progress {
+		return
+	}
+	state.Progress = progress
+	tracker.notify(state)
+}
+
+// Finish marks a broker started upgrade as over, with the error that ended it
+// if it failed.
+func (tracker *Tracker) Finish(host string, err error) {
+	if tracker == nil {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	state := tracker.stateFor(host)
+	state.Upgrading = false
+	state.SerialUpgrading = false
+	state.Finished = time.Now()
+	if err != nil {
+		state.Error = err.Error()
+		state.Progress.State = httpControl.Update_Failed
+	} else {
+		state.Progress.State = httpControl.Update_Complete
+	}
+	tracker.notify(state)
+}
+
+// ObserveSerial records the upgrading flag from a serial status read. This
+// catches upgrades started outside the broker, like from the vendor app.
+// Serial connections are polled in the background, and a new connection
+// reports false when its status doesn't say.
+func (tracker *Tracker) ObserveSerial(host string, upgrading bool) {
+	if tracker == nil {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	state, hasState := tracker.hosts[host]
+	if !hasState && !upgrading {
+		return
+	}
+	state = tracker.stateFor(host)
+	if upgrading {
+		state.serialSeen = time.Now()
+	}
+	if state.SerialUpgrading == upgrading {
+		return
+	}
+	state.SerialUpgrading = upgrading
+	if upgrading && !state.Upgrading {
+		state.Started = time.Now()
+	}
+	tracker.notify(state)
+}
+
+// Upgrading checks if commands to a host should be held off.
+func (tracker *Tracker) Upgrading(host string) bool {
+	if tracker == nil {
+		return false
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	state, hasState := tracker.hosts[host]
+	if !hasState {
+		return false
+	}
+	tracker.expire(state)
+	return state.active()
+}
+
+// State returns the upgrade state of a single host.
+func (tracker *Tracker) State(host string) State {
+	if tracker == nil {
+		return State{Host: host}
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	state, hasState := tracker.hosts[host]
+	if !hasState {
+		return State{Host: host}
+	}
+	tracker.expire(state)
+	return *state
+}
+
+// States lists every host that has been seen upgrading.
+func (tracker *Tracker) States() []State {
+	states := make([]State, 0)
+	if tracker == nil {
+		return states
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	for _, state := range tracker.hosts {
+		tracker.expire(state)
+		states = append(states, *state)
+	}
+	return states
+}
+
+// Watch sends every change to the upgrade state of a host on the channel until
+// Unwatch is called. Sends that would block are dropped.
+func (tracker *Tracker) Watch(host string, channel chan<- State) {
+	if tracker == nil {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.listeners[channel] = host
+}
+
+func (tracker *Tracker) Unwatch(channel chan<- State) {
+	if tracker == nil {
+		return
+	}
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	delete(tracker.listeners, channel)
+}
@@ -0,0 +1,153 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package upnp reads the UPnP device description a device links to from its
+// SSDP announcements, which identifies it before any transport is connected.
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fetchTimeout bounds the description request. Devices answer in well under
+// a second when they're reachable at all.
+const fetchTimeout = 5 * time.Second
+
+// maxDescriptionSize caps how much of a description is read.
+const maxDescriptionSize = 1 << 20
+
+type Service struct {
+	Type        string `xml:"serviceType"`
+	ID          string `xml:"serviceId"`
+	SCPDURL     string `xml:"SCPDURL"`
+	ControlURL  string `xml:"controlURL"`
+	EventSubURL string `xml:"eventSubURL"`
+}
+
+type Device struct {
+	DeviceType       string    `xml:"deviceType"`
+	FriendlyName     string    `xml:"friendlyName"`
+	UDN              string    `xml:"UDN"`
+	Manufacturer     string    `xml:"manufacturer"`
+	ManufacturerURL  string    `xml:"manufacturerURL"`
+	ModelName        string    `xml:"modelName"`
+	ModelNumber      string    `xml:"modelNumber"`
+	ModelDescription string    `xml:"modelDescription"`
+	SerialNumber     string    `xml:"serialNumber"`
+	Services         []Service `xml:"serviceList>service"`
+	Devices          []Device  `xml:"deviceList>device"`
+}
+
+// Description is the root device of a description document, with where it
+// was fetched from.
+type Description struct {
+	Device
+	Location string
+}
+
+type root struct {
+	Device Device `xml:"device"`
+}
+
+// Fetch downloads and parses the description at an SSDP LOCATION.
+func Fetch(ctx context.Context, location string) (Description, error) {
+	ctx, ctxCancel := context.WithTimeout(ctx, fetchTimeout)
+	defer ctxCancel()
+	request, requestErr := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if requestErr != nil {
+		return Description{}, requestErr
+	}
+	response, responseErr := http.DefaultClient.Do(request)
+	if responseErr != nil {
+		return Description{}, responseErr
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return Description{}, fmt.Errorf("fetching %s: %s", location, response.Status)
+	}
+
+	document := root{}
+	decodeErr := xml.NewDecoder(io.LimitReader(response.Body, maxDescriptionSize)).Decode(&document)
+	if decodeErr != nil {
+		return Description{}, fmt.Errorf("parsing %s: %w", location, decodeErr)
+	}
+	return Description{Device: document.Device, Location: location}, nil
+}
+
+// UUID is the UDN without its uuid: prefix.
+func (device Device) UUID() string {
+	return strings.TrimPrefix(device.UDN, "uuid:")
+}
+
+// Offers reports whether the device or any embedded device has a service.
+func (device Device) Offers(serviceType string) bool {
+	for _, service := range device.Services {
+		if service.Type == serviceType {
+			return true
+		}
+	}
+	for _, embedded := range device.Devices {
+		if embedded.Offers(serviceType) {
+			return true
+		}
+	}
+	return false
+}
+
+// MadeBy reports whether any of the names appear in the manufacturer or
+// model fields, ignoring case. The friendly name isn't checked, as users can
+// set it to anything.
+func (device Device) MadeBy(names []string) bool {
+	fields := strings.ToLower(strings.Join([]string{device.Manufacturer, device.ManufacturerURL, device.ModelName, device.ModelDescription}, "\n"))
+	for _, name := range names {
+		if name != "" && strings.Contains(fields, strings.ToLower(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Directory holds the latest description seen for each host.
+type Directory struct {
+	lock         sync.RWMutex
+	descriptions map[string]Description
+}
+
+func NewDirectory() *Directory {
+	return &Directory{descriptions: make(map[string]Description)}
+}
+
+func (directory *Directory) Set(host string, description Description) {
+	directory.lock.Lock()
+	defer directory.lock.Unlock()
+	directory.descriptions[host] = description
+}
+
+func (directory *Directory) Get(host string) (Description, bool) {
+	directory.lock.RLock()
+	defer directory.lock.RUnlock()
+	description, known := directory.descriptions[host]
+	return description, known
+}
@@ -19,10 +19,27 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package localWebsocketApi
 
 import (
+	"arylic-connect/localWebsocketApi/artwork"
+	"arylic-connect/localWebsocketApi/auth"
+	"arylic-connect/localWebsocketApi/certs"
+	"arylic-connect/localWebsocketApi/config"
+	"arylic-connect/localWebsocketApi/devices"
 	"arylic-connect/localWebsocketApi/extWebsocket"
 	"arylic-connect/localWebsocketApi/httpmedia"
+	"arylic-connect/localWebsocketApi/metrics"
+	"arylic-connect/localWebsocketApi/mqttbridge"
+	"arylic-connect/localWebsocketApi/nowplaying"
+	"arylic-connect/localWebsocketApi/rest"
+	"arylic-connect/localWebsocketApi/scan"
+	"arylic-connect/localWebsocketApi/scheduler"
 	"arylic-connect/localWebsocketApi/serialmedia"
+	"arylic-connect/localWebsocketApi/upgrades"
+	"arylic-connect/localWebsocketApi/upnp"
+	"arylic-connect/localWebsocketApi/zones"
+	arylicTransport "arylic-connect/transport"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"embed"
 	"fmt"
 	"github.com/ethereum/go-ethereum/rpc"
@@ -30,97 +47,183 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type WebsocketManager struct {
+	config config.Config
+
 	serialConnections    *serialmedia.SerialMediaWrapper
 	httpConnections      *httpmedia.HttpMediaWrapper
 	websocketConnections *extWebsocket.ExternalWebsocketWrapper
+	nowPlaying           *nowplaying.Service
+	artwork              *artwork.Service
+	devices              *devices.Registry
+	zones                *zones.Service
+	scheduler            *scheduler.Service
+	metrics              *metrics.Metrics
+	auth                 *auth.Authenticator
+	bridge               *mqttbridge.Bridge
+
+	rpcServer      *rpc.Server
+	server         *http.Server
+	redirectServer *http.Server
+	serveErrors    chan error
+	loops          *supervisor
+	stopLoops      context.CancelFunc
+
+	descriptions *upnp.Directory
+	scanner      *scan.Scanner
+
+	ssdpLock   sync.Mutex
+	ssdpHosts  map[string]string // by device UUID
+	ssdpBusy   map[string]bool   // device UUIDs whose announcement is being handled
+	connecting map[string]bool   // hosts being connected to
 }
 
+// shutdownTimeout bounds how long RunWebsocketServer waits for a clean stop.
+const shutdownTimeout = 15 * time.Second
+
 func (manager *WebsocketManager) discoverSsdp() {
-	ssdpList, ssdpErr := ssdp.Search(ssdp.All, 5, "")
+	ssdpList, ssdpErr := ssdp.Search(ssdp.All, int(manager.config.Discovery.Wait/time.Second), "")
 	if ssdpErr != nil {
-		panic(ssdpErr)
+		log.Printf("Error searching for devices: %s\n", ssdpErr.Error())
+		return
 	}
-	knownSerialEndpoints := manager.serialConnections.ConnectedEndpoints()
-	knownHttpEndpoints := manager.httpConnections.ConnectedEndpoints()
-	knownWebsocketEndpoints := manager.websocketConnections.ConnectedEndpoints()
 	for _, service := range ssdpList {
-		if service.Type != "urn:schemas-wiimu-com:service:PlayQueue:1" {
+		if service.Type != playQueueService {
 			continue
 		}
-		parsedUrl, urlErr := url.Parse(service.Location)
-		if urlErr == nil {
-			serialTarget := parsedUrl.Hostname() + ":8899"
-			httpTarget := fmt.Sprintf("http://%s/httpapi.asp", parsedUrl.Hostname())
-			wsTarget := fmt.Sprintf("ws://%s:8888/", parsedUrl.Hostname())
-			playerName := ""
-			serialConnected := false
-			httpConnected := false
-			wsConnected := false
-			for _, endpoint := range knownSerialEndpoints {
-				if endpoint.Target == serialTarget {
-					serialConnected = true
-					playerName = endpoint.Name
-					break
-				}
-			}
-			for _, endpoint := range knownHttpEndpoints {
-				if endpoint.Target == httpTarget {
-					httpConnected = true
-					playerName = endpoint.Name
-					break
-				}
-			}
-			for _, endpoint := range knownWebsocketEndpoints {
-				if endpoint.Target == wsTarget {
-					wsConnected = true
-					break
-				}
-			}
-			if !serialConnected {
-				log.Printf("Discovered potential device at %s\n", parsedUrl.Hostname())
-				name, connectErr := manager.serialConnections.ConnectEndpoint(serialTarget)
-				if connectErr == nil {
-					log.Printf("TCP connected to player %s\n", name)
-					playerName = name
-				}
-			}
-			if !httpConnected {
-				log.Printf("Discovered potential device at %s\n", parsedUrl.Hostname())
-				name, connectErr := manager.httpConnections.ConnectEndpoint(httpTarget)
-				if connectErr == nil {
-					log.Printf("HTTP connected to player %s\n", name)
-					playerName = name
-				}
+		manager.found(service.USN, service.Location)
+	}
+}
+
+// connectHost opens whichever transports aren't already connected to a host,
+// using the settings the config gives for it.
+func (manager *WebsocketManager) connectHost(host string) {
+	device := manager.config.Device(host)
+	if device.Ignore {
+		return
+	}
+	// Announcements come in bursts, so don't connect twice at once.
+	manager.ssdpLock.Lock()
+	if manager.connecting[host] {
+		manager.ssdpLock.Unlock()
+		return
+	}
+	manager.connecting[host] = true
+	manager.ssdpLock.Unlock()
+	defer func() {
+		manager.ssdpLock.Lock()
+		delete(manager.connecting, host)
+		manager.ssdpLock.Unlock()
+	}()
+
+	serialTarget := net.JoinHostPort(host, strconv.Itoa(device.SerialPort))
+	httpTarget := fmt.Sprintf("http://%s/httpapi.asp", host)
+	wsTarget := fmt.Sprintf("ws://%s/", net.JoinHostPort(host, strconv.Itoa(device.WebsocketPort)))
+	playerName := ""
+	serialConnected := false
+	httpConnected := false
+	wsConnected := false
+	for _, endpoint := range manager.serialConnections.ConnectedEndpoints() {
+		if endpoint.Target == serialTarget {
+			serialConnected = true
+			playerName = endpoint.Name
+			break
+		}
+	}
+	for _, endpoint := range manager.httpConnections.ConnectedEndpoints() {
+		if endpoint.Target == httpTarget {
+			httpConnected = true
+			playerName = endpoint.Name
+			break
+		}
+	}
+	for _, endpoint := range manager.websocketConnections.ConnectedEndpoints() {
+		if endpoint.Target == wsTarget {
+			wsConnected = true
+			break
+		}
+	}
+	// Leave alone anything that was disconnected on request.
+	serialConnected = serialConnected || manager.serialConnections.Endpoints.HeldDisconnected(serialTarget)
+	httpConnected = httpConnected || manager.httpConnections.Endpoints.HeldDisconnected(httpTarget)
+	wsConnected = wsConnected || manager.websocketConnections.Endpoints.HeldDisconnected(wsTarget)
+	if device.Serial && !serialConnected {
+		log.Printf("Discovered potential device at %s\n", host)
+		name, connectErr := manager.serialConnections.ConnectEndpoint(serialTarget)
+		if connectErr == nil {
+			log.Printf("TCP connected to player %s\n", name)
+			playerName = name
+		}
+	}
+	if device.Http && !httpConnected {
+		log.Printf("Discovered potential device at %s\n", host)
+		name, connectErr := manager.httpConnections.ConnectEndpoint(httpTarget)
+		if connectErr == nil {
+			log.Printf("HTTP connected to player %s\n", name)
+			playerName = name
+		}
+	}
+	if device.Websocket && !wsConnected {
+		if playerName == "" {
+			playerName = device.Name
+		}
+		if playerName == "" {
+			description, described := manager.descriptions.Get(host)
+			if described {
+				playerName = description.FriendlyName
 			}
-			if !wsConnected {
-				if playerName == "" {
-					log.Printf("Player name could not be found for device at %s\n", wsTarget)
-				}
-				log.Printf("Discovered potential device at %s\n", parsedUrl.Hostname())
-				connectErr := manager.websocketConnections.ConnectEndpoint(wsTarget, playerName)
-				if connectErr == nil {
-					log.Printf("Websocket connected to player %s\n", playerName)
-				} else {
-					log.Printf("Error conecting to websocket: %s\n", connectErr.Error())
-				}
+		}
+		if playerName == "" {
+			log.Printf("Player name could not be found for device at %s\n", wsTarget)
+		}
+		log.Printf("Discovered potential device at %s\n", host)
+		name, connectErr := manager.websocketConnections.ConnectEndpoint(wsTarget, playerName)
+		if connectErr == nil {
+			log.Printf("Websocket connected to player %s\n", name)
+			watchErr := manager.artwork.Watch(name)
+			if watchErr != nil {
+				log.Printf("Error watching artwork for %s: %s\n", name, watchErr.Error())
 			}
+		} else {
+			log.Printf("Error conecting to websocket: %s\n", connectErr.Error())
 		}
 	}
 }
 
-func (manager *WebsocketManager) ssdpLoop() {
-	ticker := time.NewTicker(time.Minute)
-	manager.discoverSsdp()
+// connectStatic connects to the devices listed in the config, so they work
+// without discovery and get reconnected if they drop off.
+func (manager *WebsocketManager) connectStatic() {
+	for _, device := range manager.config.Devices {
+		manager.connectHost(device.Host)
+	}
+}
+
+func (manager *WebsocketManager) ssdpLoop(ctx context.Context) error {
+	ticker := time.NewTicker(manager.config.Discovery.Interval)
+	defer ticker.Stop()
+	manager.connectStatic()
+	if manager.config.Discovery.Enabled {
+		manager.discoverSsdp()
+	}
 	for {
 		select {
+		case <-ctx.Done():
+			return nil
 		case <-ticker.C:
-			manager.discoverSsdp()
+			manager.connectStatic()
+			if manager.config.Discovery.Enabled {
+				manager.discoverSsdp()
+			}
 		}
 	}
 }
@@ -128,47 +231,267 @@ func (manager *WebsocketManager) ssdpLoop() {
 //go:embed dist
 var uiDist embed.FS
 
-func (manager *WebsocketManager) wsRpcLoop() error {
+func (manager *WebsocketManager) newRpcServer() (*rpc.Server, error) {
 	rpcServer := rpc.NewServer()
 	serialMediaErr := rpcServer.RegisterName("serialmedia", manager.serialConnections)
 	if serialMediaErr != nil {
-		panic(serialMediaErr)
+		return nil, serialMediaErr
 	}
 	httpMediaErr := rpcServer.RegisterName("httpmedia", manager.httpConnections)
 	if httpMediaErr != nil {
-		panic(httpMediaErr)
+		return nil, httpMediaErr
 	}
 	wsMediaErr := rpcServer.RegisterName("websocketmedia", manager.websocketConnections)
 	if wsMediaErr != nil {
-		panic(wsMediaErr)
+		return nil, wsMediaErr
 	}
+	nowPlayingErr := rpcServer.RegisterName("nowplaying", manager.nowPlaying)
+	if nowPlayingErr != nil {
+		return nil, nowPlayingErr
+	}
+	devicesErr := rpcServer.RegisterName("devices", manager.devices)
+	if devicesErr != nil {
+		return nil, devicesErr
+	}
+	artworkErr := rpcServer.RegisterName("artwork", manager.artwork)
+	if artworkErr != nil {
+		return nil, artworkErr
+	}
+	zonesErr := rpcServer.RegisterName("zones", manager.zones)
+	if zonesErr != nil {
+		return nil, zonesErr
+	}
+	schedulerErr := rpcServer.RegisterName("scheduler", manager.scheduler)
+	if schedulerErr != nil {
+		return nil, schedulerErr
+	}
+	return rpcServer, nil
+}
 
-	http.Handle("/ws", rpcServer.WebsocketHandler([]string{"*"}))
-	http.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
+func (manager *WebsocketManager) newMux(rpcServer *rpc.Server) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/ws", manager.auth.WebsocketHandler(rpcServer))
+	mux.Handle(rest.Prefix, manager.auth.Require(rest.New(manager.devices, rpcServer)))
+	mux.Handle("/art/", manager.auth.RequireScope(auth.Scope_Read, manager.artwork.Handler()))
+	mux.Handle("/metrics", manager.auth.RequireScope(auth.Scope_Read, manager.metrics.Handler()))
+	mux.HandleFunc("/favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "localWebUi/dist/favicon.ico")
 	})
 
 	pathStrippedUiDist, _ := fs.Sub(uiDist, "dist")
 	uiServer := http.FileServer(http.FS(pathStrippedUiDist))
-	http.Handle("/assets/", uiServer)
+	mux.Handle("/assets/", uiServer)
 
 	indexFile, _ := uiDist.Open("dist/index.html")
 	indexData, _ := io.ReadAll(indexFile)
-	indexReadSeeker := bytes.NewReader(indexData)
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeContent(w, r, "index.html", time.Time{}, indexReadSeeker)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "index.html", time.Time{}, bytes.NewReader(indexData))
 	})
-	log.Println("Starting web server")
-	return http.ListenAndServe(":8080", nil)
+	return mux
 }
 
-func RunWebsocketServer() error {
-	manager := WebsocketManager{
+// serve runs an HTTP server on a listener, reporting if it stops other than
+// by being shut down.
+func (manager *WebsocketManager) serve(server *http.Server, listener net.Listener) {
+	go func() {
+		serveErr := server.Serve(listener)
+		if serveErr != http.ErrServerClosed {
+			manager.serveErrors <- serveErr
+		}
+	}()
+}
+
+// New sets up a broker without connecting to anything yet.
+func New(brokerConfig config.Config) (*WebsocketManager, error) {
+	manager := &WebsocketManager{
+		config:               brokerConfig,
 		serialConnections:    serialmedia.New(),
 		httpConnections:      httpmedia.New(),
 		websocketConnections: extWebsocket.New(),
+		serveErrors:          make(chan error, 2),
+		ssdpHosts:            make(map[string]string),
+		ssdpBusy:             make(map[string]bool),
+		connecting:           make(map[string]bool),
+		descriptions:         upnp.NewDirectory(),
+	}
+	interfacesErr := useInterfaces(brokerConfig.Discovery.Interfaces)
+	if interfacesErr != nil {
+		return nil, interfacesErr
+	}
+	authenticator, authErr := auth.New(brokerConfig.Auth)
+	if authErr != nil {
+		return nil, authErr
 	}
+	manager.auth = authenticator
+	manager.serialConnections.ConnectTimeout = brokerConfig.ConnectTimeout
+	manager.httpConnections.ConnectTimeout = brokerConfig.ConnectTimeout
+	manager.websocketConnections.ConnectTimeout = brokerConfig.ConnectTimeout
 
-	go manager.ssdpLoop()
-	return manager.wsRpcLoop()
+	upgradeTracker := upgrades.New()
+	manager.serialConnections.Upgrades = upgradeTracker
+	manager.httpConnections.Upgrades = upgradeTracker
+	manager.websocketConnections.Upgrades = upgradeTracker
+	deviceRegistry, devicesErr := devices.New(manager.serialConnections, manager.httpConnections, manager.websocketConnections, upgradeTracker, brokerConfig.DevicesFile)
+	if devicesErr != nil {
+		return nil, devicesErr
+	}
+	manager.devices = deviceRegistry
+	manager.devices.Descriptions = manager.descriptions
+	manager.metrics = metrics.New(manager.devices, manager.serialConnections, manager.httpConnections, manager.websocketConnections)
+	arylicTransport.SetObserver(manager.metrics)
+	manager.nowPlaying = nowplaying.New(manager.serialConnections, manager.httpConnections, manager.websocketConnections)
+	artworkService, artworkErr := artwork.New(manager.websocketConnections, brokerConfig.ArtworkCache)
+	if artworkErr != nil {
+		return nil, artworkErr
+	}
+	manager.artwork = artworkService
+	zoneService, zonesErr := zones.New(manager.devices, brokerConfig.Zones, brokerConfig.ZonesFile)
+	if zonesErr != nil {
+		return nil, zonesErr
+	}
+	manager.zones = zoneService
+	schedulerService, schedulerErr := scheduler.New(manager.devices, manager.zones, brokerConfig.Scheduler)
+	if schedulerErr != nil {
+		return nil, schedulerErr
+	}
+	manager.scheduler = schedulerService
+
+	if brokerConfig.Discovery.Enabled && len(brokerConfig.Discovery.Scan.Ranges) != 0 {
+		scanner, scanErr := scan.New(brokerConfig.Discovery.Scan, brokerConfig.Transports.Serial.Port)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		scanner.Skip = manager.knownHost
+		scanner.Found = func(host string) {
+			log.Printf("Scan found device at %s\n", host)
+			manager.devices.Feed.Publish(devices.PresenceEvent{Kind: devices.Presence_Discovered, Host: host, Via: "scan"})
+			manager.connectHost(host)
+		}
+		manager.scanner = scanner
+	}
+
+	if brokerConfig.MQTT.Enabled {
+		manager.bridge = mqttbridge.New(brokerConfig.MQTT, manager.devices, manager.serialConnections, manager.httpConnections, manager.websocketConnections)
+	}
+	return manager, nil
+}
+
+// Start begins serving the web server and runs discovery and the other
+// background loops. Errors listening are returned straight away; the server
+// failing later is reported on Errors.
+func (manager *WebsocketManager) Start() error {
+	rpcServer, rpcErr := manager.newRpcServer()
+	if rpcErr != nil {
+		return rpcErr
+	}
+
+	listener, listenErr := net.Listen("tcp", manager.config.Listen)
+	if listenErr != nil {
+		return listenErr
+	}
+	if manager.config.TLS.Enabled {
+		tlsConfig, tlsErr := certs.Load(manager.config.TLS)
+		if tlsErr != nil {
+			listener.Close()
+			return tlsErr
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	if manager.config.TLS.Enabled && manager.config.TLS.RedirectHTTP != "" {
+		redirectListener, redirectErr := net.Listen("tcp", manager.config.TLS.RedirectHTTP)
+		if redirectErr != nil {
+			listener.Close()
+			return redirectErr
+		}
+		manager.redirectServer = &http.Server{Handler: certs.RedirectHandler(manager.config.Listen)}
+		manager.serve(manager.redirectServer, redirectListener)
+	}
+
+	manager.rpcServer = rpcServer
+	manager.server = &http.Server{Handler: manager.newMux(rpcServer)}
+	log.Printf("Starting web server on %s\n", listener.Addr())
+	manager.serve(manager.server, listener)
+
+	loopsCtx, stopLoops := context.WithCancel(context.Background())
+	manager.loops = &supervisor{ctx: loopsCtx}
+	manager.stopLoops = stopLoops
+	manager.loops.run("Discovery", manager.ssdpLoop)
+	if manager.config.Discovery.Enabled && manager.config.Discovery.Passive {
+		manager.loops.run("SSDP listener", manager.ssdpListenLoop)
+	}
+	if manager.scanner != nil {
+		manager.loops.run("Subnet scan", manager.scanner.Run)
+	}
+	manager.loops.run("Metrics", manager.metrics.Run)
+	manager.loops.run("Scheduler", func(ctx context.Context) error {
+		return scheduler.Loop(ctx, manager.scheduler)
+	})
+	if manager.bridge != nil {
+		manager.loops.run("MQTT bridge", manager.bridge.Run)
+	}
+	return nil
+}
+
+// Errors reports the web server stopping by itself after Start.
+func (manager *WebsocketManager) Errors() <-chan error {
+	return manager.serveErrors
+}
+
+// Stop shuts the broker down in order: the web server stops accepting
+// requests, open websockets and their subscriptions are closed, the
+// background loops are stopped, and then the device connections are closed.
+// ctx bounds how long to wait for each step.
+func (manager *WebsocketManager) Stop(ctx context.Context) error {
+	log.Println("Shutting down")
+	var stopErr error
+	if manager.redirectServer != nil {
+		manager.redirectServer.Shutdown(ctx)
+	}
+	if manager.server != nil {
+		stopErr = manager.server.Shutdown(ctx)
+	}
+	if manager.rpcServer != nil {
+		manager.rpcServer.Stop()
+	}
+	if manager.loops != nil {
+		manager.stopLoops()
+		waitErr := manager.loops.wait(ctx)
+		if waitErr != nil && stopErr == nil {
+			stopErr = fmt.Errorf("waiting for background loops: %w", waitErr)
+		}
+	}
+
+	serialmedia.CloseAll(manager.serialConnections)
+	httpmedia.CloseAll(manager.httpConnections)
+	extWebsocket.CloseAll(manager.websocketConnections)
+	return stopErr
+}
+
+// RunWebsocketServer runs the broker until it's interrupted or the web server
+// fails, then shuts it down.
+func RunWebsocketServer(brokerConfig config.Config) error {
+	manager, newErr := New(brokerConfig)
+	if newErr != nil {
+		return newErr
+	}
+	startErr := manager.Start()
+	if startErr != nil {
+		return startErr
+	}
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	var serveErr error
+	select {
+	case <-signals.Done():
+	case serveErr = <-manager.Errors():
+	}
+
+	ctx, ctxCancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer ctxCancel()
+	stopErr := manager.Stop(ctx)
+	if serveErr != nil {
+		return serveErr
+	}
+	return stopErr
 }
@@ -0,0 +1,360 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package zones manages broker-level zones, named sets of devices that take
+// commands together. Commands fan out to every member at once and report how
+// each one went.
+package zones
+
+import (
+	"arylic-connect/localWebsocketApi/config"
+	"arylic-connect/localWebsocketApi/devices"
+	"arylic-connect/rpcWrapper/serialMediaControl"
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var ErrZoneNotFound = errors.New("zone not found")
+var ErrStaticZone = errors.New("zone is defined in the config file")
+
+// Zone is a zone with whether it came from the config file, which makes it
+// read-only.
+type Zone struct {
+	Name    string              `json:"name"`
+	Members []config.ZoneMember `json:"members"`
+	Static  bool                `json:"static"`
+}
+
+// MemberResult is how a command went on one member. Result is what the same
+// call on the devices namespace returns.
+type MemberResult struct {
+	Device string      `json:"device"`
+	Result interface{} `json:"result,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+type ZoneResult struct {
+	Zone    string         `json:"zone"`
+	Members []MemberResult `json:"members"`
+	Failed  int            `json:"failed"`
+}
+
+// Member is a zone member with the ID of the device it refers to. ID is empty
+// for members that don't refer to a connected device.
+type Member struct {
+	config.ZoneMember
+	ID string
+}
+
+// Ref is what to send the member's commands to, its device ID when known.
+func (member Member) Ref() string {
+	if member.ID != "" {
+		return member.ID
+	}
+	return member.Device
+}
+
+// OffsetVolume is the volume for the member at a zone volume, with its offset
+// added and clamped to 0 - 1.
+func (member Member) OffsetVolume(level float32) float32 {
+	level += member.VolumeOffset
+	if level < 0 {
+		return 0
+	}
+	if level > 1 {
+		return 1
+	}
+	return level
+}
+
+// ResolveMembers works out which device each member refers to and drops those
+// that refer to a device already listed, keeping the first. A device can be
+// listed by name and by MAC, and would otherwise get toggles and skips twice.
+// Members that don't resolve are kept, so commands report them as failing.
+func ResolveMembers(ctx context.Context, registry *devices.Registry, members []config.ZoneMember) []Member {
+	resolved := make([]Member, 0, len(members))
+	seen := make(map[string]bool)
+	for _, member := range members {
+		next := Member{ZoneMember: member}
+		info, lookupErr := registry.GetDevice(ctx, member.Device)
+		if lookupErr == nil {
+			next.ID = info.ID
+		}
+		if seen[next.Ref()] {
+			continue
+		}
+		seen[next.Ref()] = true
+		resolved = append(resolved, next)
+	}
+	return resolved
+}
+
+type Service struct {
+	devices *devices.Registry
+	path    string
+
+	lock    sync.RWMutex
+	static  map[string]config.Zone
+	dynamic map[string]config.Zone
+}
+
+// New loads the zones saved at path on top of those from the config file.
+// An empty path uses the user config directory.
+func New(registry *devices.Registry, static []config.Zone, path string) (*Service, error) {
+	if path == "" {
+		configDir, dirErr := os.UserConfigDir()
+		if dirErr != nil {
+			return nil, dirErr
+		}
+		path = filepath.Join(configDir, "arylic-connect", "zones.yaml")
+	}
+	service := &Service{
+		devices: registry,
+		path:    path,
+		static:  make(map[string]config.Zone),
+		dynamic: make(map[string]config.Zone),
+	}
+	for _, zone := range static {
+		service.static[zone.Name] = zone
+	}
+
+	data, readErr := os.ReadFile(path)
+	if errors.Is(readErr, os.ErrNotExist) {
+		return service, nil
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+	saved := make([]config.Zone, 0)
+	unmarshalErr := yaml.Unmarshal(data, &saved)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, unmarshalErr)
+	}
+	for _, zone := range saved {
+		if _, isStatic := service.static[zone.Name]; !isStatic {
+			service.dynamic[zone.Name] = zone
+		}
+	}
+	return service, nil
+}
+
+// save writes out the API-made zones.
+//
+// Callers must hold the write lock.
+func (service *Service) save() error {
+	saved := make([]config.Zone, 0, len(service.dynamic))
+	for _, zone := range service.dynamic {
+		saved = append(saved, zone)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return saved[i].Name < saved[j].Name
+	})
+	return config.WriteYAML(service.path, saved)
+}
+
+// zone finds a zone by name.
+//
+// Callers must hold the read lock.
+func (service *Service) zone(name string) (Zone, error) {
+	static, isStatic := service.static[name]
+	if isStatic {
+		return Zone{Name: static.Name, Members: static.Members, Static: true}, nil
+	}
+	dynamic, isDynamic := service.dynamic[name]
+	if isDynamic {
+		return Zone{Name: dynamic.Name, Members: dynamic.Members}, nil
+	}
+	return Zone{}, ErrZoneNotFound
+}
+
+func (service *Service) ListZones(ctx context.Context) []Zone {
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+
+	list := make([]Zone, 0, len(service.static)+len(service.dynamic))
+	for name := range service.static {
+		found, _ := service.zone(name)
+		list = append(list, found)
+	}
+	for name := range service.dynamic {
+		found, _ := service.zone(name)
+		list = append(list, found)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (service *Service) GetZone(ctx context.Context, name string) (Zone, error) {
+	service.lock.RLock()
+	defer service.lock.RUnlock()
+	return service.zone(name)
+}
+
+// SetZone creates a zone or replaces its members. Members aren't checked
+// against connected devices, so a zone can include devices that are off.
+func (service *Service) SetZone(ctx context.Context, name string, members []config.ZoneMember) (Zone, error) {
+	if name == "" || len(members) == 0 {
+		return Zone{}, errors.New("a zone needs a name and members")
+	}
+	for _, member := range members {
+		if member.Device == "" {
+			return Zone{}, errors.New("zone members need a device")
+		}
+		if member.VolumeOffset < -1 || member.VolumeOffset > 1 {
+			return Zone{}, fmt.Errorf("volume offset for %s must be between -1 and 1", member.Device)
+		}
+	}
+
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	if _, isStatic := service.static[name]; isStatic {
+		return Zone{}, ErrStaticZone
+	}
+	previous, existed := service.dynamic[name]
+	service.dynamic[name] = config.Zone{Name: name, Members: members}
+	saveErr := service.save()
+	if saveErr != nil {
+		if existed {
+			service.dynamic[name] = previous
+		} else {
+			delete(service.dynamic, name)
+		}
+		return Zone{}, saveErr
+	}
+	return service.zone(name)
+}
+
+func (service *Service) DeleteZone(ctx context.Context, name string) error {
+	service.lock.Lock()
+	defer service.lock.Unlock()
+	if _, isStatic := service.static[name]; isStatic {
+		return ErrStaticZone
+	}
+	previous, existed := service.dynamic[name]
+	if !existed {
+		return ErrZoneNotFound
+	}
+	delete(service.dynamic, name)
+	saveErr := service.save()
+	if saveErr != nil {
+		service.dynamic[name] = previous
+		return saveErr
+	}
+	return nil
+}
+
+// fanOut runs a command on every device in a zone at once, collecting the
+// results in member order. Members referring to the same device run once.
+func (service *Service) fanOut(ctx context.Context, name string, command func(ctx context.Context, member Member) (interface{}, error)) (ZoneResult, error) {
+	service.lock.RLock()
+	target, zoneErr := service.zone(name)
+	service.lock.RUnlock()
+	if zoneErr != nil {
+		return ZoneResult{}, zoneErr
+	}
+
+	members := ResolveMembers(ctx, service.devices, target.Members)
+	result := ZoneResult{Zone: target.Name, Members: make([]MemberResult, len(members))}
+	var running sync.WaitGroup
+	for index, member := range members {
+		running.Add(1)
+		go func(index int, member Member) {
+			defer running.Done()
+			reply, commandErr := command(ctx, member)
+			if commandErr != nil {
+				result.Members[index] = MemberResult{Device: member.Device, Error: commandErr.Error()}
+				return
+			}
+			result.Members[index] = MemberResult{Device: member.Device, Result: reply}
+		}(index, member)
+	}
+	running.Wait()
+
+	for _, member := range result.Members {
+		if member.Error != "" {
+			result.Failed++
+		}
+	}
+	return result, nil
+}
+
+// SetVolume sets every member to the zone volume plus its offset, clamped to
+// 0 - 1.
+func (service *Service) SetVolume(ctx context.Context, name string, level float32) (ZoneResult, error) {
+	if level < 0 || level > 1 {
+		return ZoneResult{}, errors.New("volume must be between 0 and 1")
+	}
+	return service.fanOut(ctx, name, func(ctx context.Context, member Member) (interface{}, error) {
+		return service.devices.SetVolume(ctx, member.Ref(), member.OffsetVolume(level))
+	})
+}
+
+func (service *Service) SetMute(ctx context.Context, name string, state bool) (ZoneResult, error) {
+	return service.fanOut(ctx, name, func(ctx context.Context, member Member) (interface{}, error) {
+		return service.devices.SetMute(ctx, member.Ref(), state)
+	})
+}
+
+func (service *Service) SetSource(ctx context.Context, name string, source serialMediaControl.InputSource) (ZoneResult, error) {
+	return service.fanOut(ctx, name, func(ctx context.Context, member Member) (interface{}, error) {
+		return service.devices.SetSource(ctx, member.Ref(), source)
+	})
+}
+
+// each wraps a device command that only takes the device, for fanOut.
+func each(command func(ctx context.Context, ref string) (devices.Served, error)) func(ctx context.Context, member Member) (interface{}, error) {
+	return func(ctx context.Context, member Member) (interface{}, error) {
+		return command(ctx, member.Ref())
+	}
+}
+
+func (service *Service) RequestPlay(ctx context.Context, name string) (ZoneResult, error) {
+	return service.fanOut(ctx, name, each(service.devices.RequestPlay))
+}
+
+func (service *Service) RequestPause(ctx context.Context, name string) (ZoneResult, error) {
+	return service.fanOut(ctx, name, each(service.devices.RequestPause))
+}
+
+func (service *Service) RequestPlayPause(ctx context.Context, name string) (ZoneResult, error) {
+	return service.fanOut(ctx, name, each(service.devices.RequestPlayPause))
+}
+
+func (service *Service) RequestStop(ctx context.Context, name string) (ZoneResult, error) {
+	return service.fanOut(ctx, name, each(service.devices.RequestStop))
+}
+
+func (service *Service) RequestNext(ctx context.Context, name string) (ZoneResult, error) {
+	return service.fanOut(ctx, name, each(service.devices.RequestNext))
+}
+
+func (service *Service) RequestPrevious(ctx context.Context, name string) (ZoneResult, error) {
+	return service.fanOut(ctx, name, each(service.devices.RequestPrevious))
+}
+
+func (service *Service) RequestStandby(ctx context.Context, name string) (ZoneResult, error) {
+	return service.fanOut(ctx, name, each(service.devices.RequestStandby))
+}
@@ -23,4 +23,5 @@ import "errors"
 var (
 	ErrTransportNotConnected  = errors.New("transport is not connected")
 	ErrUnknownTransportFlavor = errors.New("transport flavor unknown")
+	ErrSettingNotApplied      = errors.New("device did not apply setting")
 )
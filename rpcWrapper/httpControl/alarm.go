@@ -0,0 +1,465 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpControl
+
+import (
+	"arylic-connect/rpcWrapper"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AlarmSlots is how many alarms the firmware can hold.
+const AlarmSlots = 3
+
+// AlarmTrigger is when an alarm fires.
+type AlarmTrigger int
+
+const (
+	Trigger_Off      AlarmTrigger = iota
+	Trigger_Once                  // Fires once on Date
+	Trigger_Daily                 // Fires every day
+	Trigger_Weekly                // Fires once a week on WeekDays[0]
+	Trigger_WeekDays              // Fires every week on each of WeekDays
+	Trigger_Monthly               // Fires every month on MonthDay
+)
+
+func (trigger AlarmTrigger) MarshalText() ([]byte, error) {
+	switch trigger {
+	case Trigger_Off:
+		return []byte("Off"), nil
+	case Trigger_Once:
+		return []byte("Once"), nil
+	case Trigger_Daily:
+		return []byte("Daily"), nil
+	case Trigger_Weekly:
+		return []byte("Weekly"), nil
+	case Trigger_WeekDays:
+		return []byte("WeekDays"), nil
+	case Trigger_Monthly:
+		return []byte("Monthly"), nil
+	default:
+		return []byte("Unknown"), errors.New("unknown alarm trigger")
+	}
+}
+
+func (trigger *AlarmTrigger) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "Off":
+		*trigger = Trigger_Off
+	case "Once":
+		*trigger = Trigger_Once
+	case "Daily":
+		*trigger = Trigger_Daily
+	case "Weekly":
+		*trigger = Trigger_Weekly
+	case "WeekDays":
+		*trigger = Trigger_WeekDays
+	case "Monthly":
+		*trigger = Trigger_Monthly
+	default:
+		*trigger = Trigger_Off
+		return errors.New("unknown alarm trigger")
+	}
+	return nil
+}
+
+// AlarmAction is what an alarm does when it fires.
+type AlarmAction int
+
+const (
+	Action_Play AlarmAction = iota // Play URL or switch to Source, or the built in ring if both are empty
+	Action_Stop                    // Stop whatever is playing
+)
+
+func (action AlarmAction) MarshalText() ([]byte, error) {
+	switch action {
+	case Action_Play:
+		return []byte("Play"), nil
+	case Action_Stop:
+		return []byte("Stop"), nil
+	default:
+		return []byte("Unknown"), errors.New("unknown alarm action")
+	}
+}
+
+func (action *AlarmAction) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "Play":
+		*action = Action_Play
+	case "Stop":
+		*action = Action_Stop
+	default:
+		*action = Action_Play
+		return errors.New("unknown alarm action")
+	}
+	return nil
+}
+
+// alarmSources are the inputs an alarm can switch to, by their names in the
+// switchmode player command.
+var alarmSources = map[string]bool{
+	"wifi":      true,
+	"line-in":   true,
+	"bluetooth": true,
+	"optical":   true,
+	"co-axial":  true,
+	"udisk":     true,
+}
+
+// alarmSourceCommand is run by the device's shell when a source alarm fires.
+// The alarm playback operation only takes a URL, so switching input goes back
+// through the device's own HTTP API using the shell operation.
+const alarmSourceCommand = "wget -q -O /dev/null http://127.0.0.1/httpapi.asp?command=setPlayerCmd:switchmode:"
+
+func (alarm Alarm) marshallApiOperation() (string, string) {
+	switch {
+	case alarm.Action == Action_Stop:
+		return "2", ""
+	case alarm.Source != "":
+		return "0", alarmSourceCommand + alarm.Source
+	default:
+		return "1", alarm.URL
+	}
+}
+
+// Alarm is a single on-device alarm slot. The device keeps time in UTC, so
+// Time, Date and the day fields are all UTC too.
+type Alarm struct {
+	Slot    int          `json:"slot"`
+	Trigger AlarmTrigger `json:"trigger"`
+	Action  AlarmAction  `json:"action"`
+
+	Time     string         `json:"time"`     // HH:MM:SS
+	Date     string         `json:"date"`     // YYYY-MM-DD, Trigger_Once only
+	WeekDays []time.Weekday `json:"weekDays"` // Trigger_Weekly and Trigger_WeekDays only
+	MonthDay int            `json:"monthDay"` // Trigger_Monthly only
+
+	URL    string  `json:"url"`
+	Source string  `json:"source"` // wifi, line-in, bluetooth, optical, co-axial or udisk, instead of URL
+	Volume float32 `json:"volume"` // 0 - 1, 0 leaves the volume alone
+}
+
+type rawAlarm struct {
+	Enable    string `json:"enable"`
+	Trigger   string `json:"trigger"`
+	Operation string `json:"operation"`
+	Date      string `json:"date"`
+	WeekDay   string `json:"week_day"`
+	Day       string `json:"day"`
+	Time      string `json:"time"`
+	Path      string `json:"path"`
+	Volume    string `json:"volume"`
+}
+
+var alarmTimeFormat = regexp.MustCompile(`^(\d{2}):?(\d{2}):?(\d{2})$`)
+
+// normalizeAlarmTime turns HHMMSS or HH:MM:SS into HH:MM:SS, as alarms are
+// read back.
+func normalizeAlarmTime(alarmTime string) (string, error) {
+	timeMatch := alarmTimeFormat.FindStringSubmatch(alarmTime)
+	if timeMatch == nil {
+		return "", errors.New("alarm time must be HH:MM:SS")
+	}
+	return fmt.Sprintf("%s:%s:%s", timeMatch[1], timeMatch[2], timeMatch[3]), nil
+}
+
+// marshallApiParams builds the parameters for setAlarmClock, after the slot.
+func (alarm Alarm) marshallApiParams() ([]string, error) {
+	if alarm.Trigger == Trigger_Off {
+		return []string{"0"}, nil
+	}
+
+	alarmTime, timeErr := normalizeAlarmTime(alarm.Time)
+	if timeErr != nil {
+		return nil, timeErr
+	}
+	apiTime := strings.ReplaceAll(alarmTime, ":", "")
+	if alarm.Source != "" && !alarmSources[alarm.Source] {
+		return nil, errors.New("unknown alarm source: " + alarm.Source)
+	}
+	if alarm.Source != "" && alarm.URL != "" {
+		return nil, errors.New("alarms play a URL or a source, not both")
+	}
+
+	day := ""
+	switch alarm.Trigger {
+	case Trigger_Once:
+		date, dateErr := time.Parse("2006-01-02", alarm.Date)
+		if dateErr != nil {
+			return nil, errors.New("alarm date must be YYYY-MM-DD")
+		}
+		day = date.Format("20060102")
+	case Trigger_Daily:
+	case Trigger_Weekly:
+		if len(alarm.WeekDays) != 1 {
+			return nil, errors.New("weekly alarms need exactly one week day")
+		}
+		day = fmt.Sprintf("%02d", int(alarm.WeekDays[0]))
+	case Trigger_WeekDays:
+		if len(alarm.WeekDays) == 0 {
+			return nil, errors.New("week day alarms need at least one week day")
+		}
+		mask := 0
+		for _, weekDay := range alarm.WeekDays {
+			mask |= 1 << int(weekDay)
+		}
+		day = fmt.Sprintf("%02X", mask)
+	case Trigger_Monthly:
+		if alarm.MonthDay < 1 || alarm.MonthDay > 31 {
+			return nil, errors.New("monthly alarms need a day between 1 and 31")
+		}
+		day = fmt.Sprintf("%02d", alarm.MonthDay)
+	default:
+		return nil, errors.New("unknown alarm trigger")
+	}
+
+	// The URL can contain ":" itself, so it goes last and is read to the end
+	// of the command. The volume always goes before it to keep it in place.
+	operation, path := alarm.marshallApiOperation()
+	params := []string{
+		strconv.Itoa(int(alarm.Trigger)),
+		operation,
+		apiTime,
+		day,
+		strconv.Itoa(int(math.Round(float64(alarm.Volume) * 100))),
+		path,
+	}
+
+	return params, nil
+}
+
+func (raw rawAlarm) normalize(slot int) Alarm {
+	alarm := Alarm{Slot: slot}
+	if raw.Enable != "1" {
+		return alarm
+	}
+
+	trigger, _ := strconv.Atoi(raw.Trigger)
+	alarm.Trigger = AlarmTrigger(trigger)
+	switch {
+	case raw.Operation == "2":
+		alarm.Action = Action_Stop
+	case raw.Operation == "0" && strings.HasPrefix(raw.Path, alarmSourceCommand):
+		alarm.Source = strings.TrimPrefix(raw.Path, alarmSourceCommand)
+	default:
+		alarm.URL = raw.Path
+	}
+
+	alarm.Time, _ = normalizeAlarmTime(raw.Time)
+
+	switch alarm.Trigger {
+	case Trigger_Once:
+		date, dateErr := time.Parse("20060102", raw.Date)
+		if dateErr == nil {
+			alarm.Date = date.Format("2006-01-02")
+		}
+	case Trigger_Weekly:
+		weekDay, _ := strconv.Atoi(raw.WeekDay)
+		alarm.WeekDays = []time.Weekday{time.Weekday(weekDay)}
+	case Trigger_WeekDays:
+		mask, _ := strconv.ParseInt(raw.WeekDay, 16, 32)
+		for weekDay := time.Sunday; weekDay <= time.Saturday; weekDay++ {
+			if mask&(1<<int(weekDay)) > 0 {
+				alarm.WeekDays = append(alarm.WeekDays, weekDay)
+			}
+		}
+	case Trigger_Monthly:
+		alarm.MonthDay, _ = strconv.Atoi(raw.Day)
+	}
+
+	volume, volumeErr := strconv.Atoi(raw.Volume)
+	if volumeErr == nil {
+		alarm.Volume = float32(volume) / 100
+	}
+
+	return alarm
+}
+
+// GetAlarm queries the device for the alarm in a slot.
+func (rpc *RPC) GetAlarm(ctx context.Context, slot int) (Alarm, error) {
+	if rpc.transport == nil {
+		return Alarm{}, rpcWrapper.ErrTransportNotConnected
+	}
+	if slot < 0 || slot >= AlarmSlots {
+		return Alarm{}, fmt.Errorf("alarm slot must be between 0 and %d", AlarmSlots-1)
+	}
+
+	reply, reqErr := rpc.transport.MakeRequest(ctx, "getAlarmClock", strconv.Itoa(slot))
+	if reqErr != nil {
+		return Alarm{}, reqErr
+	}
+
+	raw := rawAlarm{}
+	parseErr := json.Unmarshal(reply, &raw)
+	return raw.normalize(slot), parseErr
+}
+
+// SetAlarm requests the device store an alarm in the slot given by it, then
+// reads it back.
+func (rpc *RPC) SetAlarm(ctx context.Context, alarm Alarm) (Alarm, error) {
+	if rpc.transport == nil {
+		return Alarm{}, rpcWrapper.ErrTransportNotConnected
+	}
+	if alarm.Slot < 0 || alarm.Slot >= AlarmSlots {
+		return Alarm{}, fmt.Errorf("alarm slot must be between 0 and %d", AlarmSlots-1)
+	}
+	if alarm.Volume < 0 || alarm.Volume > 1 {
+		return Alarm{}, errors.New("alarm volume must be between 0 and 1")
+	}
+
+	params, paramsErr := alarm.marshallApiParams()
+	if paramsErr != nil {
+		return Alarm{}, paramsErr
+	}
+	if alarm.Trigger != Trigger_Off {
+		alarm.Time, _ = normalizeAlarmTime(alarm.Time)
+	}
+	params = append([]string{strconv.Itoa(alarm.Slot)}, params...)
+
+	reply, reqErr := rpc.transport.MakeRequest(ctx, "setAlarmClock", params...)
+	if reqErr != nil {
+		return Alarm{}, reqErr
+	}
+	if !strings.HasPrefix(string(reply), "OK") {
+		return Alarm{}, errors.New("alarm rejected by device: " + string(reply))
+	}
+
+	stored, getErr := rpc.GetAlarm(ctx, alarm.Slot)
+	if getErr != nil {
+		return stored, getErr
+	}
+	if stored.Trigger != alarm.Trigger || stored.Time != alarm.Time {
+		return stored, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return stored, nil
+}
+
+// ClearAlarm requests the device empty an alarm slot.
+func (rpc *RPC) ClearAlarm(ctx context.Context, slot int) error {
+	if rpc.transport == nil {
+		return rpcWrapper.ErrTransportNotConnected
+	}
+	if slot < 0 || slot >= AlarmSlots {
+		return fmt.Errorf("alarm slot must be between 0 and %d", AlarmSlots-1)
+	}
+
+	_, reqErr := rpc.transport.MakeRequest(ctx, "setAlarmClock", strconv.Itoa(slot), "0")
+	if reqErr != nil {
+		return reqErr
+	}
+
+	stored, getErr := rpc.GetAlarm(ctx, slot)
+	if getErr != nil {
+		return getErr
+	}
+	if stored.Trigger != Trigger_Off {
+		return rpcWrapper.ErrSettingNotApplied
+	}
+
+	return nil
+}
+
+// StopAlarm silences an alarm that is currently going off.
+func (rpc *RPC) StopAlarm(ctx context.Context) error {
+	if rpc.transport == nil {
+		return rpcWrapper.ErrTransportNotConnected
+	}
+
+	_, reqErr := rpc.transport.MakeRequest(ctx, "alarmStop")
+	return reqErr
+}
+
+// GetSleepTimer queries the device for the seconds left until it shuts down,
+// or -1 if no timer is set.
+func (rpc *RPC) GetSleepTimer(ctx context.Context) (int, error) {
+	if rpc.transport == nil {
+		return -1, rpcWrapper.ErrTransportNotConnected
+	}
+
+	reply, reqErr := rpc.transport.MakeRequest(ctx, "getShutdown")
+	if reqErr != nil {
+		return -1, reqErr
+	}
+
+	remaining, parseErr := strconv.Atoi(strings.TrimSpace(string(reply)))
+	if parseErr != nil {
+		return -1, errors.New("could not determine sleep timer from string: " + string(reply))
+	}
+	if remaining <= 0 {
+		return -1, nil
+	}
+
+	return remaining, nil
+}
+
+// SetSleepTimer requests the device shut down after the given seconds and
+// returns the seconds left as reported by the device.
+func (rpc *RPC) SetSleepTimer(ctx context.Context, seconds int) (int, error) {
+	if rpc.transport == nil {
+		return -1, rpcWrapper.ErrTransportNotConnected
+	}
+	if seconds <= 0 {
+		return -1, errors.New("sleep timer must be at least one second")
+	}
+
+	_, reqErr := rpc.transport.MakeRequest(ctx, "setShutdown", strconv.Itoa(seconds))
+	if reqErr != nil {
+		return -1, reqErr
+	}
+
+	remaining, getErr := rpc.GetSleepTimer(ctx)
+	if getErr != nil {
+		return remaining, getErr
+	}
+	if remaining < 0 {
+		return remaining, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return remaining, nil
+}
+
+// CancelSleepTimer requests the device drop any pending shutdown.
+func (rpc *RPC) CancelSleepTimer(ctx context.Context) error {
+	if rpc.transport == nil {
+		return rpcWrapper.ErrTransportNotConnected
+	}
+
+	_, reqErr := rpc.transport.MakeRequest(ctx, "setShutdown", "-1")
+	if reqErr != nil {
+		return reqErr
+	}
+
+	remaining, getErr := rpc.GetSleepTimer(ctx)
+	if getErr != nil {
+		return getErr
+	}
+	if remaining >= 0 {
+		return rpcWrapper.ErrSettingNotApplied
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpControl
+
+import (
+	"arylic-connect/rpcWrapper/serialMediaControl"
+)
+
+// Capabilities is the feature set of a device, decoded from the masks and odd
+// strings in EndpointStatus into something a UI can use directly.
+type Capabilities struct {
+	Model string `json:"model"`
+
+	// Inputs the device can switch to, in the same terms the serial API
+	// uses for sources.
+	Inputs []serialMediaControl.InputSource `json:"inputs"`
+
+	// Streaming services built into the firmware.
+	Streams []string `json:"streams"`
+
+	Presets   int  `json:"presets"`
+	Battery   bool `json:"battery"`
+	Multiroom bool `json:"multiroom"`
+
+	// Bits set in the capability mask. Linkplay doesn't document what they
+	// mean, so they're listed by number instead of guessing at names.
+	FeatureBits []int `json:"featureBits"`
+
+	// Not understood well enough to name yet, decoded from hex for
+	// anyone who wants to dig further.
+	Cap1Mask     uint64 `json:"cap1Mask"`
+	LanguageMask uint64 `json:"languageMask"`
+}
+
+// inputBits maps the plm_support bits onto input sources. Network is always
+// available and has no bit.
+var inputBits = []struct {
+	bit    int
+	source serialMediaControl.InputSource
+}{
+	{1, serialMediaControl.Input_LineIn1},
+	{2, serialMediaControl.Input_Bluetooth},
+	{3, serialMediaControl.Input_Usb},
+	{4, serialMediaControl.Input_Optical},
+	{6, serialMediaControl.Input_Coax},
+	{8, serialMediaControl.Input_LineIn2},
+	{15, serialMediaControl.Input_UsbDac},
+}
+
+var streamBits = []struct {
+	bit  int
+	name string
+}{
+	{0, "AirPlay"},
+	{1, "DLNA"},
+	{2, "TTPod"},
+	{3, "TuneIn"},
+	{4, "Pandora"},
+	{5, "DoubanFM"},
+}
+
+// Capabilities decodes the feature set out of the status.
+func (status EndpointStatus) Capabilities() Capabilities {
+	capabilities := Capabilities{
+		Model:     status.Model,
+		Inputs:    []serialMediaControl.InputSource{serialMediaControl.Input_Net},
+		Streams:   make([]string, 0),
+		Presets:   status.PresetCount,
+		Battery:   status.Battery.Present,
+		Multiroom: status.Versions.MultiroomLib != "",
+	}
+
+	for _, input := range inputBits {
+		if status.InputsMask[input.bit] {
+			capabilities.Inputs = append(capabilities.Inputs, input.source)
+		}
+	}
+
+	for _, stream := range streamBits {
+		if status.StreamsMask[stream.bit] {
+			capabilities.Streams = append(capabilities.Streams, stream.name)
+		}
+	}
+
+	capabilities.FeatureBits = make([]int, 0)
+	for bit, set := range status.ModuleFeatureMask {
+		if set {
+			capabilities.FeatureBits = append(capabilities.FeatureBits, bit)
+		}
+	}
+
+	capabilities.Cap1Mask = parseMask(status.Unknown.Cap1)
+	capabilities.LanguageMask = parseMask(status.Unknown.Languages)
+
+	return capabilities
+}
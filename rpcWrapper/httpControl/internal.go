@@ -0,0 +1,57 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpControl
+
+import (
+	"arylic-connect/rpcWrapper"
+	"context"
+	"errors"
+	"strings"
+)
+
+// ErrParamSeparator is returned for values containing ":", which the device
+// would read as the start of another parameter.
+var ErrParamSeparator = errors.New(`value can't contain ":"`)
+
+// setAndVerify sends a settings command and then re-reads the device status so
+// callers can check the change actually stuck. Most of the settings commands
+// just reply "OK" whether anything happened or not.
+func (rpc *RPC) setAndVerify(ctx context.Context, command string, params ...string) (EndpointStatus, error) {
+	sendErr := rpc.send(ctx, command, params...)
+	if sendErr != nil {
+		return EndpointStatus{}, sendErr
+	}
+
+	return rpc.GetStatus(ctx)
+}
+
+// send makes a settings request, ignoring the reply.
+func (rpc *RPC) send(ctx context.Context, command string, params ...string) error {
+	if rpc.transport == nil {
+		return rpcWrapper.ErrTransportNotConnected
+	}
+	for _, param := range params {
+		if strings.Contains(param, ":") {
+			return ErrParamSeparator
+		}
+	}
+
+	_, reqErr := rpc.transport.MakeRequest(ctx, command, params...)
+	return reqErr
+}
@@ -0,0 +1,139 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpControl
+
+import (
+	"arylic-connect/rpcWrapper"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"unicode/utf8"
+)
+
+// LocalTrack is a file on a USB drive or TF card plugged into the device.
+type LocalTrack struct {
+	Index    int    `json:"index"` // Position in the local playlist, from 0
+	File     string `json:"file"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Duration int    `json:"duration"` // Milliseconds, 0 if unknown
+}
+
+type rawLocalPlayList struct {
+	Num string `json:"num"`
+}
+
+type rawFileInfo struct {
+	Num      string `json:"num"`
+	InfoList []struct {
+		Filename string `json:"filename"`
+		TotLen   string `json:"totlen"`
+		Title    string `json:"Title"`
+		Artist   string `json:"Artist"`
+		Album    string `json:"Album"`
+	} `json:"infolist"`
+}
+
+// decodeHexField undoes the hex encoding the firmware uses for track titles,
+// artists and albums. Values that don't decode to valid UTF-8 are passed
+// through, as some firmware sends them as they are.
+func decodeHexField(value string) string {
+	decoded, decodeErr := hex.DecodeString(value)
+	if decodeErr != nil || !utf8.Valid(decoded) {
+		return value
+	}
+	return string(decoded)
+}
+
+// GetLocalTrackCount queries the device for how many tracks are on the inserted
+// USB drive or TF card.
+func (rpc *RPC) GetLocalTrackCount(ctx context.Context) (int, error) {
+	if rpc.transport == nil {
+		return 0, rpcWrapper.ErrTransportNotConnected
+	}
+
+	reply, reqErr := rpc.transport.MakeRequest(ctx, "getLocalPlayList")
+	if reqErr != nil {
+		return 0, reqErr
+	}
+
+	raw := rawLocalPlayList{}
+	parseErr := json.Unmarshal(reply, &raw)
+	if parseErr != nil {
+		return 0, parseErr
+	}
+
+	count, _ := strconv.Atoi(raw.Num)
+	return count, nil
+}
+
+// GetLocalTracks queries the device for up to count tracks off the inserted
+// USB drive or TF card, starting from the given index.
+func (rpc *RPC) GetLocalTracks(ctx context.Context, start int, count int) ([]LocalTrack, error) {
+	if rpc.transport == nil {
+		return nil, rpcWrapper.ErrTransportNotConnected
+	}
+	if start < 0 || count <= 0 {
+		return nil, errors.New("invalid track range")
+	}
+
+	reply, reqErr := rpc.transport.MakeRequest(ctx, "getFileInfo", strconv.Itoa(start), strconv.Itoa(count))
+	if reqErr != nil {
+		return nil, reqErr
+	}
+
+	raw := rawFileInfo{}
+	parseErr := json.Unmarshal(reply, &raw)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	tracks := make([]LocalTrack, len(raw.InfoList))
+	for i, info := range raw.InfoList {
+		duration, _ := strconv.Atoi(info.TotLen)
+		tracks[i] = LocalTrack{
+			Index:    start + i,
+			File:     info.Filename, // not hex encoded, unlike the tags
+			Title:    decodeHexField(info.Title),
+			Artist:   decodeHexField(info.Artist),
+			Album:    decodeHexField(info.Album),
+			Duration: duration,
+		}
+	}
+
+	return tracks, nil
+}
+
+// PlayLocalTrack requests the device play a track off the inserted USB drive
+// or TF card, switching input if needed.
+func (rpc *RPC) PlayLocalTrack(ctx context.Context, index int) error {
+	if rpc.transport == nil {
+		return rpcWrapper.ErrTransportNotConnected
+	}
+	if index < 0 {
+		return errors.New("invalid track index")
+	}
+
+	// The device counts playlist entries from 1
+	_, reqErr := rpc.transport.MakeRequest(ctx, "setPlayerCmd", "playLocalList", strconv.Itoa(index+1))
+	return reqErr
+}
@@ -0,0 +1,111 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpControl
+
+import (
+	"arylic-connect/rpcWrapper"
+	"context"
+	"errors"
+	"net"
+	"net/url"
+)
+
+// StaticIpConfig is the addressing used for the wired interface when DHCP is
+// turned off.
+type StaticIpConfig struct {
+	Ip      string `json:"ip"`
+	Netmask string `json:"netmask"`
+	Gateway string `json:"gateway"`
+}
+
+// None of the network configuration commands are part of the published API
+// docs, so each one checks GetStatus afterwards instead of trusting the reply.
+
+// SetEthernetDHCP requests the device get its wired address from DHCP.
+func (rpc *RPC) SetEthernetDHCP(ctx context.Context) error {
+	status, setErr := rpc.setAndVerify(ctx, "setEthDhcp")
+	if setErr != nil {
+		return setErr
+	}
+	if !status.Network.DHCPEnabled {
+		return rpcWrapper.ErrSettingNotApplied
+	}
+
+	return nil
+}
+
+// SetEthernetStatic requests the device use a fixed wired address and returns
+// whether the change was verified.
+//
+// Moving the device to a new address leaves this transport pointing at the
+// old one, so the change is only sent, and false is returned without an
+// error. Reconnect to the new address to confirm.
+func (rpc *RPC) SetEthernetStatic(ctx context.Context, config StaticIpConfig) (bool, error) {
+	for _, addr := range []string{config.Ip, config.Netmask, config.Gateway} {
+		if net.ParseIP(addr).To4() == nil {
+			return false, errors.New("invalid IPv4 address: " + addr)
+		}
+	}
+
+	target, parseErr := url.Parse(rpc.TransportTarget())
+	if parseErr != nil || target.Hostname() != config.Ip {
+		sendErr := rpc.send(ctx, "setEthStaticIp", config.Ip, config.Netmask, config.Gateway)
+		return false, sendErr
+	}
+
+	status, setErr := rpc.setAndVerify(ctx, "setEthStaticIp", config.Ip, config.Netmask, config.Gateway)
+	if setErr != nil {
+		return false, setErr
+	}
+	if status.Network.DHCPEnabled || status.Ethernet.Ip != config.Ip {
+		return false, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return true, nil
+}
+
+// SetDNS requests the device use the given DNS servers instead of whatever
+// DHCP hands out and returns if custom DNS is enabled afterwards. An empty
+// primary server goes back to the DHCP provided servers.
+func (rpc *RPC) SetDNS(ctx context.Context, primary string, secondary string) (bool, error) {
+	var status EndpointStatus
+	var setErr error
+	if primary == "" {
+		status, setErr = rpc.setAndVerify(ctx, "setDNS", "0")
+	} else {
+		params := []string{"1", primary}
+		if secondary != "" {
+			params = append(params, secondary)
+		}
+		for _, addr := range params[1:] {
+			if net.ParseIP(addr).To4() == nil {
+				return false, errors.New("invalid IPv4 address: " + addr)
+			}
+		}
+		status, setErr = rpc.setAndVerify(ctx, "setDNS", params...)
+	}
+	if setErr != nil {
+		return false, setErr
+	}
+	if status.Network.DNSEnabled != (primary != "") {
+		return status.Network.DNSEnabled, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return status.Network.DNSEnabled, nil
+}
@@ -0,0 +1,188 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpControl
+
+import (
+	"arylic-connect/rpcWrapper"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+type rawPlayerStatus struct {
+	Type      string `json:"type"`
+	Ch        string `json:"ch"`
+	Mode      string `json:"mode"`
+	Loop      string `json:"loop"`
+	Eq        string `json:"eq"`
+	Status    string `json:"status"`
+	CurPos    string `json:"curpos"`
+	OffsetPts string `json:"offset_pts"`
+	TotLen    string `json:"totlen"`
+	Title     string `json:"Title"`
+	Artist    string `json:"Artist"`
+	Album     string `json:"Album"`
+	AlarmFlag string `json:"alarmflag"`
+	PliCount  string `json:"plicount"`
+	PliCurr   string `json:"plicurr"`
+	Vol       string `json:"vol"`
+	Mute      string `json:"mute"`
+}
+
+// PlayerStatus is the playback state of the device, as opposed to the device
+// and network state in EndpointStatus.
+//
+// https://developer.arylic.com/httpapi/#get-player-status
+type PlayerStatus struct {
+	Mode  int    `json:"mode"`  // Raw playback mode, the rough equivalent of the input source
+	State string `json:"state"` // play, pause, stop or load
+
+	Playing  bool `json:"playing"`
+	Position int  `json:"position"` // Milliseconds
+	Duration int  `json:"duration"` // Milliseconds, 0 for streams
+
+	Title  string `json:"title"`
+	Artist string `json:"artist"`
+	Album  string `json:"album"`
+
+	Volume float32 `json:"volume"` // 0 - 1
+	Mute   bool    `json:"mute"`
+
+	Loop          int `json:"loop"`
+	PlaylistCount int `json:"playlistCount"`
+	PlaylistIndex int `json:"playlistIndex"`
+
+	AlarmActive bool `json:"alarmActive"`
+}
+
+func (status *PlayerStatus) UnmarshalJSON(input []byte) error {
+	rawStruct := rawPlayerStatus{}
+	initialParseErr := json.Unmarshal(input, &rawStruct)
+	if initialParseErr != nil {
+		return initialParseErr
+	}
+
+	status.Mode, _ = strconv.Atoi(rawStruct.Mode)
+	status.State = rawStruct.Status
+	status.Playing = rawStruct.Status == "play"
+	status.Position, _ = strconv.Atoi(rawStruct.CurPos)
+	status.Duration, _ = strconv.Atoi(rawStruct.TotLen)
+
+	status.Title = decodeHexField(rawStruct.Title)
+	status.Artist = decodeHexField(rawStruct.Artist)
+	status.Album = decodeHexField(rawStruct.Album)
+
+	volume, _ := strconv.Atoi(rawStruct.Vol)
+	status.Volume = float32(volume) / 100
+	status.Mute = rawStruct.Mute == "1"
+
+	status.Loop, _ = strconv.Atoi(rawStruct.Loop)
+	status.PlaylistCount, _ = strconv.Atoi(rawStruct.PliCount)
+	status.PlaylistIndex, _ = strconv.Atoi(rawStruct.PliCurr)
+
+	status.AlarmActive = rawStruct.AlarmFlag == "1"
+
+	return nil
+}
+
+// GetPlayerStatus queries the device for its current playback state.
+func (rpc *RPC) GetPlayerStatus(ctx context.Context) (PlayerStatus, error) {
+	status := PlayerStatus{}
+	if rpc.transport == nil {
+		return status, rpcWrapper.ErrTransportNotConnected
+	}
+
+	reply, reqErr := rpc.transport.MakeRequest(ctx, "getPlayerStatus")
+	if reqErr != nil {
+		return status, reqErr
+	}
+	parseErr := json.Unmarshal(reply, &status)
+	if parseErr != nil {
+		rpcWrapper.ParseFailed(rpc.transport)
+	}
+
+	return status, parseErr
+}
+
+// playerCommand sends one of the setPlayerCmd playback commands.
+func (rpc *RPC) playerCommand(ctx context.Context, params ...string) error {
+	if rpc.transport == nil {
+		return rpcWrapper.ErrTransportNotConnected
+	}
+
+	_, reqErr := rpc.transport.MakeRequest(ctx, "setPlayerCmd", params...)
+	return reqErr
+}
+
+// RequestPlay resumes playback of whatever was paused.
+func (rpc *RPC) RequestPlay(ctx context.Context) error {
+	return rpc.playerCommand(ctx, "resume")
+}
+
+func (rpc *RPC) RequestPause(ctx context.Context) error {
+	return rpc.playerCommand(ctx, "pause")
+}
+
+// RequestPlayPause toggles between playing and paused.
+func (rpc *RPC) RequestPlayPause(ctx context.Context) error {
+	return rpc.playerCommand(ctx, "onepause")
+}
+
+func (rpc *RPC) RequestStop(ctx context.Context) error {
+	return rpc.playerCommand(ctx, "stop")
+}
+
+func (rpc *RPC) RequestNext(ctx context.Context) error {
+	return rpc.playerCommand(ctx, "next")
+}
+
+func (rpc *RPC) RequestPrevious(ctx context.Context) error {
+	return rpc.playerCommand(ctx, "prev")
+}
+
+// SetVolume sets the volume, from 0 to 1, and returns what the device reports
+// afterwards.
+func (rpc *RPC) SetVolume(ctx context.Context, level float32) (float32, error) {
+	if level < 0 || level > 1 {
+		return 0, errors.New("volume must be between 0 and 1")
+	}
+
+	cmdErr := rpc.playerCommand(ctx, "vol", strconv.Itoa(int(level*100)))
+	if cmdErr != nil {
+		return 0, cmdErr
+	}
+	status, statusErr := rpc.GetPlayerStatus(ctx)
+	return status.Volume, statusErr
+}
+
+// SetMute mutes or unmutes the device and returns what it reports afterwards.
+func (rpc *RPC) SetMute(ctx context.Context, state bool) (bool, error) {
+	formattedState := "0"
+	if state {
+		formattedState = "1"
+	}
+
+	cmdErr := rpc.playerCommand(ctx, "mute", formattedState)
+	if cmdErr != nil {
+		return false, cmdErr
+	}
+	status, statusErr := rpc.GetPlayerStatus(ctx)
+	return status.Mute, statusErr
+}
@@ -0,0 +1,142 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpControl
+
+import (
+	"arylic-connect/rpcWrapper"
+	"context"
+	"encoding/hex"
+	"strings"
+)
+
+// SetDeviceName requests the device change its name and returns the name it
+// reports afterwards.
+func (rpc *RPC) SetDeviceName(ctx context.Context, name string) (string, error) {
+	status, setErr := rpc.setAndVerify(ctx, "setDeviceName", name)
+	if setErr != nil {
+		return "", setErr
+	}
+	if status.DeviceName != name {
+		return status.DeviceName, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return status.DeviceName, nil
+}
+
+// SetApSSID requests the device rename the access point it hosts itself and
+// returns the SSID it reports afterwards.
+func (rpc *RPC) SetApSSID(ctx context.Context, ssid string) (string, error) {
+	encoded := strings.ToUpper(hex.EncodeToString([]byte(ssid)))
+	status, setErr := rpc.setAndVerify(ctx, "setSSID", encoded)
+	if setErr != nil {
+		return "", setErr
+	}
+	if status.Wifi.LocalSSID != ssid {
+		return status.Wifi.LocalSSID, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return status.Wifi.LocalSSID, nil
+}
+
+// SetApPassword requests the device change the password of the access point it
+// hosts itself. An empty password leaves the access point open.
+//
+// The password is never reported back, so the status check only confirms the
+// device is still answering after the change.
+func (rpc *RPC) SetApPassword(ctx context.Context, password string) error {
+	var setErr error
+	if password == "" {
+		_, setErr = rpc.setAndVerify(ctx, "setNetwork", "0")
+	} else {
+		_, setErr = rpc.setAndVerify(ctx, "setNetwork", "1", password)
+	}
+
+	return setErr
+}
+
+// SetHideSSID requests the device hide or show the access point it hosts
+// itself and returns the result state.
+func (rpc *RPC) SetHideSSID(ctx context.Context, state bool) (bool, error) {
+	flag := "0"
+	if state {
+		flag = "1"
+	}
+
+	status, setErr := rpc.setAndVerify(ctx, "setHideSSID", flag)
+	if setErr != nil {
+		return false, setErr
+	}
+	if status.Wifi.HideSSID != state {
+		return status.Wifi.HideSSID, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return status.Wifi.HideSSID, nil
+}
+
+// SetVoicePrompt requests the device enable/disable any voice prompts and
+// returns the result state.
+func (rpc *RPC) SetVoicePrompt(ctx context.Context, state bool) (bool, error) {
+	command := "PromptDisable"
+	if state {
+		command = "PromptEnable"
+	}
+
+	status, setErr := rpc.setAndVerify(ctx, command)
+	if setErr != nil {
+		return false, setErr
+	}
+	if status.Settings.VoicePrompt != state {
+		return status.Settings.VoicePrompt, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return status.Settings.VoicePrompt, nil
+}
+
+// SetLanguage requests the device change its prompt language and returns the
+// language it reports afterwards. Valid values depend on the model and are
+// listed in EndpointStatus.Unknown.Languages.
+//
+// This is not part of the published API docs, so older firmware may ignore it.
+func (rpc *RPC) SetLanguage(ctx context.Context, language string) (string, error) {
+	status, setErr := rpc.setAndVerify(ctx, "setLanguage", language)
+	if setErr != nil {
+		return "", setErr
+	}
+	if status.Locale.Language != language {
+		return status.Locale.Language, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return status.Locale.Language, nil
+}
+
+// SetTimeZone requests the device change its time zone and returns the zone it
+// reports afterwards. The value takes the same form as EndpointStatus.Locale.Tz.
+//
+// This is not part of the published API docs, so older firmware may ignore it.
+func (rpc *RPC) SetTimeZone(ctx context.Context, tz string) (string, error) {
+	status, setErr := rpc.setAndVerify(ctx, "setTimeZone", tz)
+	if setErr != nil {
+		return "", setErr
+	}
+	if status.Locale.Tz != tz {
+		return status.Locale.Tz, rpcWrapper.ErrSettingNotApplied
+	}
+
+	return status.Locale.Tz, nil
+}
@@ -19,11 +19,13 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package httpControl
 
 import (
+	"arylic-connect/rpcWrapper"
 	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 // rawEndpointStatus is the truly awful mess of a  struct the far API returns
@@ -150,13 +152,7 @@ type EndpointStatus struct {
 		ApIp     string `json:"apIp"`
 	} `json:"wifi"`
 
-	Updates struct {
-		UpdateAvailable bool   `json:"updateAvailable"`
-		Version         string `json:"version"`
-
-		MCUAvailable string `json:"mcuAvailable"`
-		DSPAvailable string `json:"dspAvailable"`
-	} `json:"Updates"`
+	Updates UpdateInfo `json:"Updates"`
 
 	Versions struct {
 		Firmware   string `json:"firmware"`
@@ -175,6 +171,7 @@ type EndpointStatus struct {
 	} `json:"versions"`
 
 	Battery struct {
+		Present  bool    `json:"present"`
 		Charging bool    `json:"charging"`
 		Level    float32 `json:"level"` // 0 - 1
 	} `json:"battery"`
@@ -257,6 +254,19 @@ func wifiStatusMap(rawVal string) string {
 	}
 }
 
+// parseMask reads one of the bit masks in the status. They come through as hex
+// with a 0x prefix on most firmware, but plain decimal on some older builds.
+// Bits past the size of the mask are ignored by the caller, and anything that
+// won't parse counts as no bits set rather than the all set ParseUint gives
+// back on overflow.
+func parseMask(raw string) uint64 {
+	mask, parseErr := strconv.ParseUint(strings.TrimSpace(raw), 0, 64)
+	if parseErr != nil {
+		return 0
+	}
+	return mask
+}
+
 func (status *EndpointStatus) UnmarshalJSON(input []byte) error {
 	rawStruct := rawEndpointStatus{}
 	initialParseErr := json.Unmarshal(input, &rawStruct)
@@ -311,6 +321,7 @@ func (status *EndpointStatus) UnmarshalJSON(input []byte) error {
 	status.Versions.MultiroomLib = rawStruct.WmrmVersion
 	status.Versions.IOTLib = rawStruct.IotVer
 
+	status.Battery.Present = rawStruct.BatteryPercent != ""
 	status.Battery.Charging = rawStruct.Battery == "1"
 	batteryLevel, _ := strconv.Atoi(rawStruct.BatteryPercent)
 	status.Battery.Level = float32(batteryLevel) / 100
@@ -339,19 +350,19 @@ func (status *EndpointStatus) UnmarshalJSON(input []byte) error {
 	status.UPNP.Version = rawStruct.UpnpVersion
 	status.UPNP.ID = rawStruct.UpnpUUID
 
-	moduleMask, _ := strconv.Atoi(rawStruct.Capability)
-	for i, _ := range status.ModuleFeatureMask {
-		status.ModuleFeatureMask[i] = (moduleMask & (2 ^ i)) > 0
+	moduleMask := parseMask(rawStruct.Capability)
+	for i := range status.ModuleFeatureMask {
+		status.ModuleFeatureMask[i] = moduleMask&(1<<i) > 0
 	}
 
-	streamsMask, _ := strconv.Atoi(rawStruct.Streams)
-	for i, _ := range status.StreamsMask {
-		status.StreamsMask[i] = (streamsMask & (2 ^ i)) > 0
+	streamsMask := parseMask(rawStruct.Streams)
+	for i := range status.StreamsMask {
+		status.StreamsMask[i] = streamsMask&(1<<i) > 0
 	}
 
-	inputMask, _ := strconv.Atoi(rawStruct.PlmSupport)
-	for i, _ := range status.InputsMask {
-		status.InputsMask[i] = (inputMask & (2 ^ i)) > 0
+	inputMask := parseMask(rawStruct.PlmSupport)
+	for i := range status.InputsMask {
+		status.InputsMask[i] = inputMask&(1<<i) > 0
 	}
 
 	status.Settings.VoicePrompt = rawStruct.PromptStatus == "1"
@@ -387,6 +398,9 @@ func (rpc *RPC) GetStatus(ctx context.Context) (EndpointStatus, error) {
 		return status, reqErr
 	}
 	parseErr := json.Unmarshal(reply, &status)
+	if parseErr != nil {
+		rpcWrapper.ParseFailed(rpc.transport)
+	}
 
 	return status, parseErr
 }
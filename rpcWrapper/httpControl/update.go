@@ -0,0 +1,202 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package httpControl
+
+import (
+	"arylic-connect/rpcWrapper"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpdateInfo is the firmware update section of the device status.
+type UpdateInfo struct {
+	UpdateAvailable bool   `json:"updateAvailable"`
+	Version         string `json:"version"`
+
+	MCUAvailable string `json:"mcuAvailable"`
+	DSPAvailable string `json:"dspAvailable"`
+}
+
+// UpdateState is a simplified view of where a remote update is at.
+type UpdateState int
+
+const (
+	Update_Idle UpdateState = iota
+	Update_Checking
+	Update_Downloading
+	Update_Writing
+	Update_Complete
+	Update_Failed
+)
+
+func (state UpdateState) MarshalText() ([]byte, error) {
+	switch state {
+	case Update_Idle:
+		return []byte("Idle"), nil
+	case Update_Checking:
+		return []byte("Checking"), nil
+	case Update_Downloading:
+		return []byte("Downloading"), nil
+	case Update_Writing:
+		return []byte("Writing"), nil
+	case Update_Complete:
+		return []byte("Complete"), nil
+	case Update_Failed:
+		return []byte("Failed"), nil
+	default:
+		return []byte(fmt.Sprintf("Unknown :%d", state)), errors.New("unknown UpdateState value")
+	}
+}
+
+// UpdateProgress is the state of an in progress remote update.
+//
+// The status codes are barely documented, so the raw value is passed along
+// next to our best guess at what it means.
+type UpdateProgress struct {
+	State   UpdateState `json:"state"`
+	Code    int         `json:"code"`
+	Percent int         `json:"percent"` // 0 - 100, only moves while writing
+}
+
+// updateStateFromCode buckets the remote update status codes. Codes in the 10s
+// are the online check, 20s are downloading, 30s and 40s are writing to flash.
+// Anything 90 and up is a failure.
+func updateStateFromCode(code int) UpdateState {
+	switch {
+	case code <= 0:
+		return Update_Idle
+	case code < 20:
+		return Update_Checking
+	case code < 30:
+		return Update_Downloading
+	case code < 90:
+		return Update_Writing
+	default:
+		return Update_Failed
+	}
+}
+
+// CheckForUpdate asks the device to look for new firmware online and returns
+// what it found.
+func (rpc *RPC) CheckForUpdate(ctx context.Context) (UpdateInfo, error) {
+	if rpc.transport == nil {
+		return UpdateInfo{}, rpcWrapper.ErrTransportNotConnected
+	}
+
+	_, reqErr := rpc.transport.MakeRequest(ctx, "getMvRemoteUpdateStartCheck")
+	if reqErr != nil {
+		return UpdateInfo{}, reqErr
+	}
+
+	// The check runs in the background on the device, so give it a moment
+	// before reading the result back.
+	select {
+	case <-time.After(3 * time.Second):
+	case <-ctx.Done():
+		return UpdateInfo{}, ctx.Err()
+	}
+
+	status, statusErr := rpc.GetStatus(ctx)
+	return status.Updates, statusErr
+}
+
+// StartUpdate requests the device download and install the firmware found by
+// the last update check. The device reboots on its own once it finishes.
+func (rpc *RPC) StartUpdate(ctx context.Context) error {
+	if rpc.transport == nil {
+		return rpcWrapper.ErrTransportNotConnected
+	}
+
+	_, reqErr := rpc.transport.MakeRequest(ctx, "getMvRemoteUpdateStart")
+	return reqErr
+}
+
+// GetUpdateProgress queries the device for the state of a running update.
+func (rpc *RPC) GetUpdateProgress(ctx context.Context) (UpdateProgress, error) {
+	progress := UpdateProgress{}
+	if rpc.transport == nil {
+		return progress, rpcWrapper.ErrTransportNotConnected
+	}
+
+	statusReply, statusErr := rpc.transport.MakeRequest(ctx, "getMvRemoteUpdateStatus")
+	if statusErr != nil {
+		return progress, statusErr
+	}
+	code, codeErr := strconv.Atoi(strings.TrimSpace(string(statusReply)))
+	if codeErr != nil {
+		return progress, errors.New("could not determine update status from string: " + string(statusReply))
+	}
+	progress.Code = code
+	progress.State = updateStateFromCode(code)
+
+	if progress.State == Update_Writing {
+		percentReply, percentErr := rpc.transport.MakeRequest(ctx, "getMvRomBurnPrecent")
+		if percentErr != nil {
+			return progress, percentErr
+		}
+		// Fully written isn't complete, the device still has to reboot
+		// into the new firmware.
+		percent, _ := strconv.Atoi(strings.TrimSpace(string(percentReply)))
+		progress.Percent = percent
+	}
+
+	return progress, nil
+}
+
+// UpdateProgressChannel polls the device for update progress until the context
+// is cancelled, sending on every change. Failed polls are skipped, as the
+// device drops off the network while it reboots into the new firmware.
+func (rpc *RPC) UpdateProgressChannel(ctx context.Context, interval time.Duration) <-chan UpdateProgress {
+	outputChan := make(chan UpdateProgress)
+
+	go func() {
+		defer close(outputChan)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last *UpdateProgress
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				progress, progressErr := rpc.GetUpdateProgress(ctx)
+				if progressErr != nil {
+					continue
+				}
+				if last != nil && *last == progress {
+					continue
+				}
+				last = &progress
+				select {
+				case outputChan <- progress:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return outputChan
+}
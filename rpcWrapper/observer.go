@@ -0,0 +1,33 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package rpcWrapper
+
+import "arylic-connect/transport"
+
+// ParseFailed reports a reply that couldn't be understood to the transport
+// Observer, so malformed traffic shows up in metrics.
+func ParseFailed(t interface {
+	Flavor() transport.InterfaceFlavor
+	Target() string
+}) {
+	if t == nil {
+		return
+	}
+	transport.Observed().ParseFailure(t.Flavor(), t.Target())
+}
@@ -22,6 +22,7 @@ import (
 	"arylic-connect/rpcWrapper"
 	"arylic-connect/transport"
 	"context"
+	"time"
 )
 
 func requestWithResponse(ctx context.Context, t transport.AsyncLine, request string, replyPrefix string) ([]byte, error) {
@@ -33,8 +34,11 @@ func requestWithResponse(ctx context.Context, t transport.AsyncLine, request str
 		return nil, rpcWrapper.ErrUnknownTransportFlavor
 	}
 
-	returnChan := make(chan []byte)
-	defer close(returnChan)
+	// The read loop keeps the channel until the next reply comes in, even
+	// after this gives up, so it's buffered to take that reply and never
+	// closed.
+	sent := time.Now()
+	returnChan := make(chan []byte, 1)
 	otherReaders := t.RegisterOneshotReader(replyPrefix, returnChan)
 	if !otherReaders {
 		sendErr := t.SendMessage(ctx, request)
@@ -43,12 +47,7 @@ func requestWithResponse(ctx context.Context, t transport.AsyncLine, request str
 		}
 	}
 
-	select {
-	case value := <-returnChan:
-		return value, nil
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	}
+	return awaitReply(ctx, t, returnChan, sent)
 }
 
 func atomicRequestWithResponse(ctx context.Context, t transport.AsyncLine, request string, replyPrefix string) ([]byte, error) {
@@ -60,18 +59,29 @@ func atomicRequestWithResponse(ctx context.Context, t transport.AsyncLine, reque
 		return nil, rpcWrapper.ErrUnknownTransportFlavor
 	}
 
-	returnChan := make(chan []byte)
-	defer close(returnChan)
+	// The read loop keeps the channel until the next reply comes in, even
+	// after this gives up, so it's buffered to take that reply and never
+	// closed.
+	sent := time.Now()
+	returnChan := make(chan []byte, 1)
 
 	sendErr := t.SendMessageAtomic(ctx, request, replyPrefix, returnChan)
 	if sendErr != nil {
 		return nil, sendErr
 	}
 
+	return awaitReply(ctx, t, returnChan, sent)
+}
+
+// awaitReply waits for the reply to a request, reporting how long it took or
+// that it never came.
+func awaitReply(ctx context.Context, t transport.AsyncLine, returnChan <-chan []byte, sent time.Time) ([]byte, error) {
 	select {
 	case value := <-returnChan:
+		transport.ObservedFor(ctx).RoundTrip(t.Flavor(), t.Target(), time.Since(sent))
 		return value, nil
 	case <-ctx.Done():
+		transport.ObservedFor(ctx).Timeout(t.Flavor(), t.Target())
 		return nil, ctx.Err()
 	}
 }
@@ -44,8 +44,9 @@ func (rpc *RPC) GetInternet(ctx context.Context) (bool, error) {
 		return false, rpcWrapper.ErrUnknownTransportFlavor
 	}
 
-	returnChan := make(chan []byte)
-	defer close(returnChan)
+	// Buffered and never closed, as the read loop may still send after this
+	// gives up
+	returnChan := make(chan []byte, 1)
 	rpc.transport.RegisterOneshotReader(replyPrefix, returnChan)
 	sendErr := rpc.transport.SendMessage(ctx, request)
 	if sendErr != nil {
@@ -89,8 +90,9 @@ func (rpc *RPC) SetInternet(ctx context.Context, state bool) (bool, error) {
 		return false, rpcWrapper.ErrUnknownTransportFlavor
 	}
 
-	returnChan := make(chan []byte)
-	defer close(returnChan)
+	// Buffered and never closed, as the read loop may still send after this
+	// gives up
+	returnChan := make(chan []byte, 1)
 	rpc.transport.RegisterOneshotReader(replyPrefix, returnChan)
 	sendErr := rpc.transport.SendMessage(ctx, request)
 	if sendErr != nil {
@@ -129,8 +131,9 @@ func (rpc *RPC) GetEthernet(ctx context.Context) (bool, error) {
 		return false, rpcWrapper.ErrUnknownTransportFlavor
 	}
 
-	returnChan := make(chan []byte)
-	defer close(returnChan)
+	// Buffered and never closed, as the read loop may still send after this
+	// gives up
+	returnChan := make(chan []byte, 1)
 	rpc.transport.RegisterOneshotReader(replyPrefix, returnChan)
 	sendErr := rpc.transport.SendMessage(ctx, request)
 	if sendErr != nil {
@@ -35,8 +35,9 @@ func (rpc *RPC) DirectCommand(ctx context.Context, request string) (DirectComman
 		return command, rpcWrapper.ErrTransportNotConnected
 	}
 
-	returnChan := make(chan []byte)
-	defer close(returnChan)
+	// Buffered and never closed, as the read loop may still send after this
+	// gives up
+	returnChan := make(chan []byte, 1)
 	rpc.transport.RegisterOneshotReader("", returnChan)
 	sendErr := rpc.transport.SendMessage(ctx, request)
 	if sendErr != nil {
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package serialMediaControl
 
 import (
+	"arylic-connect/rpcWrapper"
 	"arylic-connect/transport"
 	"context"
 	"encoding/hex"
@@ -63,12 +64,16 @@ func (rpc *RPC) MetadataChangeChannel(ctx context.Context) <-chan MetadataChange
 			case input := <-inputChan:
 				matches := parser.FindSubmatch(input)
 				if matches == nil {
+					rpcWrapper.ParseFailed(rpc.transport)
 					log.Printf("Got a malformed response in streaming metadata")
 					continue
 				}
 
 				outputMessage := MetadataChangeMessage{}
 				parseErr := json.Unmarshal(matches[1], &outputMessage)
+				if parseErr != nil {
+					rpcWrapper.ParseFailed(rpc.transport)
+				}
 				if parseErr == nil {
 					album, _ := hex.DecodeString(outputMessage.Album)
 					artist, _ := hex.DecodeString(outputMessage.Artist)
@@ -155,6 +160,7 @@ func (rpc *RPC) VolumeChannel(ctx context.Context) <-chan float32 {
 			case input := <-inputChan:
 				matches := parser.FindSubmatch(input)
 				if matches == nil {
+					rpcWrapper.ParseFailed(rpc.transport)
 					log.Printf("could not determine volume from string: %s\n" + string(input))
 					continue
 				}
@@ -206,6 +212,7 @@ func (rpc *RPC) MuteChannel(ctx context.Context) <-chan bool {
 			case input := <-inputChan:
 				matches := parser.FindSubmatch(input)
 				if matches == nil {
+					rpcWrapper.ParseFailed(rpc.transport)
 					log.Printf("could not determine mute from string: %s\n" + string(input))
 					continue
 				}
@@ -256,6 +263,7 @@ func (rpc *RPC) PlayChannel(ctx context.Context) <-chan bool {
 			case input := <-inputChan:
 				matches := parser.FindSubmatch(input)
 				if matches == nil {
+					rpcWrapper.ParseFailed(rpc.transport)
 					log.Printf("could not determine play from string: %s\n" + string(input))
 					continue
 				}
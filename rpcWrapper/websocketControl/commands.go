@@ -0,0 +1,133 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package websocketControl
+
+import (
+	"arylic-connect/rpcWrapper"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The device pushes a fresh STATUS after every command that changes something,
+// so the setters here wait on that and hand back the new state.
+
+// statusReplyWait is how long a command waits for the STATUS that follows it
+// before asking for the status instead.
+const statusReplyWait = 2 * time.Second
+
+// commandWithStatus sends a command and waits for the STATUS that follows it.
+// Commands that change nothing, like setting the volume it's already at, get
+// no STATUS, so the status is read separately when none comes.
+func (rpc *RPC) commandWithStatus(ctx context.Context, command string) (StatusChangeMessage, error) {
+	status := incomingStatusChangeMessage{}
+
+	data, reqErr := atomicRequestWithResponse(ctx, rpc.transport, command, "STATUS", statusReplyWait)
+	if errors.Is(reqErr, errNoReply) {
+		return rpc.GetStatus(ctx)
+	}
+	if reqErr != nil {
+		return status.Normalize(), reqErr
+	}
+	jsonErr := json.Unmarshal(data, &status)
+	return status.Normalize(), jsonErr
+}
+
+// command sends a command without waiting on any reply.
+func (rpc *RPC) command(ctx context.Context, command string) error {
+	if rpc.transport == nil {
+		return rpcWrapper.ErrTransportNotConnected
+	}
+
+	return rpc.transport.SendMessage(ctx, command)
+}
+
+func (rpc *RPC) RequestPlay(ctx context.Context) error {
+	return rpc.command(ctx, "#CMD:PLAY")
+}
+
+func (rpc *RPC) RequestPause(ctx context.Context) error {
+	return rpc.command(ctx, "#CMD:PAUSE")
+}
+
+func (rpc *RPC) RequestNext(ctx context.Context) error {
+	return rpc.command(ctx, "#CMD:NEXT")
+}
+
+func (rpc *RPC) RequestPrevious(ctx context.Context) error {
+	return rpc.command(ctx, "#CMD:PREV")
+}
+
+// Seek requests the device jump to a position in the current track, in
+// milliseconds like StatusChangeMessage.Elapsed, and returns the status after
+// the jump. The device seeks to the second.
+func (rpc *RPC) Seek(ctx context.Context, position int) (StatusChangeMessage, error) {
+	if position < 0 {
+		return StatusChangeMessage{}, errors.New("seek position must not be negative")
+	}
+
+	return rpc.commandWithStatus(ctx, fmt.Sprintf("#CMD:SEEK:%d", position/1000))
+}
+
+// SetVolume requests the device change its volume and returns the result.
+func (rpc *RPC) SetVolume(ctx context.Context, level float32) (float32, error) {
+	if level < 0 || level > 1 {
+		return 0, errors.New("volume must be between 0 and 1")
+	}
+
+	status, statusErr := rpc.commandWithStatus(ctx, fmt.Sprintf("#CMD:VOL:%d", int(level*100)))
+	if statusErr != nil {
+		return 0, statusErr
+	}
+
+	return float32(status.Volume) / 100, nil
+}
+
+// SetInput requests the device change its input and returns the result. Inputs
+// use the same names the device reports in StatusChangeMessage.Input.
+func (rpc *RPC) SetInput(ctx context.Context, input string) (string, error) {
+	if input == "" {
+		return "", errors.New("no input given")
+	}
+
+	status, statusErr := rpc.commandWithStatus(ctx, "#CMD:INPUT:"+input)
+	if statusErr != nil {
+		return "", statusErr
+	}
+
+	return status.Input, nil
+}
+
+// SetLoopMode requests the device change how it moves through the queue and
+// returns the result. Modes use the same names the device reports in
+// StatusChangeMessage.Mode.
+func (rpc *RPC) SetLoopMode(ctx context.Context, mode string) (string, error) {
+	if mode == "" {
+		return "", errors.New("no loop mode given")
+	}
+
+	status, statusErr := rpc.commandWithStatus(ctx, "#CMD:LOOPMODE:"+mode)
+	if statusErr != nil {
+		return "", statusErr
+	}
+
+	return status.Mode, nil
+}
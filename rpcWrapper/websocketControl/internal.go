@@ -22,6 +22,8 @@ import (
 	"arylic-connect/rpcWrapper"
 	"arylic-connect/transport"
 	"context"
+	"errors"
+	"time"
 )
 
 func requestWithResponse(ctx context.Context, t transport.AsyncMessage, request interface{}, replyCommand string) ([]byte, error) {
@@ -33,8 +35,11 @@ func requestWithResponse(ctx context.Context, t transport.AsyncMessage, request
 		return nil, rpcWrapper.ErrUnknownTransportFlavor
 	}
 
-	returnChan := make(chan []byte)
-	defer close(returnChan)
+	// The read loop keeps the channel until the next reply comes in, even
+	// after this gives up, so it's buffered to take that reply and never
+	// closed.
+	sent := time.Now()
+	returnChan := make(chan []byte, 1)
 	otherReaders := t.RegisterOneshotReader(replyCommand, returnChan)
 	if !otherReaders {
 		sendErr := t.SendMessage(ctx, request)
@@ -43,35 +48,61 @@ func requestWithResponse(ctx context.Context, t transport.AsyncMessage, request
 		}
 	}
 
+	return awaitReply(ctx, t, returnChan, sent)
+}
+
+// errNoReply is returned when a command gets no reply within the wait, which is
+// what the device does when the command changes nothing.
+var errNoReply = errors.New("no reply from device")
+
+// atomicRequestWithResponse queues the reply listener together with the request,
+// so a reply meant for an earlier request can't be mistaken for this one. It
+// waits up to replyWait for the reply before giving up with errNoReply.
+func atomicRequestWithResponse(ctx context.Context, t transport.AsyncMessage, request interface{}, replyCommand string, replyWait time.Duration) ([]byte, error) {
+	if t == nil {
+		return nil, rpcWrapper.ErrTransportNotConnected
+	}
+
+	if request == nil {
+		return nil, rpcWrapper.ErrUnknownTransportFlavor
+	}
+
+	// The read loop keeps the channel until the next reply comes in, even
+	// after this gives up, so it's buffered to take that reply and never
+	// closed.
+	sent := time.Now()
+	returnChan := make(chan []byte, 1)
+
+	sendErr := t.SendMessageAtomic(ctx, request, replyCommand, returnChan)
+	if sendErr != nil {
+		return nil, sendErr
+	}
+
+	// No reply within replyWait is normal here, so it isn't counted as a
+	// timeout. Only the caller giving up is.
+	waitTimer := time.NewTimer(replyWait)
+	defer waitTimer.Stop()
 	select {
 	case value := <-returnChan:
+		transport.ObservedFor(ctx).RoundTrip(t.Flavor(), t.Target(), time.Since(sent))
 		return value, nil
+	case <-waitTimer.C:
+		return nil, errNoReply
 	case <-ctx.Done():
+		transport.ObservedFor(ctx).Timeout(t.Flavor(), t.Target())
 		return nil, ctx.Err()
 	}
 }
 
-//func atomicRequestWithResponse(ctx context.Context, t transport.AsyncLine, request string, replyPrefix string) ([]byte, error) {
-//	if t == nil {
-//		return nil, rpcWrapper.ErrTransportNotConnected
-//	}
-//
-//	if request == "" {
-//		return nil, rpcWrapper.ErrUnknownTransportFlavor
-//	}
-//
-//	returnChan := make(chan []byte)
-//	defer close(returnChan)
-//
-//	sendErr := t.SendMessageAtomic(ctx, request, replyPrefix, returnChan)
-//	if sendErr != nil {
-//		return nil, sendErr
-//	}
-//
-//	select {
-//	case value := <-returnChan:
-//		return value, nil
-//	case <-ctx.Done():
-//		return nil, ctx.Err()
-//	}
-//}
+// awaitReply waits for the reply to a request, reporting how long it took or
+// that it never came.
+func awaitReply(ctx context.Context, t transport.AsyncMessage, returnChan <-chan []byte, sent time.Time) ([]byte, error) {
+	select {
+	case value := <-returnChan:
+		transport.ObservedFor(ctx).RoundTrip(t.Flavor(), t.Target(), time.Since(sent))
+		return value, nil
+	case <-ctx.Done():
+		transport.ObservedFor(ctx).Timeout(t.Flavor(), t.Target())
+		return nil, ctx.Err()
+	}
+}
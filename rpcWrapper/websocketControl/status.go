@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package websocketControl
 
 import (
+	"arylic-connect/rpcWrapper"
 	"context"
 	"encoding/json"
 )
@@ -33,5 +34,8 @@ func (rpc *RPC) GetStatus(ctx context.Context) (StatusChangeMessage, error) {
 		return status.Normalize(), reqErr
 	}
 	jsonErr := json.Unmarshal(data, &status)
+	if jsonErr != nil {
+		rpcWrapper.ParseFailed(rpc.transport)
+	}
 	return status.Normalize(), jsonErr
 }
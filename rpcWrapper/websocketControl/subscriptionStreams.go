@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package websocketControl
 
 import (
+	"arylic-connect/rpcWrapper"
 	"context"
 	"encoding/json"
 	"golang.org/x/net/html"
@@ -68,8 +69,8 @@ type StatusChangeMessage struct {
 	Index int
 	Mode  string
 
-	Elapsed  int
-	Duration int
+	Elapsed  int // Milliseconds, matching the HTTP API
+	Duration int // Milliseconds, 0 for streams
 
 	Title  string
 	Artist string
@@ -98,6 +99,9 @@ func (rpc *RPC) StatusChangeChannel(ctx context.Context) <-chan StatusChangeMess
 			case input := <-inputChan:
 				outputMessage := incomingStatusChangeMessage{}
 				parseErr := json.Unmarshal(input, &outputMessage)
+				if parseErr != nil {
+					rpcWrapper.ParseFailed(rpc.transport)
+				}
 				if parseErr == nil {
 					select {
 					case outputChan <- outputMessage.Normalize():
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 type Transport struct {
@@ -55,14 +56,23 @@ func (t *Transport) MakeRequest(ctx context.Context, command string, params ...s
 		return nil, reqErr
 	}
 
+	sent := time.Now()
 	resp, reqErr := t.client.Do(req)
 	if reqErr != nil {
+		if errors.Is(reqErr, context.DeadlineExceeded) {
+			transport.ObservedFor(ctx).Timeout(t.Flavor(), t.Target())
+		}
 		return nil, reqErr
 	}
+	transport.ObservedFor(ctx).CommandSent(t.Flavor(), t.Target())
 
 	defer resp.Body.Close()
 
-	return io.ReadAll(resp.Body)
+	body, readErr := io.ReadAll(resp.Body)
+	if readErr == nil {
+		transport.ObservedFor(ctx).RoundTrip(t.Flavor(), t.Target(), time.Since(sent))
+	}
+	return body, readErr
 }
 
 func (t *Transport) Close() error {
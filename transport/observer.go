@@ -0,0 +1,92 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package transport
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Observer receives measurements from the transports so the broker can export
+// them as metrics. Targets are as returned by the transport's Target.
+//
+// Implementations must be safe for use by multiple threads and shouldn't block.
+type Observer interface {
+	// CommandSent counts a message put on the wire.
+	CommandSent(flavor InterfaceFlavor, target string)
+	// QueueWait records how long a message waited for the connection.
+	QueueWait(flavor InterfaceFlavor, target string, wait time.Duration)
+	// RoundTrip records the time from sending a request to its reply.
+	RoundTrip(flavor InterfaceFlavor, target string, elapsed time.Duration)
+	// Timeout counts a request that gave up waiting.
+	Timeout(flavor InterfaceFlavor, target string)
+	// ParseFailure counts a reply that couldn't be understood.
+	ParseFailure(flavor InterfaceFlavor, target string)
+	// Reconnect counts a connection to a device that had been connected
+	// before.
+	Reconnect(flavor InterfaceFlavor, target string)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) CommandSent(InterfaceFlavor, string)              {}
+func (nopObserver) QueueWait(InterfaceFlavor, string, time.Duration) {}
+func (nopObserver) RoundTrip(InterfaceFlavor, string, time.Duration) {}
+func (nopObserver) Timeout(InterfaceFlavor, string)                  {}
+func (nopObserver) ParseFailure(InterfaceFlavor, string)             {}
+func (nopObserver) Reconnect(InterfaceFlavor, string)                {}
+
+type observerHolder struct {
+	observer Observer
+}
+
+var currentObserver atomic.Value
+
+func init() {
+	currentObserver.Store(observerHolder{nopObserver{}})
+}
+
+// SetObserver routes transport measurements to an Observer.
+func SetObserver(observer Observer) {
+	currentObserver.Store(observerHolder{observer})
+}
+
+// Observed returns the Observer measurements should be reported to. It's a
+// no-op until SetObserver is called.
+func Observed() Observer {
+	return currentObserver.Load().(observerHolder).observer
+}
+
+type unobservedKey struct{}
+
+// Unobserved marks requests made with ctx as not to be measured, such as the
+// broker polling devices to fill in the metrics themselves.
+func Unobserved(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unobservedKey{}, true)
+}
+
+// ObservedFor returns the Observer for a request made with ctx, which is a
+// no-op for unobserved requests.
+func ObservedFor(ctx context.Context) Observer {
+	if ctx != nil && ctx.Value(unobservedKey{}) != nil {
+		return nopObserver{}
+	}
+	return Observed()
+}
@@ -19,6 +19,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package tcp
 
 import (
+	"arylic-connect/transport"
 	"context"
 	"log"
 	"time"
@@ -38,12 +39,16 @@ func (t *Transport) asyncWriteLoop() {
 			err := t.writeMessage(atomicMsg.outMessage)
 			if err != nil {
 				log.Println(err.Error())
+			} else {
+				transport.ObservedFor(atomicMsg.ctx).CommandSent(t.Flavor(), t.Target())
 			}
 			time.Sleep(200 * time.Millisecond)
 		case msg := <-t.outgoingQueue:
-			err := t.writeMessage(msg)
+			err := t.writeMessage(msg.message)
 			if err != nil {
 				log.Println(err.Error())
+			} else {
+				transport.ObservedFor(msg.ctx).CommandSent(t.Flavor(), t.Target())
 			}
 			time.Sleep(200 * time.Millisecond)
 		}
@@ -54,10 +59,13 @@ func (t *Transport) asyncWriteLoop() {
 // multiple threads as the internal queue keeps the connection clean and allows
 // for aborting the context if required.
 func (t *Transport) SendMessage(ctx context.Context, message string) error {
+	queued := time.Now()
 	select {
-	case t.outgoingQueue <- message:
+	case t.outgoingQueue <- queuedMessage{ctx: ctx, message: message}:
+		transport.ObservedFor(ctx).QueueWait(t.Flavor(), t.Target(), time.Since(queued))
 		return nil
 	case <-ctx.Done():
+		transport.ObservedFor(ctx).Timeout(t.Flavor(), t.Target())
 		return ctx.Err()
 	}
 }
@@ -69,10 +77,13 @@ func (t *Transport) SendMessageAtomic(ctx context.Context, message string, prefi
 		outMessage:   message,
 		outchan:      outchan,
 	}
+	queued := time.Now()
 	select {
 	case t.atomicOutgoingQueue <- wrapped:
+		transport.ObservedFor(ctx).QueueWait(t.Flavor(), t.Target(), time.Since(queued))
 		return nil
 	case <-ctx.Done():
+		transport.ObservedFor(ctx).Timeout(t.Flavor(), t.Target())
 		return ctx.Err()
 	}
 }
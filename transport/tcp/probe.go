@@ -0,0 +1,61 @@
+/*
+arylic-connect, an API broker for Arylic Audio devices
+Copyright (C) 2023  Zach Strauss
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"net"
+)
+
+// Probe checks whether a target speaks the tunnel protocol, by sending payload
+// and waiting for any reply framed with the start sequence.
+func Probe(ctx context.Context, target string, payload string) error {
+	dialer := net.Dialer{}
+	conn, dialErr := dialer.DialContext(ctx, "tcp", target)
+	if dialErr != nil {
+		return dialErr
+	}
+	defer conn.Close()
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		conn.SetDeadline(deadline)
+	}
+
+	probe := Transport{conn: conn}
+	writeErr := probe.writeMessage(payload)
+	if writeErr != nil {
+		return writeErr
+	}
+
+	reader := bufio.NewReader(conn)
+	matched := 0
+	for matched < len(startSequence) {
+		nextByte, readErr := reader.ReadByte()
+		if readErr != nil {
+			return readErr
+		}
+		if nextByte == startSequence[matched] {
+			matched++
+		} else {
+			matched = 0
+		}
+	}
+	return nil
+}
@@ -26,6 +26,11 @@ import (
 	"time"
 )
 
+type queuedMessage struct {
+	ctx     context.Context
+	message string
+}
+
 type atomicListenerPair struct {
 	ctx          context.Context
 	listenPrefix string
@@ -45,7 +50,7 @@ type Transport struct {
 
 	// use an unbuffered channel to queue up commands to enable the context-aware
 	// sending, as sending to a channel is cancel-able, unlike the socket write
-	outgoingQueue chan string
+	outgoingQueue chan queuedMessage
 
 	atomicOutgoingQueue chan atomicListenerPair
 }
@@ -65,7 +70,7 @@ func (t *Transport) Connect(target string) error {
 	}
 
 	t.listenerCloser = make(chan int)
-	t.outgoingQueue = make(chan string)
+	t.outgoingQueue = make(chan queuedMessage)
 
 	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
 	if err != nil {
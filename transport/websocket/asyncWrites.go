@@ -19,8 +19,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package websocket
 
 import (
+	"arylic-connect/transport"
 	"context"
 	"log"
+	"time"
 )
 
 // asyncWriteLoop picks an item off the outgoingQueue and puts it on the wire.
@@ -34,12 +36,16 @@ func (t *Transport) asyncWriteLoop() {
 			err := t.writeMessage(atomicMsg.outMessage)
 			if err != nil {
 				log.Println(err.Error())
+			} else {
+				transport.ObservedFor(atomicMsg.ctx).CommandSent(t.Flavor(), t.Target())
 			}
 			//time.Sleep(200 * time.Millisecond)
 		case msg := <-t.outgoingQueue:
-			err := t.writeMessage(msg)
+			err := t.writeMessage(msg.message)
 			if err != nil {
 				log.Println(err.Error())
+			} else {
+				transport.ObservedFor(msg.ctx).CommandSent(t.Flavor(), t.Target())
 			}
 			//time.Sleep(200 * time.Millisecond)
 		}
@@ -50,10 +56,13 @@ func (t *Transport) asyncWriteLoop() {
 // multiple threads as the internal queue keeps the connection clean and allows
 // for aborting the context if required.
 func (t *Transport) SendMessage(ctx context.Context, message interface{}) error {
+	queued := time.Now()
 	select {
-	case t.outgoingQueue <- message:
+	case t.outgoingQueue <- queuedMessage{ctx: ctx, message: message}:
+		transport.ObservedFor(ctx).QueueWait(t.Flavor(), t.Target(), time.Since(queued))
 		return nil
 	case <-ctx.Done():
+		transport.ObservedFor(ctx).Timeout(t.Flavor(), t.Target())
 		return ctx.Err()
 	}
 }
@@ -65,10 +74,13 @@ func (t *Transport) SendMessageAtomic(ctx context.Context, message interface{},
 		outMessage:    message,
 		outchan:       outchan,
 	}
+	queued := time.Now()
 	select {
 	case t.atomicOutgoingQueue <- wrapped:
+		transport.ObservedFor(ctx).QueueWait(t.Flavor(), t.Target(), time.Since(queued))
 		return nil
 	case <-ctx.Done():
+		transport.ObservedFor(ctx).Timeout(t.Flavor(), t.Target())
 		return ctx.Err()
 	}
 }
@@ -25,6 +25,11 @@ import (
 	"sync"
 )
 
+type queuedMessage struct {
+	ctx     context.Context
+	message interface{}
+}
+
 type atomicListenerPair struct {
 	ctx           context.Context
 	listenCommand string
@@ -42,7 +47,7 @@ type Transport struct {
 
 	// use an unbuffered channel to queue up commands to enable the context-aware
 	// sending, as sending to a channel is cancel-able, unlike the socket write
-	outgoingQueue chan interface{}
+	outgoingQueue chan queuedMessage
 
 	atomicOutgoingQueue chan atomicListenerPair
 }
@@ -62,7 +67,7 @@ func (t *Transport) Connect(target string) error {
 	}
 
 	t.listenerCloser = make(chan int)
-	t.outgoingQueue = make(chan interface{})
+	t.outgoingQueue = make(chan queuedMessage)
 
 	conn, _, err := websocket.DefaultDialer.Dial(target, nil)
 	if err != nil {